@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"wg-bridge/internal/validator"
+)
+
+// allowedIPsPolicyFile limits the AllowedIPs peers of each interface may
+// claim.
+const allowedIPsPolicyFile = "/etc/cockpit-wg/allowedips-policy"
+
+// routePolicy lists the networks peers may route. Supernets, if any, must
+// contain every route. MinPrefixV4/MinPrefixV6 reject routes wider than the
+// given prefix length, as in the exchange policy. AllowCatchAll permits
+// 0.0.0.0/0 and ::/0 for full-tunnel clients; unset, the validation mode
+// decides, lenient allowing them and strict not.
+type routePolicy struct {
+	Supernets     []string `json:"supernets"`
+	MinPrefixV4   int      `json:"minPrefixV4"`
+	MinPrefixV6   int      `json:"minPrefixV6"`
+	AllowCatchAll *bool    `json:"allowCatchAll"`
+}
+
+// allowedIPsPolicy applies Default to every interface without an entry in
+// Interfaces. An entry replaces the default as a whole.
+type allowedIPsPolicy struct {
+	Default    routePolicy            `json:"default"`
+	Interfaces map[string]routePolicy `json:"interfaces"`
+}
+
+// loadAllowedIPsPolicy returns an empty policy, limiting nothing, when no
+// policy file exists.
+func loadAllowedIPsPolicy(path string) (*allowedIPsPolicy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &allowedIPsPolicy{}, nil
+		}
+		return nil, err
+	}
+	return parseAllowedIPsPolicy(path, b)
+}
+
+func parseAllowedIPsPolicy(path string, b []byte) (*allowedIPsPolicy, error) {
+	var p allowedIPsPolicy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := p.Default.check(); err != nil {
+		return nil, fmt.Errorf("%s: default: %w", path, err)
+	}
+	for name, r := range p.Interfaces {
+		if !ifaceRx.MatchString(name) {
+			return nil, fmt.Errorf("%s: invalid interface name %q", path, name)
+		}
+		if err := r.check(); err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", path, name, err)
+		}
+	}
+	return &p, nil
+}
+
+func (r routePolicy) check() error {
+	if r.MinPrefixV4 < 0 || r.MinPrefixV4 > 32 || r.MinPrefixV6 < 0 || r.MinPrefixV6 > 128 {
+		return fmt.Errorf("invalid prefix limit")
+	}
+	for _, s := range r.Supernets {
+		if _, _, err := net.ParseCIDR(s); err != nil {
+			return fmt.Errorf("invalid supernet %q", s)
+		}
+	}
+	return nil
+}
+
+// limits returns the route limits of the interface name. lenient is the
+// validation mode, which decides on catch-all routes unless the policy
+// does.
+func (p *allowedIPsPolicy) limits(name string, lenient bool) validator.RouteLimits {
+	r, ok := p.Interfaces[name]
+	if !ok {
+		r = p.Default
+	}
+	l := validator.RouteLimits{MinPrefixV4: r.MinPrefixV4, MinPrefixV6: r.MinPrefixV6, AllowCatchAll: lenient}
+	if r.AllowCatchAll != nil {
+		l.AllowCatchAll = *r.AllowCatchAll
+	}
+	for _, s := range r.Supernets {
+		_, network, _ := net.ParseCIDR(s)
+		l.Supernets = append(l.Supernets, network)
+	}
+	return l
+}
+
+// checkBundleRoutes turns down a bundle for iface whose peers claim
+// AllowedIPs the policy of the interface does not permit. Checking on
+// import rather than on apply keeps such bundles out of the pending
+// directory and tells the sender why.
+func checkBundleRoutes(iface, typ string, payload []byte) error {
+	allowed, err := bundleAllowedIPs(typ, payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPayloadInvalid, err)
+	}
+	policy, err := loadValidation()
+	if err != nil {
+		return err
+	}
+	if err := policy.validator(iface).CheckRoutes(allowed); err != nil {
+		return fmt.Errorf("%w: %v", ErrRoutesNotAllowed, err)
+	}
+	return nil
+}
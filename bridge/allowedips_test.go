@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseAllowedIPsPolicy(t *testing.T) {
+	p, err := parseAllowedIPsPolicy("p", []byte(`{
+		"default": {"supernets": ["10.0.0.0/16"], "minPrefixV4": 24},
+		"interfaces": {"wg-client": {"allowCatchAll": true}}
+	}`))
+	if err != nil {
+		t.Fatalf("parseAllowedIPsPolicy: %v", err)
+	}
+	if l := p.limits("wg0", true); len(l.Supernets) != 1 || l.MinPrefixV4 != 24 || !l.AllowCatchAll {
+		t.Errorf("wg0 limits = %+v", l)
+	}
+	if l := p.limits("wg-client", false); len(l.Supernets) != 0 || l.MinPrefixV4 != 0 || !l.AllowCatchAll {
+		t.Errorf("wg-client limits = %+v", l)
+	}
+	for _, b := range []string{
+		`{"default":{"supernets":["10.0.0.0"]}}`,
+		`{"default":{"minPrefixV4":33}}`,
+		`{"interfaces":{"wg0":{"minPrefixV6":-1}}}`,
+		`{"interfaces":{"../wg0":{}}}`,
+		`not json`,
+	} {
+		if _, err := parseAllowedIPsPolicy("p", []byte(b)); err == nil {
+			t.Errorf("%s: expected policy to be rejected", b)
+		}
+	}
+}
+
+func TestAllowedIPsPolicyEnforced(t *testing.T) {
+	priv, _, _ := genKeyPair()
+	_, peer, _ := genKeyPair()
+	withPeer := func(allowed string) string {
+		return "[Interface]\nPrivateKey = " + priv + "\n\n[Peer]\nPublicKey = " + peer + "\nAllowedIPs = " + allowed + "\n"
+	}
+	yes := true
+	routes, _ := parseAllowedIPsPolicy("p", []byte(`{"default":{"supernets":["10.0.0.0/16"],"minPrefixV4":24}}`))
+	routes.Interfaces = map[string]routePolicy{"wg-client": {AllowCatchAll: &yes}}
+	p := &validationPolicy{Default: validationStrict, routes: routes}
+
+	cases := []struct {
+		iface, allowed string
+		ok             bool
+	}{
+		{"wg0", "10.0.3.0/24", true},
+		{"wg0", "10.0.0.0/8", false},
+		{"wg0", "10.1.0.0/24", false},
+		{"wg0", "0.0.0.0/0", false},
+		{"wg-client", "0.0.0.0/0, ::/0", true},
+		{"wg-client", "192.168.1.0/24", true},
+	}
+	for _, tc := range cases {
+		_, err := p.check(tc.iface, withPeer(tc.allowed))
+		if tc.ok && err != nil {
+			t.Errorf("%s on %s: unexpected error %v", tc.allowed, tc.iface, err)
+		}
+		if !tc.ok && !errors.Is(err, ErrValidation) {
+			t.Errorf("%s on %s: expected ErrValidation, got %v", tc.allowed, tc.iface, err)
+		}
+		// AddPeer, UpdatePeer and bundle import check routes on their own
+		// and must agree with config validation
+		if err := p.validator(tc.iface).CheckRoutes(strings.Split(tc.allowed, ",")); (err == nil) != tc.ok {
+			t.Errorf("CheckRoutes(%s) on %s = %v", tc.allowed, tc.iface, err)
+		}
+	}
+
+	// A lenient interface accepts catch-all routes unless the policy says no
+	no := false
+	p.Interfaces = map[string]string{"wg-client": validationLenient}
+	p.routes.Interfaces["wg-client"] = routePolicy{AllowCatchAll: &no}
+	if _, err := p.check("wg-client", withPeer("0.0.0.0/0")); !errors.Is(err, ErrValidation) {
+		t.Errorf("expected catch-all to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"wg-bridge/internal/bundle"
+	"wg-bridge/internal/validator"
+)
+
+// announceIface is the manifest interface of key rotation announcements,
+// which concern the node rather than one of its interfaces.
+const announceIface = "node-keys"
+
+// newKeySignature is the archive entry holding a signature of payload.json
+// made with the announced signing key, proving possession of it.
+const newKeySignature = "payload.json.minisig"
+
+var ErrAnnouncementInvalid = fmt.Errorf("%w: invalid key announcement", ErrBundle)
+
+// keyAnnouncement is the payload of a node-key-rotation bundle. The bundle
+// itself is signed with the old signing key, so trusting it only requires
+// trusting OldFingerprint.
+type keyAnnouncement struct {
+	Node           string `json:"node"`
+	OldFingerprint string `json:"oldFingerprint"`
+	NewFingerprint string `json:"newFingerprint"`
+	NewSigningKey  string `json:"newSigningKey"`
+	NewExchangeKey string `json:"newExchangeKey"`
+	Time           string `json:"time"`
+}
+
+func decodeAnnouncement(data []byte) (*keyAnnouncement, error) {
+	var a keyAnnouncement
+	if err := json.Unmarshal(data, &a); err != nil {
+		return nil, err
+	}
+	if !fingerprintRx.MatchString(a.OldFingerprint) {
+		return nil, fmt.Errorf("invalid old fingerprint")
+	}
+	_, id, err := publicKeyFingerprint(a.NewSigningKey)
+	if err != nil || id != a.NewFingerprint {
+		return nil, fmt.Errorf("new signing key does not match its fingerprint")
+	}
+	if id == a.OldFingerprint {
+		return nil, fmt.Errorf("signing key unchanged")
+	}
+	if !ageRecipientRx.MatchString(a.NewExchangeKey) {
+		return nil, fmt.Errorf("invalid exchange key")
+	}
+	return &a, nil
+}
+
+// readPublicKeyFile returns the key line and fingerprint of a minisign .pub
+// file.
+func readPublicKeyFile(path string) (string, string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+	return publicKeyFingerprint(string(b))
+}
+
+// announceRotation seals a bundle telling every known node about new keys
+// and returns its outbox path. oldKey is the archived minisign secret key
+// the announcement is signed with; the new signing key signs the payload as
+// well.
+func announceRotation(oldKey, oldPub string) (string, error) {
+	_, oldID, err := readPublicKeyFile(oldPub)
+	if err != nil {
+		return "", err
+	}
+	newLine, newID, err := readPublicKeyFile(signingPubKey)
+	if err != nil {
+		return "", err
+	}
+	exchange, err := getExchangeKey()
+	if err != nil {
+		return "", err
+	}
+	nodes, err := listNodes()
+	if err != nil {
+		return "", err
+	}
+	recipients := []string{}
+	for _, n := range nodes {
+		if !contains(recipients, n.ExchangeKey) {
+			recipients = append(recipients, n.ExchangeKey)
+		}
+	}
+	if len(recipients) == 0 {
+		return "", nil
+	}
+	host, _ := os.Hostname()
+	payload, _ := json.Marshal(keyAnnouncement{
+		Node:           host,
+		OldFingerprint: oldID,
+		NewFingerprint: newID,
+		NewSigningKey:  newLine,
+		NewExchangeKey: exchange,
+		Time:           time.Now().UTC().Format(time.RFC3339),
+	})
+	key, err := readSigningKey(signingPrivKey)
+	if err != nil {
+		return "", err
+	}
+	proof := key.sign("payload.json", payload)
+	path, entry, err := sealBundleWith(announceIface, validator.TypeNodeKeyRotation, payload, recipients, oldKey,
+		[]bundle.File{{Name: newKeySignature, Data: proof}})
+	auditExchange("announce-keys", "", entry.Checksum, err)
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// deliverAnnouncement sends a sealed announcement to the known nodes. It is
+// called without the key lock held, since transports may be slow; nodes it
+// does not reach are retried by flushOutbox.
+func deliverAnnouncement(path string) {
+	if path == "" {
+		return
+	}
+	if _, err := deliverBundle(path); err != nil {
+		auditExchange("announce-keys", "", "", err)
+	}
+	select {
+	case outboxQueued <- struct{}{}:
+	default:
+	}
+}
+
+// acceptAnnouncement verifies the key chain of an announcement received
+// from s and moves the trust entries of the announcing node to the new keys.
+func acceptAnnouncement(s *signer, archive *bundle.Archive, payload []byte) (*keyAnnouncement, error) {
+	a, err := decodeAnnouncement(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrAnnouncementInvalid, err)
+	}
+	if a.OldFingerprint != s.Fingerprint {
+		return nil, fmt.Errorf("%w: announcement not signed by the key it replaces", ErrAnnouncementInvalid)
+	}
+	proof, err := archive.Require(newKeySignature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBundle, err)
+	}
+	if err := verifyData(a.NewSigningKey, payload, proof); err != nil {
+		return nil, fmt.Errorf("%w: new key signature does not verify", ErrAnnouncementInvalid)
+	}
+	if err := rotateSigner(s, a); err != nil {
+		return nil, err
+	}
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
+	dir, err := loadNodes()
+	if err != nil {
+		return nil, err
+	}
+	changed := false
+	for _, n := range dir.Nodes {
+		if n.SigningFingerprint == a.OldFingerprint {
+			n.SigningFingerprint = a.NewFingerprint
+			n.ExchangeKey = a.NewExchangeKey
+			changed = true
+		}
+	}
+	if changed {
+		if err := saveNodes(dir); err != nil {
+			return nil, err
+		}
+	}
+	params, _ := json.Marshal(map[string]string{"signer": s.Name, "old": a.OldFingerprint, "new": a.NewFingerprint})
+	auditLog("KeyRotationAnnouncement", params, nil)
+	return a, nil
+}
+
+// rotateSigner replaces the key of s in the keyring, keeping the old
+// fingerprint in its history.
+func rotateSigner(s *signer, a *keyAnnouncement) error {
+	keyringMu.Lock()
+	defer keyringMu.Unlock()
+	kr, err := loadKeyring()
+	if err != nil {
+		return err
+	}
+	entry := kr.find(a.OldFingerprint)
+	if entry == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownSigner, s.Name)
+	}
+	if other := kr.find(a.NewFingerprint); other != nil && other != entry {
+		return fmt.Errorf("%w: key %s already belongs to %s", ErrAnnouncementInvalid, a.NewFingerprint, other.Name)
+	}
+	entry.Previous = append(entry.Previous, a.OldFingerprint)
+	entry.Fingerprint = a.NewFingerprint
+	entry.PublicKey = strings.TrimSpace(a.NewSigningKey)
+	entry.Rotated = time.Now().UTC().Format(time.RFC3339)
+	return saveKeyring(kr)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDecodeAnnouncement(t *testing.T) {
+	valid := keyAnnouncement{
+		Node:           "hq",
+		OldFingerprint: "1111111111111111",
+		NewFingerprint: "0807060504030201",
+		NewSigningKey:  testMinisignLine("Ed", 42),
+		NewExchangeKey: "age1" + strings.Repeat("q", 58),
+		Time:           "2024-01-01T00:00:00Z",
+	}
+	b, _ := json.Marshal(valid)
+	if _, err := decodeAnnouncement(b); err != nil {
+		t.Fatalf("valid announcement rejected: %v", err)
+	}
+
+	cases := map[string]func(a *keyAnnouncement){
+		"old fingerprint":  func(a *keyAnnouncement) { a.OldFingerprint = "xyz" },
+		"fingerprint":      func(a *keyAnnouncement) { a.NewFingerprint = "1111111111111111" },
+		"unchanged":        func(a *keyAnnouncement) { a.OldFingerprint = a.NewFingerprint },
+		"signature line":   func(a *keyAnnouncement) { a.NewSigningKey = testMinisignLine("ED", 74) },
+		"exchange key":     func(a *keyAnnouncement) { a.NewExchangeKey = "age1short" },
+		"missing exchange": func(a *keyAnnouncement) { a.NewExchangeKey = "" },
+	}
+	for name, mutate := range cases {
+		t.Run(name, func(t *testing.T) {
+			a := valid
+			mutate(&a)
+			b, _ := json.Marshal(a)
+			if _, err := decodeAnnouncement(b); err == nil {
+				t.Fatal("expected announcement to be rejected")
+			}
+		})
+	}
+}
+
+func TestAcceptAnnouncementWrongSigner(t *testing.T) {
+	a := keyAnnouncement{
+		OldFingerprint: "1111111111111111",
+		NewFingerprint: "0807060504030201",
+		NewSigningKey:  testMinisignLine("Ed", 42),
+		NewExchangeKey: "age1" + strings.Repeat("q", 58),
+	}
+	b, _ := json.Marshal(a)
+	s := &signer{Name: "branch", Fingerprint: "2222222222222222"}
+	_, err := acceptAnnouncement(s, nil, b)
+	if bundleReason(err) != "announcement_invalid" {
+		t.Fatalf("expected announcement_invalid, got %v", err)
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestAuthorizeRejectsUnknownMethod(t *testing.T) {
 	if err := authorize("BogusMethod"); err == nil {
@@ -13,3 +16,20 @@ func TestAuthorizeAllowsKnownMethod(t *testing.T) {
 		t.Fatalf("expected allowed method, got %v", err)
 	}
 }
+
+func TestRedactLargeParams(t *testing.T) {
+	long := strings.Repeat("A", 4096)
+	p := redact(map[string]interface{}{
+		"bundle":     "QUJD",
+		"signature":  "untrusted comment: signature",
+		"privateKey": "x",
+		"name":       "wg0",
+		"peers":      []interface{}{map[string]interface{}{"comment": long}},
+	}).(map[string]interface{})
+	if p["bundle"] != "<4 bytes>" || p["signature"] != "<28 bytes>" || p["privateKey"] != "<redacted>" || p["name"] != "wg0" {
+		t.Fatalf("unexpected params %v", p)
+	}
+	if got := p["peers"].([]interface{})[0].(map[string]interface{})["comment"]; got != "<4096 bytes>" {
+		t.Fatalf("long value logged as %v", got)
+	}
+}
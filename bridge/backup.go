@@ -0,0 +1,651 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+
+	"wg-bridge/internal/bundle"
+	"wg-bridge/internal/validator"
+)
+
+const (
+	backupDir     = "/var/lib/cockpit-wg/backups"
+	backupVersion = 1
+	// minPassphrase is the shortest passphrase accepted for new backups.
+	minPassphrase = 12
+)
+
+var backupNameRx = regexp.MustCompile(`^[a-zA-Z0-9_.-]+\.wgbackup$`)
+
+// backupWorkFactor is the scrypt work factor of new backups, the age
+// default. Tests lower it.
+var backupWorkFactor = 18
+
+// backupLimits bound what RestoreBackup reads: every key generation and
+// interface config plus the bridge state.
+var backupLimits = bundle.Limits{
+	MaxEntries:   1024,
+	MaxEntrySize: 1 << 20,  // 1MB
+	MaxTotalSize: 64 << 20, // 64MB
+}
+
+var ErrBackupInvalid = fmt.Errorf("%w: invalid backup", ErrValidation)
+
+// backupManifest is stored as backup.json at the root of the archive.
+type backupManifest struct {
+	Version int      `json:"version"`
+	Host    string   `json:"host"`
+	Created string   `json:"created"`
+	Entries []string `json:"entries"`
+}
+
+// backupState and backupPolicies map the entries of the state/ and etc/
+// archive directories to the files they are taken from.
+var backupState = map[string]string{
+	"nodes.json":          nodesFile,
+	"keyring.json":        keyringFile,
+	"exchange-state.json": exchangeStateFile,
+	"key-rotation.json":   keyRotationFile,
+}
+
+var backupPolicies = map[string]string{
+	"exchange-policy":   exchangePolicyFile,
+	"key-policy":        keyPolicyFile,
+	"validation-policy": validationPolicyFile,
+	"allowedips-policy": allowedIPsPolicyFile,
+	"lint.yaml":         lintConfigFile,
+}
+
+// backupContents is a decrypted and validated backup.
+type backupContents struct {
+	Manifest backupManifest
+	Keys     map[string][]byte
+	Configs  map[string][]byte
+	State    map[string][]byte
+	Policies map[string][]byte
+}
+
+// isKeyFile reports whether name is a current or archived key file.
+func isKeyFile(name string) bool {
+	for _, k := range keyFiles {
+		if suffix, ok := strings.CutPrefix(name, k); ok && (suffix == "" || archiveSuffixRx.MatchString(suffix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// collectBackup reads the keys, interface configs, state and policies of
+// this node.
+func collectBackup() ([]bundle.File, error) {
+	files := []bundle.File{}
+	add := func(name, src string) error {
+		b, err := os.ReadFile(src)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		files = append(files, bundle.File{Name: name, Data: b})
+		return nil
+	}
+	if entries, err := os.ReadDir(keyDir); err == nil {
+		for _, e := range entries {
+			if !e.IsDir() && isKeyFile(e.Name()) {
+				if err := add("keys/"+e.Name(), filepath.Join(keyDir, e.Name())); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if entries, err := os.ReadDir("/etc/wireguard"); err == nil {
+		for _, e := range entries {
+			name, ok := strings.CutSuffix(e.Name(), ".conf")
+			if e.IsDir() || !ok || !ifaceRx.MatchString(name) {
+				continue
+			}
+			if err := add("wireguard/"+e.Name(), filepath.Join("/etc/wireguard", e.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for name, src := range backupState {
+		if err := add("state/"+name, src); err != nil {
+			return nil, err
+		}
+	}
+	for name, src := range backupPolicies {
+		if err := add("etc/"+name, src); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+// writeBackup writes files and a manifest as a tar archive encrypted to
+// passphrase.
+func writeBackup(w io.Writer, passphrase string, files []bundle.File) error {
+	if len(passphrase) < minPassphrase {
+		return fmt.Errorf("%w: passphrase must have at least %d characters", ErrValidation, minPassphrase)
+	}
+	r, err := age.NewScryptRecipient(passphrase)
+	if err != nil {
+		return err
+	}
+	r.SetWorkFactor(backupWorkFactor)
+	host, _ := os.Hostname()
+	m := backupManifest{Version: backupVersion, Host: host, Created: time.Now().UTC().Format(time.RFC3339), Entries: []string{}}
+	for _, f := range files {
+		m.Entries = append(m.Entries, f.Name)
+	}
+	manBytes, _ := json.MarshalIndent(m, "", "  ")
+	enc, err := age.Encrypt(w, r)
+	if err != nil {
+		return err
+	}
+	if err := bundle.Write(enc, append([]bundle.File{{Name: "backup.json", Data: manBytes}}, files...)); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// readBackup decrypts a backup and validates every entry. Nothing is
+// written; a backup failing any check is rejected as a whole.
+func readBackup(r io.Reader, passphrase string) (*backupContents, error) {
+	id, err := age.NewScryptIdentity(passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBackupInvalid, err)
+	}
+	dec, err := age.Decrypt(r, id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: wrong passphrase or not a backup", ErrBackupInvalid)
+	}
+	archive, err := bundle.Read(dec, backupLimits)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBackupInvalid, err)
+	}
+	raw, err := archive.Require("backup.json")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBackupInvalid, err)
+	}
+	c := &backupContents{
+		Keys:     map[string][]byte{},
+		Configs:  map[string][]byte{},
+		State:    map[string][]byte{},
+		Policies: map[string][]byte{},
+	}
+	if err := json.Unmarshal(raw, &c.Manifest); err != nil || c.Manifest.Version != backupVersion {
+		return nil, fmt.Errorf("%w: unsupported backup.json", ErrBackupInvalid)
+	}
+	for _, name := range archive.Names() {
+		if name == "backup.json" {
+			continue
+		}
+		data, _ := archive.File(name)
+		dir, base := path.Split(name)
+		if err := c.add(dir, base, data); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrBackupInvalid, name, err)
+		}
+	}
+	if err := c.checkConfigs(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBackupInvalid, err)
+	}
+	if err := c.checkKeyPairs(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBackupInvalid, err)
+	}
+	return c, nil
+}
+
+func (c *backupContents) add(dir, base string, data []byte) error {
+	switch dir {
+	case "keys/":
+		if !isKeyFile(base) {
+			return fmt.Errorf("unexpected key file")
+		}
+		if _, err := keyFingerprint(archiveBase(base), data); err != nil {
+			return err
+		}
+		c.Keys[base] = data
+	case "wireguard/":
+		name, ok := strings.CutSuffix(base, ".conf")
+		if !ok || !ifaceRx.MatchString(name) {
+			return fmt.Errorf("invalid interface name")
+		}
+		c.Configs[name] = data
+	case "state/":
+		if err := validateStateFile(base, data); err != nil {
+			return err
+		}
+		c.State[base] = data
+	case "etc/":
+		var err error
+		switch base {
+		case "exchange-policy":
+			_, err = parseExchangePolicy(base, data)
+		case "key-policy":
+			_, err = parseKeyPolicy(base, data)
+		case "validation-policy":
+			_, err = parseValidationPolicy(base, data)
+		case "allowedips-policy":
+			_, err = parseAllowedIPsPolicy(base, data)
+		case "lint.yaml":
+			_, err = validator.ParseLintConfig(data)
+		default:
+			err = fmt.Errorf("unexpected file")
+		}
+		if err != nil {
+			return err
+		}
+		c.Policies[base] = data
+	default:
+		return fmt.Errorf("unexpected file")
+	}
+	return nil
+}
+
+// archiveBase strips the rotation timestamp from an archived key name.
+func archiveBase(name string) string {
+	if i := strings.LastIndexByte(name, '.'); i > 0 && archiveSuffixRx.MatchString(name[i:]) {
+		return name[:i]
+	}
+	return name
+}
+
+// checkConfigs validates the configs under the validation policy,
+// AllowedIPs policy and lint rules in the backup, or the installed ones if
+// the backup has none, since those are what they will be used with after
+// the restore.
+func (c *backupContents) checkConfigs() error {
+	var policy *validationPolicy
+	var err error
+	if data, ok := c.Policies["validation-policy"]; ok {
+		policy, err = parseValidationPolicy("validation-policy", data)
+	} else {
+		policy, err = loadValidationPolicy(validationPolicyFile)
+	}
+	if err != nil {
+		return err
+	}
+	if data, ok := c.Policies["allowedips-policy"]; ok {
+		policy.routes, err = parseAllowedIPsPolicy("allowedips-policy", data)
+	} else {
+		policy.routes, err = loadAllowedIPsPolicy(allowedIPsPolicyFile)
+	}
+	if err != nil {
+		return err
+	}
+	if data, ok := c.Policies["lint.yaml"]; ok {
+		policy.lint, err = validator.ParseLintConfig(data)
+	} else {
+		policy.lint, err = loadLintConfig(lintConfigFile)
+	}
+	if err != nil {
+		return err
+	}
+	for _, name := range sortedKeys(c.Configs) {
+		if _, err := policy.check(name, string(c.Configs[name])); err != nil {
+			return fmt.Errorf("wireguard/%s.conf: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// checkKeyPairs requires the current keys in a backup to be complete,
+// matching pairs, if any are present.
+func (c *backupContents) checkKeyPairs() error {
+	present := 0
+	for _, name := range keyFiles {
+		if _, ok := c.Keys[name]; ok {
+			present++
+		}
+	}
+	if present == 0 {
+		return nil
+	}
+	if present != len(keyFiles) {
+		return fmt.Errorf("incomplete key set")
+	}
+	for _, pair := range [][2]string{{"exchange.key", "exchange.pub"}, {"signing.key", "signing.pub"}} {
+		a, _ := keyFingerprint(pair[0], c.Keys[pair[0]])
+		b, _ := keyFingerprint(pair[1], c.Keys[pair[1]])
+		if a != b {
+			return fmt.Errorf("%s does not match %s", pair[1], pair[0])
+		}
+	}
+	return nil
+}
+
+func validateStateFile(name string, data []byte) error {
+	switch name {
+	case "nodes.json":
+		var d nodeDirectory
+		if err := json.Unmarshal(data, &d); err != nil {
+			return err
+		}
+		for _, n := range d.Nodes {
+			if err := validateNode(n); err != nil {
+				return err
+			}
+		}
+	case "keyring.json":
+		var kr keyring
+		if err := json.Unmarshal(data, &kr); err != nil {
+			return err
+		}
+		for _, s := range kr.Signers {
+			if _, id, err := publicKeyFingerprint(s.PublicKey); err != nil || id != s.Fingerprint {
+				return fmt.Errorf("signer %s has an invalid key", s.Name)
+			}
+		}
+	case "exchange-state.json":
+		var st exchangeState
+		return json.Unmarshal(data, &st)
+	case "key-rotation.json":
+		var st rotationState
+		return json.Unmarshal(data, &st)
+	default:
+		return fmt.Errorf("unexpected file")
+	}
+	return nil
+}
+
+// createBackup writes an encrypted backup to the backup directory.
+func createBackup(passphrase string) (interface{}, error) {
+	files, err := collectBackup()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(backupDir, 0700); err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	if !nodeNameRx.MatchString(host) {
+		host = "node"
+	}
+	out := filepath.Join(backupDir, fmt.Sprintf("%s-%s.wgbackup", host, time.Now().Format(archiveTimeFormat)))
+	err = writeAtomic(out, func(w io.Writer) error { return writeBackup(w, passphrase, files) })
+	params, _ := json.Marshal(map[string]interface{}{"file": filepath.Base(out), "entries": len(files)})
+	auditLog("CreateBackup", params, err)
+	if err != nil {
+		return nil, err
+	}
+	st, err := os.Stat(out)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"path": out, "file": filepath.Base(out), "size": st.Size(), "entries": len(files)}, nil
+}
+
+// restoreBackup validates a backup from the backup directory and writes it
+// back as a unit, see restore. Running interfaces are not reloaded.
+func restoreBackup(file, passphrase string, dryRun bool) (interface{}, error) {
+	if !backupNameRx.MatchString(file) {
+		return nil, fmt.Errorf("%w: invalid backup name", ErrValidation)
+	}
+	f, err := os.Open(filepath.Join(backupDir, file))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: no backup %s", ErrValidation, file)
+		}
+		return nil, err
+	}
+	defer f.Close()
+	c, err := readBackup(f, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]interface{}{
+		"host":       c.Manifest.Host,
+		"created":    c.Manifest.Created,
+		"interfaces": sortedKeys(c.Configs),
+		"keys":       sortedKeys(c.Keys),
+		"state":      sortedKeys(c.State),
+		"policies":   sortedKeys(c.Policies),
+		"dryRun":     dryRun,
+	}
+	if dryRun {
+		return result, nil
+	}
+	err = c.restore()
+	params, _ := json.Marshal(map[string]interface{}{"file": file, "host": c.Manifest.Host, "interfaces": result["interfaces"]})
+	auditLog("RestoreBackup", params, err)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func writeFile0600(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writeAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// restore writes the backup back as a unit: every file is staged first and
+// then swapped in, and a failure puts back all files replaced so far. The
+// interface, key and state locks are held throughout, taken in the order
+// the rest of the bridge nests them.
+func (c *backupContents) restore() error {
+	for _, name := range sortedKeys(c.Configs) {
+		unlock, err := lockInterface(name)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	if len(c.Keys) > 0 {
+		unlock, err := lockKeys()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	exchangeStateMu.Lock()
+	defer exchangeStateMu.Unlock()
+	keyringMu.Lock()
+	defer keyringMu.Unlock()
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
+
+	ts := time.Now().Format(archiveTimeFormat)
+	files, err := c.files(ts)
+	if err != nil {
+		return err
+	}
+	if err := replaceFiles(files, ts); err != nil {
+		return err
+	}
+	for name := range c.Keys {
+		os.Chown(filepath.Join(keyDir, name), 0, 0)
+	}
+	return nil
+}
+
+// restoreFile is a file written by a restore. Archive, if set, is where the
+// file it replaces is kept, as the current keys are archived like a
+// rotation; other replaced files are removed once the restore succeeded.
+type restoreFile struct {
+	Path    string
+	Data    []byte
+	Archive string
+}
+
+// files lists what a restore writes, the current keys being archived with
+// suffix ts. The node directory and keyring are replaced; exchange sequence
+// numbers are merged so that a restored node never reuses a sequence number
+// it has sent since the backup was taken. The caller holds the state locks.
+func (c *backupContents) files(ts string) ([]restoreFile, error) {
+	var files []restoreFile
+	for _, name := range sortedKeys(c.Configs) {
+		files = append(files, restoreFile{Path: filepath.Join("/etc/wireguard", name+".conf"), Data: c.Configs[name]})
+	}
+	for _, name := range sortedKeys(c.Keys) {
+		path := filepath.Join(keyDir, name)
+		f := restoreFile{Path: path, Data: c.Keys[name]}
+		if name != archiveBase(name) {
+			// never overwrite an archived generation on this host
+			if _, err := os.Stat(path); err == nil {
+				continue
+			}
+		} else {
+			f.Archive = path + "." + ts
+		}
+		files = append(files, f)
+	}
+	state := func(path string, v interface{}) error {
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		files = append(files, restoreFile{Path: path, Data: b})
+		return nil
+	}
+	if data, ok := c.State["nodes.json"]; ok {
+		var d nodeDirectory
+		json.Unmarshal(data, &d)
+		if err := state(nodesFile, &d); err != nil {
+			return nil, err
+		}
+	}
+	if data, ok := c.State["keyring.json"]; ok {
+		var kr keyring
+		json.Unmarshal(data, &kr)
+		if err := state(keyringFile, &kr); err != nil {
+			return nil, err
+		}
+	}
+	if data, ok := c.State["exchange-state.json"]; ok {
+		var backup exchangeState
+		json.Unmarshal(data, &backup)
+		st, err := loadExchangeState()
+		if err != nil {
+			return nil, err
+		}
+		mergeExchangeState(st, &backup)
+		if err := state(exchangeStateFile, st); err != nil {
+			return nil, err
+		}
+	}
+	if data, ok := c.State["key-rotation.json"]; ok {
+		files = append(files, restoreFile{Path: keyRotationFile, Data: data})
+	}
+	for _, name := range sortedKeys(c.Policies) {
+		files = append(files, restoreFile{Path: backupPolicies[name], Data: c.Policies[name]})
+	}
+	return files, nil
+}
+
+// replaceFiles writes every file next to its target and then moves them
+// into place, setting the replaced files aside with suffix ts. On any
+// failure the files already moved are taken out again and the replaced
+// ones restored, so that either all files or none are replaced.
+func replaceFiles(files []restoreFile, ts string) error {
+	staged := make([]string, len(files))
+	defer func() {
+		for _, name := range staged {
+			if name != "" {
+				os.Remove(name)
+			}
+		}
+	}()
+	for i, f := range files {
+		if err := os.MkdirAll(filepath.Dir(f.Path), 0700); err != nil {
+			return err
+		}
+		tmp, err := os.CreateTemp(filepath.Dir(f.Path), "."+filepath.Base(f.Path)+".restore-")
+		if err != nil {
+			return err
+		}
+		staged[i] = tmp.Name()
+		_, err = tmp.Write(f.Data)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	type swapped struct {
+		path, prev string
+		installed  bool
+	}
+	var done []*swapped
+	rollback := func() {
+		for i := len(done) - 1; i >= 0; i-- {
+			if done[i].installed {
+				os.Remove(done[i].path)
+			}
+			if done[i].prev != "" {
+				keyRename(done[i].prev, done[i].path)
+			}
+		}
+	}
+	for i, f := range files {
+		d := &swapped{path: f.Path}
+		if _, err := os.Stat(f.Path); err == nil {
+			d.prev = f.Archive
+			if d.prev == "" {
+				d.prev = f.Path + ".restore-" + ts
+			}
+			if err := keyRename(f.Path, d.prev); err != nil {
+				rollback()
+				return err
+			}
+		}
+		done = append(done, d)
+		if err := keyRename(staged[i], f.Path); err != nil {
+			rollback()
+			return err
+		}
+		d.installed = true
+		staged[i] = ""
+	}
+	for i, d := range done {
+		if d.prev != "" && files[i].Archive == "" {
+			os.Remove(d.prev)
+		}
+	}
+	return nil
+}
+
+// mergeExchangeState keeps the higher sent sequence and the newer received
+// manifest per signer and interface.
+func mergeExchangeState(st, backup *exchangeState) {
+	for iface, seq := range backup.Sent {
+		if seq > st.Sent[iface] {
+			st.Sent[iface] = seq
+		}
+	}
+	for key, r := range backup.Received {
+		if cur, ok := st.Received[key]; !ok || r.Sequence > cur.Sequence || r.Sequence == cur.Sequence && r.Timestamp > cur.Timestamp {
+			st.Received[key] = r
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"wg-bridge/internal/bundle"
+	"wg-bridge/internal/validator"
+)
+
+const testPassphrase = "correct horse battery"
+
+func init() {
+	backupWorkFactor = 10
+}
+
+func backupFiles(t *testing.T) []bundle.File {
+	t.Helper()
+	dir := t.TempDir()
+	if _, err := repairKeyDir(dir); err != nil {
+		t.Fatalf("repairKeyDir: %v", err)
+	}
+	priv, _, _ := genKeyPair()
+	_, peer, _ := genKeyPair()
+	files := []bundle.File{
+		{Name: "wireguard/wg0.conf", Data: []byte("[Interface]\nPrivateKey = " + priv + "\nListenPort = 51820\n\n[Peer]\nPublicKey = " + peer + "\nAllowedIPs = 10.0.0.2/32\n")},
+		{Name: "state/exchange-state.json", Data: []byte(`{"received":{},"sent":{"wg0":4}}`)},
+		{Name: "etc/key-policy", Data: []byte(`{"retain":3}`)},
+	}
+	for _, name := range keyFiles {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, bundle.File{Name: "keys/" + name, Data: b})
+	}
+	return files
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	files := backupFiles(t)
+	var buf bytes.Buffer
+	if err := writeBackup(&buf, testPassphrase, files); err != nil {
+		t.Fatalf("writeBackup: %v", err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("ListenPort")) {
+		t.Fatal("backup is not encrypted")
+	}
+	c, err := readBackup(bytes.NewReader(buf.Bytes()), testPassphrase)
+	if err != nil {
+		t.Fatalf("readBackup: %v", err)
+	}
+	if len(c.Manifest.Entries) != len(files) {
+		t.Fatalf("manifest lists %d entries, want %d", len(c.Manifest.Entries), len(files))
+	}
+	if got := strings.Join(sortedKeys(c.Configs), ","); got != "wg0" {
+		t.Fatalf("configs = %s", got)
+	}
+	if len(c.Keys) != len(keyFiles) || len(c.State) != 1 || len(c.Policies) != 1 {
+		t.Fatalf("unexpected contents: %d keys, %d state, %d policies", len(c.Keys), len(c.State), len(c.Policies))
+	}
+
+	if _, err := readBackup(bytes.NewReader(buf.Bytes()), "wrong passphrase!"); !errors.Is(err, ErrBackupInvalid) {
+		t.Fatalf("expected wrong passphrase to be rejected, got %v", err)
+	}
+	if err := writeBackup(&bytes.Buffer{}, "short", files); !errors.Is(err, ErrValidation) {
+		t.Fatalf("expected short passphrase to be rejected, got %v", err)
+	}
+}
+
+func TestBackupRejectsInvalidEntries(t *testing.T) {
+	cases := map[string]func([]bundle.File) []bundle.File{
+		"invalid config": func(f []bundle.File) []bundle.File {
+			return append(f, bundle.File{Name: "wireguard/wg1.conf", Data: []byte("PrivateKey = x\n")})
+		},
+		"invalid interface name": func(f []bundle.File) []bundle.File {
+			return append(f, bundle.File{Name: "wireguard/wg-name-too-long-0.conf", Data: []byte("[Interface]\n")})
+		},
+		"invalid validation policy": func(f []bundle.File) []bundle.File {
+			return append(f, bundle.File{Name: "etc/validation-policy", Data: []byte(`{"default":"off"}`)})
+		},
+		"invalid AllowedIPs policy": func(f []bundle.File) []bundle.File {
+			return append(f, bundle.File{Name: "etc/allowedips-policy", Data: []byte(`{"default":{"minPrefixV4":40}}`)})
+		},
+		"config outside AllowedIPs policy": func(f []bundle.File) []bundle.File {
+			return append(f, bundle.File{Name: "etc/allowedips-policy", Data: []byte(`{"default":{"supernets":["192.168.0.0/16"]}}`)})
+		},
+		"unexpected file": func(f []bundle.File) []bundle.File {
+			return append(f, bundle.File{Name: "etc/shadow", Data: []byte("root::0:0")})
+		},
+		"mismatched keys": func(f []bundle.File) []bundle.File {
+			other := backupFiles(t)
+			for i := range f {
+				if f[i].Name == "keys/exchange.pub" {
+					for _, o := range other {
+						if o.Name == f[i].Name {
+							f[i].Data = o.Data
+						}
+					}
+				}
+			}
+			return f
+		},
+		"incomplete key set": func(f []bundle.File) []bundle.File {
+			out := []bundle.File{}
+			for _, file := range f {
+				if file.Name != "keys/signing.pub" {
+					out = append(out, file)
+				}
+			}
+			return out
+		},
+	}
+	for name, mutate := range cases {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeBackup(&buf, testPassphrase, mutate(backupFiles(t))); err != nil {
+				t.Fatalf("writeBackup: %v", err)
+			}
+			if _, err := readBackup(&buf, testPassphrase); !errors.Is(err, ErrBackupInvalid) {
+				t.Fatalf("expected ErrBackupInvalid, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRestoreBackupName(t *testing.T) {
+	if _, err := restoreBackup("../../etc/shadow", testPassphrase, true); !errors.Is(err, ErrValidation) {
+		t.Fatalf("expected path to be rejected, got %v", err)
+	}
+}
+
+func TestReplaceFiles(t *testing.T) {
+	dir := t.TempDir()
+	conf, key := filepath.Join(dir, "wg0.conf"), filepath.Join(dir, "signing.key")
+	os.WriteFile(conf, []byte("old conf"), 0600)
+	os.WriteFile(key, []byte("old key"), 0600)
+	files := []restoreFile{
+		{Path: conf, Data: []byte("new conf")},
+		{Path: key, Data: []byte("new key"), Archive: key + ".20240101120000"},
+		{Path: filepath.Join(dir, "state", "nodes.json"), Data: []byte("{}")},
+	}
+	if err := replaceFiles(files, "20240101120000"); err != nil {
+		t.Fatalf("replaceFiles: %v", err)
+	}
+	for path, want := range map[string]string{
+		conf: "new conf", key: "new key", key + ".20240101120000": "old key",
+		filepath.Join(dir, "state", "nodes.json"): "{}",
+	} {
+		if b, err := os.ReadFile(path); err != nil || string(b) != want {
+			t.Fatalf("%s: got %q, %v", path, b, err)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 4 {
+		t.Fatalf("expected no leftovers, found %d entries", len(entries))
+	}
+}
+
+func TestReplaceFilesRollback(t *testing.T) {
+	dir := t.TempDir()
+	conf, key := filepath.Join(dir, "wg0.conf"), filepath.Join(dir, "signing.key")
+	os.WriteFile(conf, []byte("old conf"), 0600)
+	os.WriteFile(key, []byte("old key"), 0600)
+	defer func() { keyRename = os.Rename }()
+	calls := 0
+	keyRename = func(from, to string) error {
+		calls++
+		// fail while installing the key, after the config is swapped
+		if calls == 4 {
+			return errors.New("disk full")
+		}
+		return os.Rename(from, to)
+	}
+	files := []restoreFile{
+		{Path: conf, Data: []byte("new conf")},
+		{Path: key, Data: []byte("new key"), Archive: key + ".20240101120000"},
+		{Path: filepath.Join(dir, "nodes.json"), Data: []byte("{}")},
+	}
+	if err := replaceFiles(files, "20240101120000"); err == nil {
+		t.Fatal("expected replaceFiles to fail")
+	}
+	for path, want := range map[string]string{conf: "old conf", key: "old key"} {
+		if b, err := os.ReadFile(path); err != nil || string(b) != want {
+			t.Fatalf("%s not restored: got %q, %v", path, b, err)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Fatalf("rollback left %d entries behind", len(entries))
+	}
+}
+
+func TestMergeExchangeState(t *testing.T) {
+	st := &exchangeState{
+		Sent:     map[string]uint64{"wg0": 7, "wg1": 1},
+		Received: map[string]*validator.ReplayState{"wg0": {Sequence: 3, Timestamp: 30}},
+	}
+	backup := &exchangeState{
+		Sent: map[string]uint64{"wg0": 5, "wg1": 2, "wg2": 9},
+		Received: map[string]*validator.ReplayState{
+			"wg0": {Sequence: 2, Timestamp: 40},
+			"wg1": {Sequence: 1, Timestamp: 10},
+		},
+	}
+	mergeExchangeState(st, backup)
+	if st.Sent["wg0"] != 7 || st.Sent["wg1"] != 2 || st.Sent["wg2"] != 9 {
+		t.Fatalf("sent = %v", st.Sent)
+	}
+	if st.Received["wg0"].Sequence != 3 || st.Received["wg1"] == nil {
+		t.Fatalf("received = %v", st.Received)
+	}
+}
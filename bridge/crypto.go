@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"aead.dev/minisign"
+	"filippo.io/age"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Exchange encryption and signing are done in-process with age and minisign
+// compatible implementations. Key files, .wgx bundles and .minisig files are
+// byte-for-byte interchangeable with the age, age-keygen and minisign tools.
+
+var (
+	ErrExchangeKey = errors.New("invalid exchange key")
+	ErrSigningKey  = errors.New("invalid signing key")
+)
+
+// minisign secret key layout: signature, kdf and checksum algorithms, kdf
+// salt and limits, then key id, Ed25519 key and checksum.
+const (
+	secretKeySize    = 2 + 2 + 2 + 32 + 8 + 8 + 8 + ed25519.PrivateKeySize + blake2b.Size256
+	secretKeyComment = "untrusted comment: minisign encrypted secret key"
+)
+
+// signingKey is an unencrypted minisign secret key as created by
+// "minisign -G -W" (formerly -n).
+type signingKey struct {
+	id  uint64
+	key ed25519.PrivateKey
+}
+
+func (k *signingKey) fingerprint() string {
+	return fmt.Sprintf("%016X", k.id)
+}
+
+// publicKey returns the contents of the matching .pub file.
+func (k *signingKey) publicKey() string {
+	b := make([]byte, 2+8+ed25519.PublicKeySize)
+	copy(b, "Ed")
+	binary.LittleEndian.PutUint64(b[2:10], k.id)
+	copy(b[10:], k.key.Public().(ed25519.PublicKey))
+	return "untrusted comment: minisign public key " + k.fingerprint() + "\n" + base64.StdEncoding.EncodeToString(b) + "\n"
+}
+
+func (k *signingKey) checksum() []byte {
+	h, _ := blake2b.New256(nil)
+	h.Write([]byte("Ed"))
+	binary.Write(h, binary.LittleEndian, k.id)
+	h.Write(k.key)
+	return h.Sum(nil)
+}
+
+// marshal returns the contents of the secret key file.
+func (k *signingKey) marshal() ([]byte, error) {
+	b := make([]byte, secretKeySize)
+	copy(b, "Ed")
+	copy(b[4:], "B2")
+	if _, err := io.ReadFull(rand.Reader, b[6:38]); err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint64(b[54:62], k.id)
+	copy(b[62:], k.key)
+	copy(b[62+ed25519.PrivateKeySize:], k.checksum())
+	return []byte(secretKeyComment + "\n" + base64.StdEncoding.EncodeToString(b) + "\n"), nil
+}
+
+func parseSigningKey(data []byte) (*signingKey, error) {
+	b, err := base64.StdEncoding.DecodeString(minisignPayloadLine(data))
+	if err != nil || len(b) != secretKeySize || string(b[0:2]) != "Ed" || string(b[4:6]) != "B2" {
+		return nil, fmt.Errorf("%w: not a minisign secret key", ErrSigningKey)
+	}
+	if b[2] != 0 || b[3] != 0 {
+		return nil, fmt.Errorf("%w: password protected keys are not supported", ErrSigningKey)
+	}
+	k := &signingKey{
+		id:  binary.LittleEndian.Uint64(b[54:62]),
+		key: ed25519.PrivateKey(append([]byte{}, b[62:62+ed25519.PrivateKeySize]...)),
+	}
+	if !bytes.Equal(k.checksum(), b[62+ed25519.PrivateKeySize:]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrSigningKey)
+	}
+	return k, nil
+}
+
+func readSigningKey(path string) (*signingKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseSigningKey(b)
+}
+
+// generateSigningKey writes a new minisign key pair to priv and pub.
+func generateSigningKey(priv, pub string) (*signingKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	var id [8]byte
+	if _, err := io.ReadFull(rand.Reader, id[:]); err != nil {
+		return nil, err
+	}
+	k := &signingKey{id: binary.LittleEndian.Uint64(id[:]), key: key}
+	data, err := k.marshal()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(priv, data, 0600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(pub, []byte(k.publicKey()), 0600); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// sign returns a prehashed minisign signature of data, the default of
+// minisign 0.10 and later. name ends up in the trusted comment.
+func (k *signingKey) sign(name string, data []byte) []byte {
+	digest := blake2b.Sum512(data)
+	sig := minisign.Signature{
+		Algorithm:        minisign.HashEdDSA,
+		KeyID:            k.id,
+		UntrustedComment: "signature from minisign secret key",
+		TrustedComment:   "timestamp:" + strconv.FormatInt(time.Now().Unix(), 10) + "\tfile:" + name + "\thashed",
+	}
+	copy(sig.Signature[:], ed25519.Sign(k.key, digest[:]))
+	copy(sig.CommentSignature[:], ed25519.Sign(k.key, append(sig.Signature[:], sig.TrustedComment...)))
+	return []byte(sig.String() + "\n")
+}
+
+// signFile writes path.minisig signed with the secret key file key.
+func signFile(path, key string) error {
+	k, err := readSigningKey(key)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path+".minisig", k.sign(filepath.Base(path), data), 0644)
+}
+
+// verifyData checks a minisign signature of data against a public key given
+// as a bare line or .pub file contents.
+func verifyData(pub string, data, sig []byte) error {
+	var key minisign.PublicKey
+	if err := key.UnmarshalText([]byte(minisignPayloadLine([]byte(pub)))); err != nil {
+		return fmt.Errorf("%w: %v", ErrSignatureInvalid, err)
+	}
+	if !minisign.Verify(key, data, sig) {
+		return ErrSignatureInvalid
+	}
+	return nil
+}
+
+// generateExchangeKey writes a new age identity to priv in age-keygen format
+// and its recipient to pub, returning the recipient.
+func generateExchangeKey(priv, pub string) (string, error) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		return "", err
+	}
+	recipient := id.Recipient().String()
+	data := fmt.Sprintf("# created: %s\n# public key: %s\n%s\n", time.Now().Format(time.RFC3339), recipient, id)
+	if err := os.WriteFile(priv, []byte(data), 0600); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(pub, []byte(recipient+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return recipient, nil
+}
+
+func readIdentities(path string) ([]age.Identity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ids, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrExchangeKey, err)
+	}
+	return ids, nil
+}
+
+// encryptFile encrypts src to every age recipient into dst.
+func encryptFile(src, dst string, recipients []string) error {
+	rs := make([]age.Recipient, 0, len(recipients))
+	for _, r := range recipients {
+		parsed, err := age.ParseX25519Recipient(strings.TrimSpace(r))
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrExchangeKey, err)
+		}
+		rs = append(rs, parsed)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return writeAtomic(dst, func(out io.Writer) error {
+		w, err := age.Encrypt(out, rs...)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, in); err != nil {
+			return err
+		}
+		return w.Close()
+	})
+}
+
+// decryptFile decrypts src with the identities in the given key files.
+func decryptFile(src, dst string, identities ...string) error {
+	var ids []age.Identity
+	for _, path := range identities {
+		found, err := readIdentities(path)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, found...)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	r, err := age.Decrypt(in, ids...)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDecryptFailed, err)
+	}
+	err = writeAtomic(dst, func(out io.Writer) error {
+		_, err := io.Copy(out, r)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDecryptFailed, err)
+	}
+	return nil
+}
+
+// writeAtomic writes dst through a temporary file in the same directory.
+func writeAtomic(dst string, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Produced by the minisign tool (aead.dev/minisign test data).
+const (
+	testMinisignPub = "untrusted comment: minisign public key C373193807678450\nRWRQhGcHOBlzw4CoKyugkk4ioDfoxlXxC9LBx+VNhJ3w9w+cAxgvPsuo\n"
+	testMinisignSig = "untrusted comment: signature from minisign secret key\n" +
+		"RWRQhGcHOBlzwxrJCyuC+rJfHSfyRKRxkuwa3JJ0bWEs7RHjL1OUmqnTr+V1B9JzFuJIH/ybR2Eus9oEZKt9RbitpF/L4D3+5wg=\n" +
+		"trusted comment: timestamp:1614549543\tfile:message.txt\n" +
+		"P/722+ynQ+tIy0qadFHwLx5MsyNz/jDKJkDWQj4dDD2OKnVte8m/M14mwPE/1NMwzShPMSBhMXqZGdbe+UZjDg==\n"
+)
+
+func TestVerifyMinisignToolSignature(t *testing.T) {
+	msg := []byte("Hello World!\n")
+	if err := verifyData(testMinisignPub, msg, []byte(testMinisignSig)); err != nil {
+		t.Fatalf("signature made by minisign rejected: %v", err)
+	}
+	if err := verifyData(testMinisignPub, []byte("Hello World?\n"), []byte(testMinisignSig)); !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatalf("expected ErrSignatureInvalid for altered message, got %v", err)
+	}
+}
+
+func TestSigningKeyRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	priv, pub := filepath.Join(dir, "signing.key"), filepath.Join(dir, "signing.pub")
+	k, err := generateSigningKey(priv, pub)
+	if err != nil {
+		t.Fatalf("generateSigningKey: %v", err)
+	}
+	loaded, err := readSigningKey(priv)
+	if err != nil {
+		t.Fatalf("readSigningKey: %v", err)
+	}
+	if loaded.id != k.id || !bytes.Equal(loaded.key, k.key) {
+		t.Fatal("secret key changed on disk round trip")
+	}
+	line, id, err := readPublicKeyFile(pub)
+	if err != nil || id != k.fingerprint() {
+		t.Fatalf("public key file has id %s, want %s: %v", id, k.fingerprint(), err)
+	}
+
+	msg := filepath.Join(dir, "bundle.wgx")
+	os.WriteFile(msg, []byte("bundle"), 0600)
+	if err := signFile(msg, priv); err != nil {
+		t.Fatalf("signFile: %v", err)
+	}
+	sig, _ := os.ReadFile(msg + ".minisig")
+	if sid, err := signatureKeyID(sig); err != nil || sid != id {
+		t.Fatalf("signature key id %s, want %s: %v", sid, id, err)
+	}
+	if err := verifyData(line, []byte("bundle"), sig); err != nil {
+		t.Fatalf("verifyData: %v", err)
+	}
+	if err := verifyData(testMinisignPub, []byte("bundle"), sig); !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatalf("expected signature from another key to be rejected, got %v", err)
+	}
+}
+
+func TestParseSigningKeyRejects(t *testing.T) {
+	// password protected key created by the minisign tool
+	encrypted := "untrusted comment: minisign encrypted secret key\n" +
+		"RWRTY0Iytaz5znJmUO5kBt5xVkvpBl+29A7pZH86phD4h8vD3V8AAAACAAAAAAAAAEAAAAAA9vH9EcS6NdXNIEGhYGoqG1CiL4aptyJreJ4IfuT4+1h+OgVaY/vi0HsbCP0Y6n/wcy0AN0wOXmVDPP33jZqv82YCj2fH+/6MRuAfzNQYoLvc3sH/8bIwqdfpKIjDRZhvqRf063RFYoI=\n"
+	for name, data := range map[string]string{
+		"encrypted":  encrypted,
+		"public key": testMinisignPub,
+		"garbage":    "not a key",
+	} {
+		if _, err := parseSigningKey([]byte(data)); !errors.Is(err, ErrSigningKey) {
+			t.Errorf("%s: expected ErrSigningKey, got %v", name, err)
+		}
+	}
+
+	k, _ := generateSigningKey(filepath.Join(t.TempDir(), "k"), filepath.Join(t.TempDir(), "p"))
+	data, _ := k.marshal()
+	data[len(data)-10] ^= 1
+	if _, err := parseSigningKey(data); !errors.Is(err, ErrSigningKey) {
+		t.Errorf("corrupted key: expected ErrSigningKey, got %v", err)
+	}
+}
+
+func TestAgeEncryptDecrypt(t *testing.T) {
+	dir := t.TempDir()
+	keys := []string{}
+	for _, name := range []string{"a", "b"} {
+		r, err := generateExchangeKey(filepath.Join(dir, name+".key"), filepath.Join(dir, name+".pub"))
+		if err != nil {
+			t.Fatalf("generateExchangeKey: %v", err)
+		}
+		if !ageRecipientRx.MatchString(r) {
+			t.Fatalf("unexpected recipient %s", r)
+		}
+		keys = append(keys, r)
+	}
+	plain := filepath.Join(dir, "bundle.tar")
+	os.WriteFile(plain, []byte("tar contents"), 0600)
+	enc := filepath.Join(dir, "bundle.wgx")
+	if err := encryptFile(plain, enc, keys); err != nil {
+		t.Fatalf("encryptFile: %v", err)
+	}
+	for _, name := range []string{"a", "b"} {
+		out := filepath.Join(dir, name+".tar")
+		if err := decryptFile(enc, out, filepath.Join(dir, name+".key")); err != nil {
+			t.Fatalf("decrypt with %s: %v", name, err)
+		}
+		if b, _ := os.ReadFile(out); string(b) != "tar contents" {
+			t.Fatalf("decrypted %q", b)
+		}
+	}
+
+	other := filepath.Join(dir, "c.key")
+	generateExchangeKey(other, filepath.Join(dir, "c.pub"))
+	err := decryptFile(enc, filepath.Join(dir, "c.tar"), other)
+	if !errors.Is(err, ErrDecryptFailed) || bundleReason(err) != "decrypt_failed" {
+		t.Fatalf("expected decrypt_failed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "c.tar")); !os.IsNotExist(err) {
+		t.Fatal("failed decryption left output behind")
+	}
+	if err := encryptFile(plain, enc, []string{"age1bogus"}); !errors.Is(err, ErrExchangeKey) {
+		t.Fatalf("expected ErrExchangeKey, got %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiffIdentical(t *testing.T) {
+	diff, added, removed := unifiedDiff("a", "b", "x\ny\n", "x\ny\n")
+	if diff != "" || added != 0 || removed != 0 {
+		t.Fatalf("expected empty diff, got %q", diff)
+	}
+}
+
+func TestUnifiedDiffChanges(t *testing.T) {
+	from := "[Interface]\nListenPort = 51820\n\n[Peer]\nPublicKey = a\n"
+	to := "[Interface]\nListenPort = 51821\n\n[Peer]\nPublicKey = a\nEndpoint = 1.2.3.4:51820\n"
+	diff, added, removed := unifiedDiff("old", "new", from, to)
+	if added != 2 || removed != 1 {
+		t.Fatalf("expected +2 -1, got +%d -%d", added, removed)
+	}
+	for _, want := range []string{"--- old\n+++ new\n", "-ListenPort = 51820\n", "+ListenPort = 51821\n", "+Endpoint = 1.2.3.4:51820\n", "@@ -1,5 +1,6 @@\n"} {
+		if !strings.Contains(diff, want) {
+			t.Fatalf("diff missing %q:\n%s", want, diff)
+		}
+	}
+}
+
+func TestUnifiedDiffSeparateHunks(t *testing.T) {
+	var a, b []string
+	for i := 0; i < 20; i++ {
+		line := strings.Repeat("x", i+1)
+		a = append(a, line)
+		b = append(b, line)
+	}
+	b[1] = "changed"
+	b[18] = "changed"
+	diff, _, _ := unifiedDiff("a", "b", strings.Join(a, "\n")+"\n", strings.Join(b, "\n")+"\n")
+	if n := strings.Count(diff, "@@ -"); n != 2 {
+		t.Fatalf("expected 2 hunks, got %d:\n%s", n, diff)
+	}
+}
+
+func TestPendingPathRejectsTraversal(t *testing.T) {
+	if _, err := pendingPath("../etc", ""); err == nil {
+		t.Fatalf("expected invalid interface name")
+	}
+	if _, err := pendingPath("wg0", "../../etc"); !errors.Is(err, ErrValidation) {
+		t.Fatalf("expected invalid checksum, got %v", err)
+	}
+}
@@ -7,6 +7,7 @@ var (
 	ErrValidation         = errors.New("validation error")
 	ErrPermission         = errors.New("permission denied")
 	ErrMetricsUnavailable = errors.New("metrics provider unavailable")
+	ErrBundle             = errors.New("bundle rejected")
 )
 
 const (
@@ -14,12 +15,15 @@ const (
 	CodeValidationFailed      = 1002
 	CodePermissionDenied      = 1003
 	CodeMetricsUnavailable    = 1004
+	CodeBundleRejected        = 1005
 )
 
 type respError struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
 	Details string `json:"details,omitempty"`
+	// Data holds structured details, such as the diagnostics of a config
+	Data interface{} `json:"data,omitempty"`
 }
 
 func wrapError(err error) *respError {
@@ -27,11 +31,18 @@ func wrapError(err error) *respError {
 	case errors.Is(err, ErrPackageManager):
 		return &respError{Code: CodePackageManagerFailure, Message: "package manager failed", Details: err.Error()}
 	case errors.Is(err, ErrValidation):
-		return &respError{Code: CodeValidationFailed, Message: "validation failed", Details: err.Error()}
+		re := &respError{Code: CodeValidationFailed, Message: "validation failed", Details: err.Error()}
+		var de *diagnosticsError
+		if errors.As(err, &de) {
+			re.Data = map[string]interface{}{"diagnostics": de.Diagnostics}
+		}
+		return re
 	case errors.Is(err, ErrPermission):
 		return &respError{Code: CodePermissionDenied, Message: "permission denied", Details: err.Error()}
 	case errors.Is(err, ErrMetricsUnavailable):
 		return &respError{Code: CodeMetricsUnavailable, Message: "metrics provider unavailable", Details: err.Error()}
+	case errors.Is(err, ErrBundle):
+		return &respError{Code: CodeBundleRejected, Message: "bundle rejected", Details: err.Error()}
 	default:
 		return &respError{Code: -1, Message: err.Error(), Details: err.Error()}
 	}
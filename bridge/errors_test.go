@@ -15,6 +15,7 @@ func TestWrapErrorCodes(t *testing.T) {
 		{fmt.Errorf("%w", ErrValidation), CodeValidationFailed},
 		{fmt.Errorf("%w", ErrPermission), CodePermissionDenied},
 		{fmt.Errorf("%w", ErrMetricsUnavailable), CodeMetricsUnavailable},
+		{fmt.Errorf("%w", ErrBundle), CodeBundleRejected},
 		{errors.New("other"), -1},
 	}
 	for _, c := range cases {
@@ -26,7 +27,7 @@ func TestWrapErrorCodes(t *testing.T) {
 }
 
 func TestValidateConfigError(t *testing.T) {
-	if _, err := validateConfig("invalid"); err == nil || !errors.Is(err, ErrValidation) {
+	if _, err := validateConfig("", "invalid"); err == nil || !errors.Is(err, ErrValidation) {
 		t.Fatalf("expected validation error")
 	}
 }
@@ -1,21 +1,22 @@
 package main
 
 import (
-	"archive/tar"
-	"bytes"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/coreos/go-systemd/v22/journal"
-	"github.com/fsnotify/fsnotify"
+
+	"wg-bridge/internal/bundle"
+	"wg-bridge/internal/validator"
 )
 
 const (
@@ -24,179 +25,430 @@ const (
 	pendingDir    = "/var/lib/cockpit-wg/pending"
 )
 
-type Manifest struct {
-	Interface string `json:"interface"`
-	Version   int    `json:"version"`
-	Checksum  string `json:"checksum"`
+// manifestVersion is written by exportBundle. Version 2 manifests carry the
+// timestamp, source and sequence number used for replay protection.
+const manifestVersion = 2
+
+// Bundle rejection reasons. Each wraps ErrBundle so RPC callers receive
+// CodeBundleRejected with the specific reason in the details.
+var (
+	ErrMissingSignature = fmt.Errorf("%w: missing signature", ErrBundle)
+	ErrSignatureInvalid = fmt.Errorf("%w: signature verify failed", ErrBundle)
+	ErrDecryptFailed    = fmt.Errorf("%w: decrypt failed", ErrBundle)
+	ErrChecksumMismatch = fmt.Errorf("%w: checksum mismatch", ErrBundle)
+	ErrManifestInvalid  = fmt.Errorf("%w: invalid manifest", ErrBundle)
+	ErrReplay           = fmt.Errorf("%w: replayed bundle", ErrBundle)
+	ErrPayloadInvalid   = fmt.Errorf("%w: invalid payload", ErrBundle)
+	ErrRoutesNotAllowed = fmt.Errorf("%w: AllowedIPs not allowed for interface", ErrBundle)
+)
+
+// bundleResult describes a verified bundle that has been staged in the
+// pending directory.
+type bundleResult struct {
+	Interface string   `json:"interface"`
+	Version   int      `json:"version"`
+	Type      string   `json:"type"`
+	Checksum  string   `json:"checksum"`
+	Sequence  uint64   `json:"sequence"`
+	Timestamp int64    `json:"timestamp"`
+	Source    string   `json:"source,omitempty"`
+	Signer    string   `json:"signer"`
+	Pending   string   `json:"pending,omitempty"`
+	Meta      []string `json:"meta"`
+	// AutoApplied is set when the exchange policy applied the bundle
+	// directly; Policy explains the decision.
+	AutoApplied bool   `json:"autoApplied"`
+	Policy      string `json:"policy,omitempty"`
+	Archive     string `json:"archive,omitempty"`
 }
 
-func watchInbox() {
-	if err := os.MkdirAll(inboxDir, 0700); err != nil {
-		journal.Send(fmt.Sprintf("{\"action\":\"inbox\",\"error\":\"%v\"}", err), journal.PriErr, nil)
-		return
+// importBundle stages a bundle received over RPC. The bundle is expected as
+// base64 encoded .wgx bytes and the signature as the contents of the
+// accompanying .minisig file.
+func importBundle(bundle, signature string) (*bundleResult, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(bundle))
+	if err != nil || len(data) == 0 {
+		return nil, fmt.Errorf("%w: bundle must be base64 encoded", ErrValidation)
+	}
+	if strings.TrimSpace(signature) == "" {
+		auditExchange("import", "", "", ErrMissingSignature)
+		return nil, ErrMissingSignature
 	}
-	watcher, err := fsnotify.NewWatcher()
+	dir, err := os.MkdirTemp("", "wgx-import-")
 	if err != nil {
-		journal.Send(fmt.Sprintf("{\"action\":\"inbox\",\"error\":\"%v\"}", err), journal.PriErr, nil)
-		return
+		return nil, err
 	}
-	go func() {
-		for {
-			select {
-			case event, ok := <-watcher.Events:
-				if !ok {
-					return
-				}
-				if event.Op&fsnotify.Create == fsnotify.Create && strings.HasSuffix(event.Name, ".wgx") {
-					go handleBundle(event.Name)
-				}
-			case err := <-watcher.Errors:
-				journal.Send(fmt.Sprintf("{\"action\":\"inbox\",\"error\":\"%v\"}", err), journal.PriErr, nil)
-			}
-		}
-	}()
-	watcher.Add(inboxDir)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "import.wgx")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path+".minisig", []byte(signature), 0600); err != nil {
+		return nil, err
+	}
+	res, err := processBundle(path, path+".minisig")
+	auditBundle("import", res, err)
+	return res, err
 }
 
-func handleBundle(path string) {
-	sig := path + ".minisig"
-	if _, err := os.Stat(sig); err != nil {
-		journal.Send(fmt.Sprintf("{\"bundle\":\"%s\",\"error\":\"missing signature\"}", filepath.Base(path)), journal.PriErr, nil)
-		return
-	}
-	cmd := exec.Command("minisign", "-Vm", path, "-x", sig, "-P", trustedPubKey)
-	if err := cmd.Run(); err != nil {
-		journal.Send(fmt.Sprintf("{\"bundle\":\"%s\",\"error\":\"signature verify failed\"}", filepath.Base(path)), journal.PriErr, nil)
-		return
+// processBundle verifies, decrypts and checks the bundle at path and writes
+// its contents to the pending directory of the target interface. Receipt
+// bundles are matched against the outbox instead of being staged.
+func processBundle(path, sig string) (*bundleResult, error) {
+	signer, err := verifySignature(path, sig)
+	if err != nil {
+		return nil, err
 	}
 	decPath := path + ".tar"
-	cmd = exec.Command("age", "-d", "-i", exchangePrivKey, "-o", decPath, path)
-	if err := cmd.Run(); err != nil {
-		journal.Send(fmt.Sprintf("{\"bundle\":\"%s\",\"error\":\"decrypt failed\"}", filepath.Base(path)), journal.PriErr, nil)
-		return
+	defer os.Remove(decPath)
+	if err := decryptFile(path, decPath, exchangeKeyFiles(keyDir)...); err != nil {
+		return nil, err
+	}
+	archive, err := unpackBundle(decPath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBundle, err)
 	}
-	manifest, cfg, meta, err := unpackBundle(decPath)
+	manifest, payload, err := readBundle(archive)
 	if err != nil {
-		journal.Send(fmt.Sprintf("{\"bundle\":\"%s\",\"error\":\"%v\"}", filepath.Base(path), err), journal.PriErr, nil)
-		return
+		return nil, err
+	}
+	checksum := strings.ToLower(manifest.Checksum)
+	result := &bundleResult{
+		Interface: manifest.Interface,
+		Version:   manifest.Version,
+		Type:      manifest.PayloadType(),
+		Checksum:  checksum,
+		Sequence:  manifest.Sequence,
+		Timestamp: manifest.Timestamp,
+		Source:    manifest.Source,
+		Signer:    signer.Name,
+		Meta:      []string{},
+	}
+	// Announcements are about the signer itself rather than an interface and
+	// cannot be replayed: once applied, the old key is no longer trusted.
+	if result.Type == validator.TypeNodeKeyRotation {
+		if _, err := acceptAnnouncement(signer, archive, payload); err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+	if err := signer.allows(manifest.Interface); err != nil {
+		if result.Type != validator.TypeReceipt {
+			rejectionReceipt(signer, manifest, err)
+		}
+		return nil, err
+	}
+	mv := validator.NewManifestValidator(true)
+	if result.Type == validator.TypeReceipt {
+		r, err := decodeReceipt(payload)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrReceiptInvalid, err)
+		}
+		// Receipts are checked for replay like any bundle, so a captured
+		// one cannot be sent again to change the status of an outbox entry.
+		err = acceptManifest(mv, signer.Fingerprint, manifest, func() error {
+			return recordReceipt(signer, manifest, r)
+		})
+		if errors.Is(err, validator.ErrReplay) {
+			err = fmt.Errorf("%w: %v", ErrReplay, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+	if err := checkDeltaSigner(signer, manifest.Interface, result.Type, payload); err != nil {
+		rejectionReceipt(signer, manifest, err)
+		return nil, err
+	}
+	if err := checkBundleRoutes(manifest.Interface, result.Type, payload); err != nil {
+		rejectionReceipt(signer, manifest, err)
+		return nil, err
 	}
-	sum := sha256.Sum256(cfg)
-	if hex.EncodeToString(sum[:]) != strings.ToLower(manifest.Checksum) {
-		journal.Send(fmt.Sprintf("{\"bundle\":\"%s\",\"error\":\"checksum mismatch\"}", filepath.Base(path)), journal.PriErr, nil)
-		return
+	meta := archive.Dir("meta")
+	// Bundles queue per interface by checksum; one from another node never
+	// replaces a bundle already staged.
+	dest := filepath.Join(pendingDir, manifest.Interface, checksum)
+	origin := &bundleOrigin{
+		Interface:   manifest.Interface,
+		Checksum:    checksum,
+		Sequence:    manifest.Sequence,
+		Signer:      signer.Name,
+		Fingerprint: signer.Fingerprint,
+	}
+	var names []string
+	stage := func() (err error) {
+		names, err = stageBundle(dest, manifest, payload, origin, meta)
+		if err != nil {
+			os.RemoveAll(dest)
+		}
+		return err
+	}
+	if err := acceptManifest(mv, signer.Fingerprint, manifest, stage); err != nil {
+		if errors.Is(err, validator.ErrReplay) {
+			err = fmt.Errorf("%w: %v", ErrReplay, err)
+		}
+		rejectionReceipt(signer, manifest, err)
+		return nil, err
+	}
+	result.Pending = dest
+	result.Meta = names
+	sendReceipt(origin, receiptAccepted, "")
+	autoApply(signer, result, payload)
+	return result, nil
+}
+
+// stageBundle writes a verified bundle to its pending directory dest and
+// returns the names of its meta entries.
+func stageBundle(dest string, manifest *validator.Manifest, payload []byte, origin *bundleOrigin, meta map[string][]byte) ([]string, error) {
+	if err := os.RemoveAll(dest); err != nil {
+		return nil, err
 	}
-	dest := filepath.Join(pendingDir, manifest.Interface)
 	if err := os.MkdirAll(filepath.Join(dest, "meta"), 0700); err != nil {
-		journal.Send(fmt.Sprintf("{\"bundle\":\"%s\",\"error\":\"%v\"}", filepath.Base(path), err), journal.PriErr, nil)
-		return
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dest, payloadName(manifest)), payload, 0600); err != nil {
+		return nil, err
+	}
+	manBytes, _ := json.Marshal(manifest)
+	if err := os.WriteFile(filepath.Join(dest, "manifest.json"), manBytes, 0600); err != nil {
+		return nil, err
 	}
-	if err := os.WriteFile(filepath.Join(dest, "config.conf"), cfg, 0600); err != nil {
-		journal.Send(fmt.Sprintf("{\"bundle\":\"%s\",\"error\":\"%v\"}", filepath.Base(path), err), journal.PriErr, nil)
-		return
+	if err := writeOrigin(dest, origin); err != nil {
+		return nil, err
 	}
+	// meta entry names have been validated by the bundle reader and cannot
+	// leave the pending directory.
+	names := make([]string, 0, len(meta))
 	for name, data := range meta {
-		os.WriteFile(filepath.Join(dest, name), data, 0600)
+		target := filepath.Join(dest, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(target, data, 0600); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// readBundle extracts the manifest and the payload it describes from an
+// unpacked bundle. Whole-config bundles carry config.conf, typed peer bundles
+// carry payload.json which is decoded and validated here.
+func readBundle(archive *bundle.Archive) (*validator.Manifest, []byte, error) {
+	raw, err := archive.Require("manifest.json")
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrBundle, err)
+	}
+	manifest, err := parseManifest(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	payload, err := archive.Require(payloadName(manifest))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrBundle, err)
+	}
+	if err := checkPayload(manifest, payload); err != nil {
+		return nil, nil, err
+	}
+	switch typ := manifest.PayloadType(); typ {
+	case validator.TypeConfig:
+	case validator.TypeReceipt:
+		if _, err := decodeReceipt(payload); err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrReceiptInvalid, err)
+		}
+	case validator.TypeNodeKeyRotation:
+		if _, err := decodeAnnouncement(payload); err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrAnnouncementInvalid, err)
+		}
+	default:
+		if _, err := decodePeerPayload(typ, payload); err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrPayloadInvalid, err)
+		}
+	}
+	return manifest, payload, nil
+}
+
+// parseManifest parses the manifest with the strict manifest validator.
+func parseManifest(raw []byte) (*validator.Manifest, error) {
+	manifest, err := validator.NewManifestValidator(true).ValidateManifestJSON(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrManifestInvalid, err)
 	}
-	journal.Send(fmt.Sprintf("{\"action\":\"bundle\",\"iface\":\"%s\",\"status\":\"ready\"}", manifest.Interface), journal.PriInfo, nil)
-	os.Remove(path)
-	os.Remove(sig)
-	os.Remove(decPath)
+	if !ifaceRx.MatchString(manifest.Interface) {
+		return nil, fmt.Errorf("%w: invalid interface name", ErrManifestInvalid)
+	}
+	return manifest, nil
 }
 
-func unpackBundle(tarPath string) (*Manifest, []byte, map[string][]byte, error) {
+// checkPayload checks the bundled payload against a parsed manifest.
+func checkPayload(manifest *validator.Manifest, payload []byte) error {
+	if err := validator.NewManifestValidator(true).ValidateChecksum(manifest, payload); err != nil {
+		if errors.Is(err, validator.ErrChecksumMismatch) {
+			return ErrChecksumMismatch
+		}
+		return fmt.Errorf("%w: %v", ErrManifestInvalid, err)
+	}
+	return nil
+}
+
+// unpackBundle reads a decrypted bundle with the hardened bundle reader.
+func unpackBundle(tarPath string) (*bundle.Archive, error) {
 	f, err := os.Open(tarPath)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
 	}
 	defer f.Close()
-	tr := tar.NewReader(f)
-	var manifest Manifest
-	var cfg []byte
-	meta := make(map[string][]byte)
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, nil, nil, err
-		}
-		switch hdr.Name {
-		case "manifest.json":
-			var buf bytes.Buffer
-			if _, err := io.Copy(&buf, tr); err != nil {
-				return nil, nil, nil, err
-			}
-			if err := json.Unmarshal(buf.Bytes(), &manifest); err != nil {
-				return nil, nil, nil, err
-			}
-		case "config.conf":
-			var buf bytes.Buffer
-			if _, err := io.Copy(&buf, tr); err != nil {
-				return nil, nil, nil, err
-			}
-			cfg = buf.Bytes()
-		default:
-			if strings.HasPrefix(hdr.Name, "meta/") && !hdr.FileInfo().IsDir() {
-				var buf bytes.Buffer
-				if _, err := io.Copy(&buf, tr); err != nil {
-					return nil, nil, nil, err
-				}
-				meta[hdr.Name] = buf.Bytes()
-			}
-		}
-	}
-	if manifest.Interface == "" || len(cfg) == 0 {
-		return nil, nil, nil, fmt.Errorf("incomplete bundle")
-	}
-	return &manifest, cfg, meta, nil
+	return bundle.Read(f, bundle.DefaultLimits)
+}
+
+// bundleReason maps a bundle error to a stable machine-readable reason.
+func bundleReason(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrMissingSignature):
+		return "missing_signature"
+	case errors.Is(err, ErrSignatureInvalid):
+		return "signature_invalid"
+	case errors.Is(err, ErrDecryptFailed):
+		return "decrypt_failed"
+	case errors.Is(err, ErrChecksumMismatch):
+		return "checksum_mismatch"
+	case errors.Is(err, ErrManifestInvalid):
+		return "manifest_invalid"
+	case errors.Is(err, ErrReplay):
+		return "replay"
+	case errors.Is(err, ErrPayloadInvalid):
+		return "payload_invalid"
+	case errors.Is(err, ErrRoutesNotAllowed):
+		return "routes_not_allowed"
+	case errors.Is(err, ErrUnknownSigner):
+		return "unknown_signer"
+	case errors.Is(err, ErrSignerRevoked):
+		return "signer_revoked"
+	case errors.Is(err, ErrSignerExpired):
+		return "signer_expired"
+	case errors.Is(err, ErrSignerNotAllowed):
+		return "signer_not_allowed"
+	case errors.Is(err, ErrReceiptInvalid):
+		return "receipt_invalid"
+	case errors.Is(err, ErrReceiptUnmatched):
+		return "receipt_unmatched"
+	case errors.Is(err, ErrAnnouncementInvalid):
+		return "announcement_invalid"
+	}
+	if reason := bundle.Reason(err); reason != "" {
+		return reason
+	}
+	return "internal_error"
 }
 
 // exportBundle creates an encrypted and signed bundle for the given interface
-// and returns the path to the generated .wgx file. The recipient parameter
-// expects the target node's public exchange key.
-func exportBundle(iface, recipient string) (string, error) {
-	cfgPath := filepath.Join("/etc/wireguard", iface+".conf")
-	cfg, err := os.ReadFile(cfgPath)
+// in the outbox and returns the path to the generated .wgx file. The bundle
+// is encrypted to every age recipient given, so any one of the target nodes
+// can decrypt it. opts.Type selects the kind of peer delta describing this
+// node, peer-add by default, or the peer list of a whole-config bundle.
+func exportBundle(iface string, recipients []string, opts exportOptions) (string, error) {
+	if opts.Type == "" {
+		opts.Type = validator.TypePeerAdd
+	}
+	payload, err := bundlePayload(iface, opts)
 	if err != nil {
 		auditExchange("export", iface, "", err)
 		return "", err
 	}
-	sum := sha256.Sum256(cfg)
-	manifest := Manifest{Interface: iface, Version: 1, Checksum: hex.EncodeToString(sum[:])}
-	tmp, err := os.CreateTemp("", iface+"-*.tar")
+	path, entry, err := sealBundle(iface, opts.Type, payload, recipients)
+	auditExchange("export", iface, entry.Checksum, err)
 	if err != nil {
-		auditExchange("export", iface, hex.EncodeToString(sum[:]), err)
 		return "", err
 	}
+	// delivery failures are recorded on the outbox entry; the bundle stays
+	// in the outbox for a retry or a manual download
+	deliverBundle(path)
+	return path, nil
+}
+
+// sealBundle writes payload as a bundle of the given type to the outbox,
+// encrypted to recipients and signed with the node's signing key, and
+// records it with an outbox entry. The entry is returned even on failure so
+// callers can log the checksum.
+func sealBundle(iface, typ string, payload []byte, recipients []string) (string, *outboxEntry, error) {
+	return sealBundleWith(iface, typ, payload, recipients, signingPrivKey, nil)
+}
+
+// sealBundleWith is sealBundle with an explicit minisign secret key and
+// additional archive entries.
+func sealBundleWith(iface, typ string, payload []byte, recipients []string, signKey string, extra []bundle.File) (string, *outboxEntry, error) {
+	sum := sha256.Sum256(payload)
+	entry := &outboxEntry{
+		Interface:  iface,
+		Type:       typ,
+		Checksum:   hex.EncodeToString(sum[:]),
+		Recipients: recipients,
+	}
+	seq, err := nextSequence(sequenceStream(iface, typ))
+	if err != nil {
+		return "", entry, err
+	}
+	source, _ := os.Hostname()
+	manifest := validator.Manifest{
+		Interface: iface,
+		Version:   manifestVersion,
+		Checksum:  entry.Checksum,
+		Timestamp: time.Now().Unix(),
+		Source:    source,
+		Sequence:  seq,
+	}
+	if typ != validator.TypeConfig {
+		manifest.Type = typ
+	}
+	tmp, err := os.CreateTemp("", iface+"-*.tar")
+	if err != nil {
+		return "", entry, err
+	}
 	defer os.Remove(tmp.Name())
-	tw := tar.NewWriter(tmp)
 	manBytes, _ := json.Marshal(manifest)
-	tw.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0600, Size: int64(len(manBytes))})
-	tw.Write(manBytes)
-	tw.WriteHeader(&tar.Header{Name: "config.conf", Mode: 0600, Size: int64(len(cfg))})
-	tw.Write(cfg)
-	tw.Close()
+	files := []bundle.File{
+		{Name: "manifest.json", Data: manBytes},
+		{Name: payloadName(&manifest), Data: payload},
+	}
+	err = bundle.Write(tmp, append(files, extra...))
 	tmp.Close()
-	outName := filepath.Join(os.TempDir(), fmt.Sprintf("%s-%d.wgx", iface, time.Now().UnixNano()))
-	enc := exec.Command("age", "-r", recipient, "-o", outName, tmp.Name())
-	if err := enc.Run(); err != nil {
-		auditExchange("export", iface, hex.EncodeToString(sum[:]), err)
-		os.Remove(outName)
-		return "", err
+	if err != nil {
+		return "", entry, err
+	}
+	if err := ensureOutbox(); err != nil {
+		return "", entry, err
 	}
-	sign := exec.Command("minisign", "-Sm", outName, "-s", signingPrivKey)
-	if err := sign.Run(); err != nil {
-		auditExchange("export", iface, hex.EncodeToString(sum[:]), err)
+	created := time.Now()
+	outName := filepath.Join(outboxDir, fmt.Sprintf("%s-%d.wgx", iface, created.UnixNano()))
+	if err := encryptFile(tmp.Name(), outName, recipients); err != nil {
+		return "", entry, err
+	}
+	if err := signFile(outName, signKey); err != nil {
 		os.Remove(outName)
-		return "", err
+		os.Remove(outName + ".minisig")
+		return "", entry, err
 	}
-	auditExchange("export", iface, hex.EncodeToString(sum[:]), nil)
-	return outName, nil
+	entry.File = filepath.Base(outName)
+	entry.Sequence = seq
+	entry.Nodes = recipientNodes(recipients)
+	entry.Created = created.UTC().Format(time.RFC3339)
+	outboxMu.Lock()
+	err = writeOutboxEntry(outName, entry)
+	outboxMu.Unlock()
+	if err != nil {
+		return "", entry, err
+	}
+	return outName, entry, nil
 }
 
 // listInboxBundles enumerates .wgx files in the inbox directory and returns a
-// slice with basic verification results for each bundle.
+// slice with basic verification results for each bundle, followed by the
+// quarantined bundles and the reason they were rejected.
 func listInboxBundles() ([]map[string]interface{}, error) {
 	entries, err := os.ReadDir(inboxDir)
 	if err != nil {
@@ -208,37 +460,87 @@ func listInboxBundles() ([]map[string]interface{}, error) {
 			continue
 		}
 		path := filepath.Join(inboxDir, e.Name())
-		info := map[string]interface{}{"file": e.Name()}
-		sig := path + ".minisig"
-		if _, err := os.Stat(sig); err == nil {
-			cmd := exec.Command("minisign", "-Vm", path, "-x", sig, "-P", trustedPubKey)
-			if cmd.Run() == nil {
-				info["signature"] = true
-			} else {
-				info["signature"] = false
-			}
-		} else {
-			info["signature"] = false
-		}
-		decPath := path + ".tar"
-		cmd := exec.Command("age", "-d", "-i", exchangePrivKey, "-o", decPath, path)
-		if cmd.Run() == nil {
-			info["recipient"] = true
-			man, cfg, _, err := unpackBundle(decPath)
-			if err == nil {
-				sum := sha256.Sum256(cfg)
-				info["checksum"] = strings.EqualFold(man.Checksum, hex.EncodeToString(sum[:]))
-				info["interface"] = man.Interface
-			} else {
-				info["checksum"] = false
-			}
-		} else {
-			info["recipient"] = false
-		}
-		os.Remove(decPath)
+		info := map[string]interface{}{"file": e.Name(), "quarantined": false, "signature": false, "recipient": false, "checksum": false}
+		if err := inspectBundle(path, info); err != nil {
+			info["error"] = err.Error()
+			info["reason"] = bundleReason(err)
+		}
 		result = append(result, info)
 	}
-	return result, nil
+	quarantined, err := listQuarantine(quarantineDir)
+	if err != nil {
+		return nil, err
+	}
+	return append(result, quarantined...), nil
+}
+
+// inspectBundle runs the import checks against an inbox bundle without
+// staging it, recording each result in info. The first failure is returned.
+func inspectBundle(path string, info map[string]interface{}) error {
+	var failure error
+	signer, err := verifySignature(path, path+".minisig")
+	if err != nil {
+		failure = err
+	} else {
+		info["signature"] = true
+		info["signer"] = signer.Name
+	}
+	decPath := path + ".tar"
+	defer os.Remove(decPath)
+	if err := decryptFile(path, decPath, exchangeKeyFiles(keyDir)...); err != nil {
+		if failure == nil {
+			failure = err
+		}
+		return failure
+	}
+	info["recipient"] = true
+	archive, err := unpackBundle(decPath)
+	if err != nil {
+		if failure == nil {
+			failure = fmt.Errorf("%w: %w", ErrBundle, err)
+		}
+		return failure
+	}
+	man, _, err := readBundle(archive)
+	info["checksum"] = err == nil
+	if err != nil {
+		if failure == nil {
+			failure = err
+		}
+		return failure
+	}
+	info["interface"] = man.Interface
+	info["type"] = man.PayloadType()
+	if signer != nil {
+		if err := signer.allows(man.Interface); err != nil && failure == nil {
+			failure = err
+		}
+	}
+	info["sequence"] = man.Sequence
+	if signer != nil {
+		if err := checkFreshness(validator.NewManifestValidator(true), signer.Fingerprint, man); err != nil && failure == nil {
+			failure = fmt.Errorf("%w: %v", ErrReplay, err)
+		}
+	}
+	return failure
+}
+
+// auditBundle records the outcome of processing a received bundle together
+// with the signer it was accepted from.
+func auditBundle(action string, res *bundleResult, err error) {
+	fields := map[string]interface{}{"action": action, "actor": os.Getenv("USER")}
+	if res != nil {
+		fields["iface"] = res.Interface
+		fields["hash"] = res.Checksum
+		fields["signer"] = res.Signer
+		fields["sequence"] = res.Sequence
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+		fields["reason"] = bundleReason(err)
+	}
+	msgBytes, _ := json.Marshal(fields)
+	journal.Send(string(msgBytes), journal.PriInfo, nil)
 }
 
 func auditExchange(action, iface, hash string, err error) {
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"wg-bridge/internal/config"
+	"wg-bridge/internal/validator"
+)
+
+// peerPayload is the payload.json of a typed bundle. It describes a change
+// to a single peer rather than a whole configuration, so no private key ever
+// leaves the exporting node.
+type peerPayload struct {
+	PublicKey           string   `json:"publicKey"`
+	NewPublicKey        string   `json:"newPublicKey,omitempty"`
+	Endpoint            string   `json:"endpoint,omitempty"`
+	AllowedIPs          []string `json:"allowedIPs,omitempty"`
+	PersistentKeepalive int      `json:"persistentKeepalive,omitempty"`
+}
+
+// exportOptions are the ExportConfig parameters besides the interface name
+// and recipient.
+type exportOptions struct {
+	Type                string   `json:"type"`
+	Endpoint            string   `json:"endpoint"`
+	PublicKey           string   `json:"publicKey"`
+	AllowedIPs          []string `json:"allowedIPs"`
+	PersistentKeepalive int      `json:"persistentKeepalive"`
+}
+
+// payloadName returns the archive entry holding the payload of manifest.
+func payloadName(m *validator.Manifest) string {
+	if m.PayloadType() == validator.TypeConfig {
+		return "config.conf"
+	}
+	return "payload.json"
+}
+
+func validatePeerKey(key string) error {
+	if _, err := wgtypes.ParseKey(key); err != nil {
+		return fmt.Errorf("invalid public key")
+	}
+	return nil
+}
+
+func validateEndpoint(endpoint string) error {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil || host == "" {
+		return fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("invalid endpoint port %q", port)
+	}
+	return nil
+}
+
+// decodePeerPayload parses and validates a payload for the given type.
+func decodePeerPayload(typ string, data []byte) (*peerPayload, error) {
+	var p peerPayload
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	if err := validatePeerKey(p.PublicKey); err != nil {
+		return nil, err
+	}
+	if p.Endpoint != "" {
+		if err := validateEndpoint(p.Endpoint); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := normalizeCIDRs(p.AllowedIPs); err != nil {
+		return nil, err
+	}
+	if p.PersistentKeepalive < 0 || p.PersistentKeepalive > 65535 {
+		return nil, fmt.Errorf("invalid persistent keepalive %d", p.PersistentKeepalive)
+	}
+	switch typ {
+	case validator.TypePeerAdd:
+		if len(p.AllowedIPs) == 0 {
+			return nil, fmt.Errorf("peer-add requires allowedIPs")
+		}
+	case validator.TypePeerEndpoint:
+		if p.Endpoint == "" {
+			return nil, fmt.Errorf("peer-endpoint requires an endpoint")
+		}
+	case validator.TypePeerKeyRotation:
+		if err := validatePeerKey(p.NewPublicKey); err != nil {
+			return nil, err
+		}
+	}
+	return &p, nil
+}
+
+// authorizeDelta ties a delta to the node that signed it, which must have
+// an entry in the node directory. owner is the key recorded for that node
+// and exists tells whether the peer is configured already. A node may only
+// change its own peer; one without a recorded key may only add a peer that
+// does not exist yet, whose key is recorded for it once applied.
+func authorizeDelta(typ string, p *peerPayload, owner string, exists bool) error {
+	if owner != "" && p.PublicKey == owner {
+		return nil
+	}
+	if typ == validator.TypePeerAdd && owner == "" && !exists {
+		return nil
+	}
+	return fmt.Errorf("%w: peer %s is not the signing node's", ErrSignerNotAllowed, p.PublicKey)
+}
+
+// checkDeltaSigner turns down a peer delta for iface that changes a peer
+// other than the one of the node signing it.
+func checkDeltaSigner(s *signer, iface, typ string, payload []byte) error {
+	if typ == validator.TypeConfig {
+		return nil
+	}
+	p, err := decodePeerPayload(typ, payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPayloadInvalid, err)
+	}
+	owner, err := nodePeerKey(s.Fingerprint)
+	if err != nil {
+		return err
+	}
+	exists := false
+	if data, err := os.ReadFile(filepath.Join("/etc/wireguard", iface+".conf")); err == nil {
+		if f, err := config.Parse(string(data)); err == nil {
+			exists = f.Peer(p.PublicKey) != nil
+		}
+	}
+	return authorizeDelta(typ, p, owner, exists)
+}
+
+// mergeDelta applies a typed payload to the text of an interface
+// configuration. Only the affected [Peer] section changes; the [Interface]
+// section and every other peer are kept as the receiver configured them.
+// owner is the key recorded for the signing node, see authorizeDelta.
+func mergeDelta(text, typ string, p *peerPayload, owner string) (string, error) {
+	allowed, err := normalizeCIDRs(p.AllowedIPs)
+	if err != nil {
+		return "", err
+	}
+	f, err := config.Parse(text)
+	if err != nil {
+		return "", err
+	}
+	s := f.Peer(p.PublicKey)
+	if err := authorizeDelta(typ, p, owner, s != nil); err != nil {
+		return "", err
+	}
+	switch typ {
+	case validator.TypePeerAdd:
+		if s == nil {
+			params := peerParams{Endpoint: p.Endpoint, PersistentKeepalive: p.PersistentKeepalive, Enabled: true}
+			addPeerSection(f, p.PublicKey, "", allowed, params)
+			return f.String(), nil
+		}
+		s.Set("AllowedIPs", strings.Join(allowed, ", "))
+		if p.Endpoint != "" {
+			s.Set("Endpoint", p.Endpoint)
+		}
+		if p.PersistentKeepalive > 0 {
+			s.Set("PersistentKeepalive", strconv.Itoa(p.PersistentKeepalive))
+		}
+		return f.String(), nil
+	case validator.TypePeerRemove:
+		if s != nil {
+			f.RemoveSection(s)
+		}
+	case validator.TypePeerEndpoint:
+		if s != nil {
+			s.Set("Endpoint", p.Endpoint)
+		}
+	case validator.TypePeerKeyRotation:
+		if s != nil {
+			s.Set("PublicKey", p.NewPublicKey)
+		}
+	default:
+		return "", fmt.Errorf("unsupported bundle type %q", typ)
+	}
+	if s == nil {
+		return "", fmt.Errorf("peer %s not present", p.PublicKey)
+	}
+	return f.String(), nil
+}
+
+// localPeerPayload describes this node as a peer, text being its config of
+// the interface. The public key is derived from the interface's private key.
+func localPeerPayload(text string, opts exportOptions) (*peerPayload, error) {
+	f, err := config.Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrValidation, err)
+	}
+	summary := f.Summary()
+	priv, err := wgtypes.ParseKey(summary.Interface["PrivateKey"])
+	if err != nil {
+		return nil, fmt.Errorf("%w: interface has no valid PrivateKey", ErrValidation)
+	}
+	self := priv.PublicKey().String()
+
+	p := &peerPayload{
+		PublicKey:           self,
+		Endpoint:            strings.TrimSpace(opts.Endpoint),
+		AllowedIPs:          opts.AllowedIPs,
+		PersistentKeepalive: opts.PersistentKeepalive,
+	}
+	switch opts.Type {
+	case validator.TypePeerAdd:
+		if len(p.AllowedIPs) == 0 {
+			p.AllowedIPs = hostRoutes(summary.Interface["Address"])
+		}
+	case validator.TypePeerKeyRotation:
+		// announce that the previous key opts.PublicKey is now self
+		p.PublicKey = opts.PublicKey
+		p.NewPublicKey = self
+	}
+	return p, nil
+}
+
+// hostRoutes converts interface addresses such as 10.0.0.1/24 into the
+// single-host routes a remote peer should accept for this node.
+func hostRoutes(addresses string) []string {
+	out := []string{}
+	for _, a := range strings.Split(addresses, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		ip := net.ParseIP(a)
+		if ipAddr, _, err := net.ParseCIDR(a); err == nil {
+			ip = ipAddr
+		}
+		if ip == nil {
+			continue
+		}
+		if ip.To4() != nil {
+			out = append(out, ip.String()+"/32")
+		} else {
+			out = append(out, ip.String()+"/128")
+		}
+	}
+	return out
+}
+
+// bundlePayload builds the payload file for an export of the given type.
+func bundlePayload(iface string, opts exportOptions) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join("/etc/wireguard", iface+".conf"))
+	if err != nil {
+		return nil, err
+	}
+	return exportPayload(string(data), opts)
+}
+
+// exportPayload builds the payload of an export from text, the config of
+// the interface. No payload carries the [Interface] section: a whole-config
+// bundle holds the peer list only, so that neither the private key nor the
+// local settings of this node leave it.
+func exportPayload(text string, opts exportOptions) ([]byte, error) {
+	if opts.Type == validator.TypeConfig {
+		peers, err := peerList(text)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrValidation, err)
+		}
+		return []byte(peers), nil
+	}
+	p, err := localPeerPayload(text, opts)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := decodePeerPayload(opts.Type, b); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrValidation, err)
+	}
+	return b, nil
+}
+
+// peerList returns the [Peer] sections of text, with their comments,
+// dropping the [Interface] section and anything before the first peer.
+func peerList(text string) (string, error) {
+	f, err := config.Parse(text)
+	if err != nil {
+		return "", err
+	}
+	f.Preamble = nil
+	f.Sections = f.Peers()
+	return f.String(), nil
+}
+
+// mergePeerList replaces the peers of current, the receiver's config, with
+// those of a whole-config bundle. The receiver keeps its own [Interface]
+// section, and a peer carrying its own public key is skipped, as is any
+// [Interface] section a bundle from an older node still contains.
+func mergePeerList(current, staged string) (string, error) {
+	f, err := config.Parse(current)
+	if err != nil {
+		return "", err
+	}
+	peers, err := config.Parse(staged)
+	if err != nil {
+		return "", err
+	}
+	self := ""
+	if iface := f.Interface(); iface != nil {
+		if priv, ok := iface.Get("PrivateKey"); ok {
+			self, _ = validator.DerivePublicKey(priv)
+		}
+	}
+	kept := f.Sections[:0]
+	for _, sec := range f.Sections {
+		if sec.Name != "Peer" {
+			kept = append(kept, sec)
+		}
+	}
+	f.Sections = kept
+	for _, sec := range peers.Peers() {
+		if pub, _ := sec.Get("PublicKey"); self != "" && pub == self {
+			continue
+		}
+		f.AppendSection(sec)
+	}
+	return f.String(), nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"wg-bridge/internal/validator"
+)
+
+const exchangeStateFile = "/var/lib/cockpit-wg/exchange-state.json"
+
+// exchangeState is the persistent replay protection state. Received holds
+// the newest manifest accepted per signer and interface, keyed by
+// receivedKey, since every sender numbers its bundles on its own. Sent holds
+// the last sequence number used when exporting an interface.
+type exchangeState struct {
+	Received map[string]*validator.ReplayState `json:"received"`
+	Sent     map[string]uint64                 `json:"sent"`
+}
+
+// receivedKey is the key of the replay state of bundles in stream signed
+// with the key fingerprint.
+func receivedKey(fingerprint, stream string) string {
+	return strings.ToUpper(fingerprint) + "/" + stream
+}
+
+// sequenceStream names the sequence space of bundles of type typ for iface.
+// Receipts are numbered apart from the bundles they acknowledge, so sending
+// one never shifts the sequence of the next export.
+func sequenceStream(iface, typ string) string {
+	if typ == validator.TypeReceipt {
+		return "receipt:" + iface
+	}
+	return iface
+}
+
+// lastReceived returns the newest manifest accepted from fingerprint in
+// stream. State from before it was kept per signer only holds the newest
+// bundle of any sender: it still rules out replaying that bundle or older
+// ones, but does not hold back a sender with a lower sequence number.
+func (st *exchangeState) lastReceived(fingerprint, stream string) *validator.ReplayState {
+	if r, ok := st.Received[receivedKey(fingerprint, stream)]; ok {
+		return r
+	}
+	if legacy, ok := st.Received[stream]; ok {
+		return &validator.ReplayState{Timestamp: legacy.Timestamp, Checksum: legacy.Checksum}
+	}
+	return nil
+}
+
+// freshness checks m, signed with fingerprint, against the recorded state.
+func (st *exchangeState) freshness(mv *validator.ManifestValidator, fingerprint string, m *validator.Manifest) error {
+	last := st.lastReceived(fingerprint, sequenceStream(m.Interface, m.PayloadType()))
+	if last != nil && last.Sequence == 0 && strings.EqualFold(last.Checksum, m.Checksum) {
+		return fmt.Errorf("%w: bundle %s already accepted", validator.ErrReplay, m.Checksum)
+	}
+	return mv.ValidateFreshness(m, last)
+}
+
+var exchangeStateMu sync.Mutex
+
+func loadExchangeState() (*exchangeState, error) {
+	st := &exchangeState{
+		Received: make(map[string]*validator.ReplayState),
+		Sent:     make(map[string]uint64),
+	}
+	b, err := os.ReadFile(exchangeStateFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return st, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil, err
+	}
+	if st.Received == nil {
+		st.Received = make(map[string]*validator.ReplayState)
+	}
+	if st.Sent == nil {
+		st.Sent = make(map[string]uint64)
+	}
+	return st, nil
+}
+
+func saveExchangeState(st *exchangeState) error {
+	if err := os.MkdirAll(filepath.Dir(exchangeStateFile), 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := exchangeStateFile + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, exchangeStateFile)
+}
+
+// checkFreshness reports whether the manifest, signed with fingerprint,
+// would be accepted without recording it.
+func checkFreshness(mv *validator.ManifestValidator, fingerprint string, m *validator.Manifest) error {
+	exchangeStateMu.Lock()
+	defer exchangeStateMu.Unlock()
+	st, err := loadExchangeState()
+	if err != nil {
+		return err
+	}
+	return st.freshness(mv, fingerprint, m)
+}
+
+// acceptManifest validates the manifest, signed with fingerprint, against
+// the state recorded for its signer and interface and runs stage to put the
+// bundle in place. Only once stage succeeds is the manifest recorded as the
+// latest accepted one, so a bundle that could not be staged can be sent
+// again rather than being rejected as a replay.
+func acceptManifest(mv *validator.ManifestValidator, fingerprint string, m *validator.Manifest, stage func() error) error {
+	exchangeStateMu.Lock()
+	defer exchangeStateMu.Unlock()
+	st, err := loadExchangeState()
+	if err != nil {
+		return err
+	}
+	if err := st.freshness(mv, fingerprint, m); err != nil {
+		return err
+	}
+	if err := stage(); err != nil {
+		return err
+	}
+	st.record(fingerprint, m)
+	return saveExchangeState(st)
+}
+
+// record makes m, signed with fingerprint, the latest manifest accepted
+// from its signer in its sequence stream.
+func (st *exchangeState) record(fingerprint string, m *validator.Manifest) {
+	st.Received[receivedKey(fingerprint, sequenceStream(m.Interface, m.PayloadType()))] = &validator.ReplayState{
+		Sequence:  m.Sequence,
+		Timestamp: m.Timestamp,
+		Checksum:  m.Checksum,
+	}
+}
+
+// nextSequence reserves the next outgoing sequence number in stream, see
+// sequenceStream.
+func nextSequence(stream string) (uint64, error) {
+	exchangeStateMu.Lock()
+	defer exchangeStateMu.Unlock()
+	st, err := loadExchangeState()
+	if err != nil {
+		return 0, err
+	}
+	st.Sent[stream]++
+	if err := saveExchangeState(st); err != nil {
+		return 0, err
+	}
+	return st.Sent[stream], nil
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"wg-bridge/internal/bundle"
+	"wg-bridge/internal/validator"
+)
+
+func TestImportBundleRejectsInvalidEncoding(t *testing.T) {
+	if _, err := importBundle("not base64!", "sig"); err == nil || !errors.Is(err, ErrValidation) {
+		t.Fatalf("expected validation error, got %v", err)
+	}
+}
+
+func TestImportBundleRequiresSignature(t *testing.T) {
+	data := base64.StdEncoding.EncodeToString([]byte("bundle"))
+	if _, err := importBundle(data, ""); !errors.Is(err, ErrMissingSignature) {
+		t.Fatalf("expected missing signature error, got %v", err)
+	}
+	if re := wrapError(ErrMissingSignature); re.Code != CodeBundleRejected {
+		t.Fatalf("expected code %d got %d", CodeBundleRejected, re.Code)
+	}
+}
+
+func TestCheckPayloadChecksumMismatch(t *testing.T) {
+	raw := []byte(`{"interface":"wg0","version":2,"checksum":"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824","sequence":1,"timestamp":1}`)
+	m, err := parseManifest(raw)
+	if err != nil {
+		t.Fatalf("parseManifest: %v", err)
+	}
+	if err := checkPayload(m, []byte("other")); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+	if err := checkPayload(m, []byte("hello")); err != nil {
+		t.Fatalf("expected valid manifest, got %v", err)
+	}
+}
+
+func TestParseManifestInvalid(t *testing.T) {
+	raw := []byte(`{"interface":"../etc","version":2,"checksum":"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"}`)
+	if _, err := parseManifest(raw); !errors.Is(err, ErrManifestInvalid) {
+		t.Fatalf("expected invalid manifest, got %v", err)
+	}
+}
+
+func TestFreshnessPerSigner(t *testing.T) {
+	const a, b = "AAAA000000000001", "BBBB000000000002"
+	mv := validator.NewManifestValidator(true)
+	manifest := func(seq uint64, ts int64) *validator.Manifest {
+		return &validator.Manifest{Interface: "wg0", Sequence: seq, Timestamp: ts, Checksum: fmt.Sprintf("%064x", seq)}
+	}
+	st := &exchangeState{Received: map[string]*validator.ReplayState{}}
+
+	// Each sender numbers its bundles on its own
+	for _, step := range []struct {
+		signer string
+		m      *validator.Manifest
+		ok     bool
+	}{
+		{a, manifest(40, 100), true},
+		{b, manifest(3, 101), true},
+		{a, manifest(41, 102), true},
+		{b, manifest(4, 103), true},
+		{b, manifest(4, 103), false},
+		{a, manifest(40, 104), false},
+		{b, manifest(2, 105), false},
+	} {
+		err := st.freshness(mv, step.signer, step.m)
+		if step.ok && err != nil {
+			t.Fatalf("%s seq %d: unexpected error %v", step.signer, step.m.Sequence, err)
+		}
+		if !step.ok && !errors.Is(err, validator.ErrReplay) {
+			t.Fatalf("%s seq %d: expected replay, got %v", step.signer, step.m.Sequence, err)
+		}
+		if err == nil {
+			st.record(step.signer, step.m)
+		}
+	}
+
+	// State kept per interface only still stops replays of its bundle
+	st = &exchangeState{Received: map[string]*validator.ReplayState{"wg0": {Sequence: 40, Timestamp: 100, Checksum: fmt.Sprintf("%064x", 40)}}}
+	if err := st.freshness(mv, b, manifest(3, 101)); err != nil {
+		t.Fatalf("lower sequence of another sender: %v", err)
+	}
+	if err := st.freshness(mv, a, manifest(40, 100)); !errors.Is(err, validator.ErrReplay) {
+		t.Fatalf("expected replay, got %v", err)
+	}
+	if err := st.freshness(mv, b, manifest(5, 99)); !errors.Is(err, validator.ErrReplay) {
+		t.Fatalf("expected older bundle to be rejected, got %v", err)
+	}
+}
+
+func TestBundleReason(t *testing.T) {
+	cases := []struct {
+		err    error
+		reason string
+	}{
+		{ErrMissingSignature, "missing_signature"},
+		{ErrSignatureInvalid, "signature_invalid"},
+		{fmt.Errorf("%w: %v", ErrReplay, "old"), "replay"},
+		{fmt.Errorf("%w: %v", ErrPayloadInvalid, "bad key"), "payload_invalid"},
+		{fmt.Errorf("%w: %v", ErrRoutesNotAllowed, "AllowedIPs 0.0.0.0/0"), "routes_not_allowed"},
+		{fmt.Errorf("%w: %w", ErrBundle, &bundle.Error{Entry: "meta/../x", Err: bundle.ErrUnsafePath}), "unsafe_path"},
+		{errors.New("disk full"), "internal_error"},
+	}
+	for _, c := range cases {
+		if got := bundleReason(c.err); got != c.reason {
+			t.Fatalf("expected reason %q for %v, got %q", c.reason, c.err, got)
+		}
+	}
+}
+
+func testPeerKey(t *testing.T) string {
+	t.Helper()
+	k, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return k.PublicKey().String()
+}
+
+func TestMergeDelta(t *testing.T) {
+	a, b, c := testPeerKey(t), testPeerKey(t), testPeerKey(t)
+	base := "[Interface]\nPrivateKey = secret\nListenPort = 51820\n\n" +
+		"[Peer]\nPublicKey = " + a + "\nAllowedIPs = 10.0.0.2/32\n\n" +
+		"# office\n[Peer]\nPublicKey = " + b + "\nAllowedIPs = 10.0.0.3/32\n"
+
+	out, err := mergeDelta(base, validator.TypePeerAdd, &peerPayload{PublicKey: c, AllowedIPs: []string{"10.0.0.4/32"}, Endpoint: "vpn.example.com:51820"}, c)
+	if err != nil {
+		t.Fatalf("peer-add: %v", err)
+	}
+	if !strings.HasPrefix(out, base) || !strings.Contains(out, "PublicKey = "+c+"\nEndpoint = vpn.example.com:51820\nAllowedIPs = 10.0.0.4/32") {
+		t.Fatalf("unexpected peer-add result:\n%s", out)
+	}
+
+	out, err = mergeDelta(base, validator.TypePeerAdd, &peerPayload{PublicKey: a, AllowedIPs: []string{"10.0.1.0/24"}}, a)
+	if err != nil {
+		t.Fatalf("peer-add existing: %v", err)
+	}
+	if strings.Count(out, a) != 1 || !strings.Contains(out, "AllowedIPs = 10.0.1.0/24") {
+		t.Fatalf("expected existing peer to be updated:\n%s", out)
+	}
+
+	out, err = mergeDelta(base, validator.TypePeerEndpoint, &peerPayload{PublicKey: b, Endpoint: "192.0.2.1:51820"}, b)
+	if err != nil {
+		t.Fatalf("peer-endpoint: %v", err)
+	}
+	if !strings.Contains(out, "AllowedIPs = 10.0.0.3/32\nEndpoint = 192.0.2.1:51820\n") || !strings.Contains(out, "# office") {
+		t.Fatalf("unexpected peer-endpoint result:\n%s", out)
+	}
+
+	out, err = mergeDelta(base, validator.TypePeerKeyRotation, &peerPayload{PublicKey: a, NewPublicKey: c}, a)
+	if err != nil {
+		t.Fatalf("peer-key-rotation: %v", err)
+	}
+	if strings.Contains(out, a) || !strings.Contains(out, "PublicKey = "+c+"\nAllowedIPs = 10.0.0.2/32") {
+		t.Fatalf("unexpected peer-key-rotation result:\n%s", out)
+	}
+
+	out, err = mergeDelta(base, validator.TypePeerRemove, &peerPayload{PublicKey: a}, a)
+	if err != nil {
+		t.Fatalf("peer-remove: %v", err)
+	}
+	if strings.Contains(out, a) || !strings.Contains(out, b) || !strings.Contains(out, "PrivateKey = secret") {
+		t.Fatalf("unexpected peer-remove result:\n%s", out)
+	}
+
+	if _, err := mergeDelta(base, validator.TypePeerRemove, &peerPayload{PublicKey: c}, c); err == nil {
+		t.Fatal("expected error removing unknown peer")
+	}
+}
+
+func TestMergeDeltaOnlyChangesTheSignersPeer(t *testing.T) {
+	a, b, c := testPeerKey(t), testPeerKey(t), testPeerKey(t)
+	base := "[Interface]\nPrivateKey = secret\n\n[Peer]\nPublicKey = " + a + "\nAllowedIPs = 10.0.0.2/32\n"
+	cases := []struct {
+		typ   string
+		p     *peerPayload
+		owner string
+		ok    bool
+	}{
+		{validator.TypePeerRemove, &peerPayload{PublicKey: a}, b, false},
+		{validator.TypePeerRemove, &peerPayload{PublicKey: a}, "", false},
+		{validator.TypePeerEndpoint, &peerPayload{PublicKey: a, Endpoint: "192.0.2.1:51820"}, b, false},
+		{validator.TypePeerKeyRotation, &peerPayload{PublicKey: a, NewPublicKey: c}, b, false},
+		{validator.TypePeerAdd, &peerPayload{PublicKey: a, AllowedIPs: []string{"0.0.0.0/0"}}, "", false},
+		{validator.TypePeerAdd, &peerPayload{PublicKey: c, AllowedIPs: []string{"10.0.0.4/32"}}, b, false},
+		{validator.TypePeerAdd, &peerPayload{PublicKey: c, AllowedIPs: []string{"10.0.0.4/32"}}, "", true},
+		{validator.TypePeerEndpoint, &peerPayload{PublicKey: a, Endpoint: "192.0.2.1:51820"}, a, true},
+	}
+	for _, tc := range cases {
+		_, err := mergeDelta(base, tc.typ, tc.p, tc.owner)
+		if tc.ok && err != nil {
+			t.Errorf("%s for %s signed by %q: %v", tc.typ, tc.p.PublicKey, tc.owner, err)
+		}
+		if !tc.ok && !errors.Is(err, ErrSignerNotAllowed) {
+			t.Errorf("%s for %s signed by %q: expected ErrSignerNotAllowed, got %v", tc.typ, tc.p.PublicKey, tc.owner, err)
+		}
+	}
+}
+
+func TestMergeDeltaKeepsComments(t *testing.T) {
+	a, b := testPeerKey(t), testPeerKey(t)
+	base := "# wg0, managed by hand\n[Interface]\nPrivateKey = secret\n\n" +
+		"# laptop\n[Peer]\nPublicKey = " + a + "\nAllowedIPs = 10.0.0.2/32 # fixed lease\n; roams\n\n" +
+		"# phone\n[Peer]\nPublicKey = " + b + "\nAllowedIPs = 10.0.0.3/32\n"
+
+	out, err := mergeDelta(base, validator.TypePeerAdd, &peerPayload{PublicKey: a, AllowedIPs: []string{"10.0.1.0/24"}}, a)
+	if err != nil {
+		t.Fatalf("peer-add existing: %v", err)
+	}
+	want := strings.Replace(base, "10.0.0.2/32 # fixed lease", "10.0.1.0/24 # fixed lease", 1)
+	if out != want {
+		t.Fatalf("expected only AllowedIPs to change:\n%s", out)
+	}
+
+	out, err = mergeDelta(base, validator.TypePeerRemove, &peerPayload{PublicKey: b}, b)
+	if err != nil {
+		t.Fatalf("peer-remove: %v", err)
+	}
+	if strings.Contains(out, "# phone") || !strings.Contains(out, "; roams") || !strings.HasPrefix(out, "# wg0, managed by hand\n") {
+		t.Fatalf("unexpected peer-remove result:\n%s", out)
+	}
+}
+
+func TestExportPayloadCarriesNoPrivateKey(t *testing.T) {
+	priv, _, _ := genKeyPair()
+	peer, old := testPeerKey(t), testPeerKey(t)
+	text := "# hq\n[Interface]\nPrivateKey = " + priv + "\nAddress = 10.0.0.1/24\nListenPort = 51820\nPostUp = iptables -A FORWARD -i wg0 -j ACCEPT\n\n" +
+		"# branch\n[Peer]\nPublicKey = " + peer + "\nAllowedIPs = 10.0.0.2/32\n"
+	for _, opts := range []exportOptions{
+		{},
+		{Type: validator.TypeConfig},
+		{Type: validator.TypePeerAdd, Endpoint: "vpn.example.com:51820"},
+		{Type: validator.TypePeerRemove},
+		{Type: validator.TypePeerEndpoint, Endpoint: "vpn.example.com:51820"},
+		{Type: validator.TypePeerKeyRotation, PublicKey: old},
+	} {
+		if opts.Type == "" {
+			opts.Type = validator.TypePeerAdd
+		}
+		b, err := exportPayload(text, opts)
+		if err != nil {
+			t.Fatalf("%s: %v", opts.Type, err)
+		}
+		out := string(b)
+		if strings.Contains(out, priv) || strings.Contains(out, "PrivateKey") || strings.Contains(out, "ListenPort") || strings.Contains(out, "PostUp") {
+			t.Errorf("%s payload leaks the interface section:\n%s", opts.Type, out)
+		}
+	}
+	b, _ := exportPayload(text, exportOptions{Type: validator.TypeConfig})
+	if string(b) != "# branch\n[Peer]\nPublicKey = "+peer+"\nAllowedIPs = 10.0.0.2/32\n" {
+		t.Errorf("unexpected peer list:\n%s", b)
+	}
+}
+
+func TestMergePeerList(t *testing.T) {
+	priv, self, _ := genKeyPair()
+	a, b := testPeerKey(t), testPeerKey(t)
+	current := "[Interface]\nPrivateKey = " + priv + "\nListenPort = 51821\n\n[Peer]\nPublicKey = " + a + "\nAllowedIPs = 10.0.0.2/32\n"
+	staged := "[Interface]\nPrivateKey = sender\nListenPort = 51820\n\n" +
+		"[Peer]\nPublicKey = " + self + "\nAllowedIPs = 10.0.0.5/32\n\n" +
+		"# office\n[Peer]\nPublicKey = " + b + "\nAllowedIPs = 10.0.0.3/32"
+	out, err := mergePeerList(current, staged)
+	if err != nil {
+		t.Fatalf("mergePeerList: %v", err)
+	}
+	want := "[Interface]\nPrivateKey = " + priv + "\nListenPort = 51821\n\n# office\n[Peer]\nPublicKey = " + b + "\nAllowedIPs = 10.0.0.3/32"
+	if out != want {
+		t.Fatalf("unexpected merge:\n%s", out)
+	}
+}
+
+func TestDecodePeerPayload(t *testing.T) {
+	key := testPeerKey(t)
+	cases := []struct {
+		typ     string
+		payload string
+		ok      bool
+	}{
+		{validator.TypePeerAdd, `{"publicKey":"` + key + `","allowedIPs":["10.0.0.2/32"]}`, true},
+		{validator.TypePeerAdd, `{"publicKey":"` + key + `"}`, false},
+		{validator.TypePeerAdd, `{"publicKey":"nope","allowedIPs":["10.0.0.2/32"]}`, false},
+		{validator.TypePeerEndpoint, `{"publicKey":"` + key + `","endpoint":"host:0"}`, false},
+		{validator.TypePeerEndpoint, `{"publicKey":"` + key + `","endpoint":"[2001:db8::1]:51820"}`, true},
+		{validator.TypePeerKeyRotation, `{"publicKey":"` + key + `"}`, false},
+		{validator.TypePeerRemove, `{"publicKey":"` + key + `"}`, true},
+	}
+	for _, c := range cases {
+		_, err := decodePeerPayload(c.typ, []byte(c.payload))
+		if (err == nil) != c.ok {
+			t.Fatalf("%s %s: expected ok=%v, got %v", c.typ, c.payload, c.ok, err)
+		}
+	}
+}
+
+func TestReadBundlePeerPayload(t *testing.T) {
+	payload := []byte(`{"publicKey":"` + testPeerKey(t) + `","allowedIPs":["10.0.0.2/32"]}`)
+	sum := sha256.Sum256(payload)
+	man, _ := json.Marshal(validator.Manifest{
+		Interface: "wg0",
+		Version:   manifestVersion,
+		Type:      validator.TypePeerAdd,
+		Checksum:  hex.EncodeToString(sum[:]),
+		Sequence:  1,
+		Timestamp: 1,
+	})
+	var buf bytes.Buffer
+	if err := bundle.Write(&buf, []bundle.File{{Name: "manifest.json", Data: man}, {Name: "payload.json", Data: payload}}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	archive, err := bundle.Read(&buf, bundle.DefaultLimits)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	m, got, err := readBundle(archive)
+	if err != nil {
+		t.Fatalf("readBundle: %v", err)
+	}
+	if m.PayloadType() != validator.TypePeerAdd || !bytes.Equal(got, payload) {
+		t.Fatalf("unexpected manifest %+v / payload %s", m, got)
+	}
+}
+
+func TestHostRoutes(t *testing.T) {
+	got := hostRoutes("10.0.0.1/24, fd00::1/64")
+	if strings.Join(got, ",") != "10.0.0.1/32,fd00::1/128" {
+		t.Fatalf("unexpected routes %v", got)
+	}
+}
+
+func TestOutboxPathRejectsTraversal(t *testing.T) {
+	for _, name := range []string{"../wg0.wgx", "wg0.conf", "..wgx", "a/b.wgx", ""} {
+		if _, err := outboxPath(name); !errors.Is(err, ErrValidation) {
+			t.Fatalf("expected validation error for %q, got %v", name, err)
+		}
+	}
+	if p, err := outboxPath("wg0-1.wgx"); err != nil || p != outboxDir+"/wg0-1.wgx" {
+		t.Fatalf("unexpected path %q: %v", p, err)
+	}
+}
+
+func TestDecodeReceipt(t *testing.T) {
+	sum := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if _, err := decodeReceipt([]byte(`{"status":"applied","interface":"wg0","checksum":"` + sum + `"}`)); err != nil {
+		t.Fatalf("expected valid receipt, got %v", err)
+	}
+	for _, bad := range []string{
+		`{"status":"done","interface":"wg0","checksum":"` + sum + `"}`,
+		`{"status":"applied","interface":"../x","checksum":"` + sum + `"}`,
+		`{"status":"applied","interface":"wg0","checksum":"abc"}`,
+		`{"status":"rejected","interface":"wg0","checksum":"` + sum + `","reason":"` + strings.Repeat("x", 300) + `"}`,
+	} {
+		if _, err := decodeReceipt([]byte(bad)); err == nil {
+			t.Fatalf("expected receipt to be rejected: %s", bad)
+		}
+	}
+}
+
+func TestApplyReceipt(t *testing.T) {
+	sum := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	entry := &outboxEntry{Interface: "wg0", Type: validator.TypeConfig, Checksum: sum, Sequence: 3}
+
+	if applyReceipt(entry, "branch1", "b1", &receiptPayload{Status: receiptAccepted, Interface: "wg0", Checksum: sum, Sequence: 4}, 10) {
+		t.Fatal("expected receipt for another sequence not to match")
+	}
+	if !applyReceipt(entry, "branch1", "b1", &receiptPayload{Status: receiptApplied, Interface: "wg0", Checksum: sum, Sequence: 3}, 20) {
+		t.Fatal("expected receipt to match")
+	}
+	// an older, replayed receipt must not overwrite the newer status
+	applyReceipt(entry, "branch1", "b1", &receiptPayload{Status: receiptAccepted, Interface: "wg0", Checksum: sum, Sequence: 3}, 10)
+	if got := entry.Receipts["branch1"].Status; got != receiptApplied {
+		t.Fatalf("expected applied, got %s", got)
+	}
+
+	receipt := &outboxEntry{Interface: "wg0", Type: validator.TypeReceipt, Checksum: sum}
+	if applyReceipt(receipt, "branch1", "b1", &receiptPayload{Status: receiptApplied, Interface: "wg0", Checksum: sum}, 30) {
+		t.Fatal("receipts must not be acknowledged")
+	}
+}
+
+func TestReceiptSequenceStream(t *testing.T) {
+	const a = "AAAA000000000001"
+	mv := validator.NewManifestValidator(true)
+	st := &exchangeState{Received: map[string]*validator.ReplayState{}}
+	config := &validator.Manifest{Interface: "wg0", Sequence: 41, Timestamp: 100, Checksum: fmt.Sprintf("%064x", 1)}
+	receipt := &validator.Manifest{Interface: "wg0", Type: validator.TypeReceipt, Sequence: 1, Timestamp: 101, Checksum: fmt.Sprintf("%064x", 2)}
+	if sequenceStream("wg0", validator.TypeReceipt) == sequenceStream("wg0", validator.TypePeerAdd) {
+		t.Fatal("receipts must not share the sequence of other bundles")
+	}
+	st.record(a, config)
+	if err := st.freshness(mv, a, receipt); err != nil {
+		t.Fatalf("receipt numbered on its own: %v", err)
+	}
+	st.record(a, receipt)
+	if err := st.freshness(mv, a, receipt); !errors.Is(err, validator.ErrReplay) {
+		t.Fatalf("expected replayed receipt to be rejected, got %v", err)
+	}
+}
+
+func TestReceiptDelivered(t *testing.T) {
+	now := time.Now()
+	entry := &outboxEntry{Type: validator.TypeReceipt, Created: now.UTC().Format(time.RFC3339)}
+	if receiptDelivered(entry) || receiptExpired(entry, now) {
+		t.Fatal("undelivered receipt must be kept")
+	}
+	entry.Deliveries = map[string]*deliveryStatus{"hq": {Transport: "ssh", Error: "scp: timeout"}}
+	if receiptDelivered(entry) {
+		t.Fatal("failed delivery must be retried")
+	}
+	entry.Deliveries["hq"].Error = ""
+	if !receiptDelivered(entry) {
+		t.Fatal("expected receipt to be delivered")
+	}
+	if !receiptExpired(entry, now.Add(receiptRetention+time.Hour)) {
+		t.Fatal("expected receipt to expire")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// fileOwner is not available on Windows (no uid/gid)
+func fileOwner(_ os.FileInfo) (uint32, uint32, bool) {
+	return 0, 0, false
+}
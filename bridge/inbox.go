@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/journal"
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	quarantineDir = "/var/lib/cockpit-wg/quarantine"
+	// inboxSettle is the quiet period after the last write before a file is
+	// considered complete.
+	inboxSettle = 2 * time.Second
+	// signatureGrace is how long a bundle waits for its .minisig to arrive.
+	signatureGrace = 2 * time.Minute
+)
+
+// quarantineRecord is stored next to a quarantined bundle as
+// <bundle>.reason.json.
+type quarantineRecord struct {
+	File   string `json:"file"`
+	Reason string `json:"reason"`
+	Error  string `json:"error"`
+	Time   string `json:"time"`
+}
+
+// inboxWatcher tracks bundles in the inbox until they and their signature
+// are complete, then hands them to process. Bundles that fail are moved to
+// the quarantine directory.
+type inboxWatcher struct {
+	dir        string
+	quarantine string
+	settle     time.Duration
+	grace      time.Duration
+	process    func(path, sig string) error
+
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+	first  map[string]time.Time
+	// busy serializes processing so two bundles never stage concurrently.
+	busy sync.Mutex
+}
+
+func newInboxWatcher(dir, quarantine string, process func(path, sig string) error) *inboxWatcher {
+	return &inboxWatcher{
+		dir:        dir,
+		quarantine: quarantine,
+		settle:     inboxSettle,
+		grace:      signatureGrace,
+		process:    process,
+		timers:     make(map[string]*time.Timer),
+		first:      make(map[string]time.Time),
+	}
+}
+
+func watchInbox() {
+	if err := os.MkdirAll(inboxDir, 0700); err != nil {
+		journal.Send(fmt.Sprintf("{\"action\":\"inbox\",\"error\":\"%v\"}", err), journal.PriErr, nil)
+		return
+	}
+	w := newInboxWatcher(inboxDir, quarantineDir, func(path, sig string) error {
+		res, err := processBundle(path, sig)
+		auditBundle("inbox", res, err)
+		return err
+	})
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		journal.Send(fmt.Sprintf("{\"action\":\"inbox\",\"error\":\"%v\"}", err), journal.PriErr, nil)
+		return
+	}
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&(fsnotify.Create|fsnotify.Write) != 0 {
+					w.notify(event.Name)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				journal.Send(fmt.Sprintf("{\"action\":\"inbox\",\"error\":\"%v\"}", err), journal.PriErr, nil)
+			}
+		}
+	}()
+	if err := watcher.Add(inboxDir); err != nil {
+		journal.Send(fmt.Sprintf("{\"action\":\"inbox\",\"error\":\"%v\"}", err), journal.PriErr, nil)
+	}
+	// Pick up anything that arrived while the bridge was not running. This
+	// happens after the watch is registered so no file slips through.
+	w.rescan()
+}
+
+// rescan schedules every bundle currently in the inbox.
+func (w *inboxWatcher) rescan() {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".wgx") {
+			w.notify(filepath.Join(w.dir, e.Name()))
+		}
+	}
+}
+
+// notify is called for every change to a bundle or signature file and
+// (re)starts the settle timer of the bundle it belongs to.
+func (w *inboxWatcher) notify(name string) {
+	var path string
+	switch {
+	case strings.HasSuffix(name, ".wgx"):
+		path = name
+	case strings.HasSuffix(name, ".wgx.minisig"):
+		path = strings.TrimSuffix(name, ".minisig")
+	default:
+		return
+	}
+	w.schedule(path, w.settle)
+}
+
+func (w *inboxWatcher) schedule(path string, d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.first[path]; !ok {
+		w.first[path] = time.Now()
+	}
+	if t, ok := w.timers[path]; ok {
+		t.Stop()
+	}
+	w.timers[path] = time.AfterFunc(d, func() { w.check(path) })
+}
+
+func (w *inboxWatcher) forget(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.timers, path)
+	delete(w.first, path)
+}
+
+// check runs once a bundle has been quiet for the settle period.
+func (w *inboxWatcher) check(path string) {
+	st, err := os.Stat(path)
+	if err != nil {
+		// only the signature has arrived so far, or the bundle was removed
+		w.forget(path)
+		return
+	}
+	sig := path + ".minisig"
+	sigSt, sigErr := os.Stat(sig)
+
+	// Writers that do not produce fsnotify events (e.g. some network file
+	// systems) are caught by comparing modification times.
+	if wait := w.settle - time.Since(st.ModTime()); wait > 0 {
+		w.schedule(path, wait)
+		return
+	}
+	if sigErr == nil {
+		if wait := w.settle - time.Since(sigSt.ModTime()); wait > 0 {
+			w.schedule(path, wait)
+			return
+		}
+	}
+
+	if sigErr != nil {
+		w.mu.Lock()
+		waited := time.Since(w.first[path])
+		w.mu.Unlock()
+		if waited < w.grace {
+			next := w.grace - waited
+			if next > w.settle {
+				next = w.settle
+			}
+			w.schedule(path, next)
+			return
+		}
+	}
+
+	w.forget(path)
+	w.busy.Lock()
+	defer w.busy.Unlock()
+	if err := w.process(path, sig); err != nil {
+		journal.Send(fmt.Sprintf("{\"bundle\":\"%s\",\"error\":\"%v\"}", filepath.Base(path), err), journal.PriErr, nil)
+		if qerr := w.quarantineBundle(path, err); qerr != nil {
+			journal.Send(fmt.Sprintf("{\"bundle\":\"%s\",\"error\":\"quarantine: %v\"}", filepath.Base(path), qerr), journal.PriErr, nil)
+		}
+		return
+	}
+	os.Remove(path)
+	os.Remove(sig)
+}
+
+// quarantineBundle moves a failed bundle and its signature out of the inbox
+// and records why it was rejected.
+func (w *inboxWatcher) quarantineBundle(path string, cause error) error {
+	if err := os.MkdirAll(w.quarantine, 0700); err != nil {
+		return err
+	}
+	name := filepath.Base(path)
+	if _, err := os.Stat(filepath.Join(w.quarantine, name)); err == nil {
+		name = fmt.Sprintf("%d-%s", time.Now().UnixNano(), name)
+	}
+	dest := filepath.Join(w.quarantine, name)
+	if err := os.Rename(path, dest); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".minisig", dest+".minisig"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	rec := quarantineRecord{
+		File:   name,
+		Reason: bundleReason(cause),
+		Error:  cause.Error(),
+		Time:   time.Now().UTC().Format(time.RFC3339),
+	}
+	b, _ := json.MarshalIndent(rec, "", "  ")
+	return os.WriteFile(dest+".reason.json", b, 0600)
+}
+
+// listQuarantine returns the reason records of all quarantined bundles.
+func listQuarantine(dir string) ([]map[string]interface{}, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []map[string]interface{}{}, nil
+		}
+		return nil, err
+	}
+	result := []map[string]interface{}{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".wgx") {
+			continue
+		}
+		info := map[string]interface{}{"file": e.Name(), "quarantined": true, "reason": "unknown"}
+		if b, err := os.ReadFile(filepath.Join(dir, e.Name()+".reason.json")); err == nil {
+			var rec quarantineRecord
+			if json.Unmarshal(b, &rec) == nil {
+				info["reason"] = rec.Reason
+				info["error"] = rec.Error
+				info["quarantinedAt"] = rec.Time
+			}
+		}
+		result = append(result, info)
+	}
+	return result, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordedCalls struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (r *recordedCalls) add(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.paths = append(r.paths, path)
+}
+
+func (r *recordedCalls) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.paths)
+}
+
+func newTestWatcher(t *testing.T, process func(path, sig string) error) *inboxWatcher {
+	t.Helper()
+	dir := t.TempDir()
+	w := newInboxWatcher(filepath.Join(dir, "inbox"), filepath.Join(dir, "quarantine"), process)
+	w.settle = 20 * time.Millisecond
+	w.grace = 200 * time.Millisecond
+	if err := os.MkdirAll(w.dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInboxWatcherWaitsForLateSignature(t *testing.T) {
+	calls := &recordedCalls{}
+	w := newTestWatcher(t, func(path, sig string) error {
+		if _, err := os.Stat(sig); err != nil {
+			return ErrMissingSignature
+		}
+		calls.add(path)
+		return nil
+	})
+	path := filepath.Join(w.dir, "a.wgx")
+	os.WriteFile(path, []byte("bundle"), 0600)
+	w.notify(path)
+
+	time.Sleep(80 * time.Millisecond)
+	if calls.count() != 0 {
+		t.Fatalf("bundle processed before its signature arrived")
+	}
+	os.WriteFile(path+".minisig", []byte("sig"), 0600)
+	w.notify(path + ".minisig")
+
+	waitFor(t, func() bool { return calls.count() == 1 })
+	waitFor(t, func() bool {
+		_, err := os.Stat(path)
+		return errors.Is(err, os.ErrNotExist)
+	})
+}
+
+func TestInboxWatcherQuarantinesMissingSignature(t *testing.T) {
+	w := newTestWatcher(t, func(path, sig string) error {
+		if _, err := os.Stat(sig); err != nil {
+			return ErrMissingSignature
+		}
+		return nil
+	})
+	path := filepath.Join(w.dir, "b.wgx")
+	os.WriteFile(path, []byte("bundle"), 0600)
+	w.notify(path)
+
+	reasonFile := filepath.Join(w.quarantine, "b.wgx.reason.json")
+	waitFor(t, func() bool {
+		_, err := os.Stat(reasonFile)
+		return err == nil
+	})
+	b, _ := os.ReadFile(reasonFile)
+	var rec quarantineRecord
+	if err := json.Unmarshal(b, &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Reason != "missing_signature" {
+		t.Fatalf("expected missing_signature, got %q", rec.Reason)
+	}
+
+	list, err := listQuarantine(w.quarantine)
+	if err != nil || len(list) != 1 || list[0]["reason"] != "missing_signature" {
+		t.Fatalf("unexpected quarantine listing %v (%v)", list, err)
+	}
+}
+
+func TestInboxWatcherRescan(t *testing.T) {
+	calls := &recordedCalls{}
+	w := newTestWatcher(t, func(path, sig string) error {
+		calls.add(path)
+		return nil
+	})
+	for _, name := range []string{"c.wgx", "d.wgx"} {
+		path := filepath.Join(w.dir, name)
+		os.WriteFile(path, []byte("bundle"), 0600)
+		os.WriteFile(path+".minisig", []byte("sig"), 0600)
+	}
+	w.rescan()
+	waitFor(t, func() bool { return calls.count() == 2 })
+}
@@ -0,0 +1,220 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrTooManyEntries is returned when an archive exceeds Limits.MaxEntries
+	ErrTooManyEntries = errors.New("too many entries")
+	// ErrEntryTooLarge is returned when a single entry exceeds Limits.MaxEntrySize
+	ErrEntryTooLarge = errors.New("entry too large")
+	// ErrArchiveTooLarge is returned when all entries together exceed Limits.MaxTotalSize
+	ErrArchiveTooLarge = errors.New("archive too large")
+	// ErrUnsafePath is returned for absolute, relative-parent or otherwise non-canonical names
+	ErrUnsafePath = errors.New("unsafe path")
+	// ErrUnsupportedEntry is returned for links, devices, FIFOs and other special entries
+	ErrUnsupportedEntry = errors.New("unsupported entry type")
+	// ErrDuplicateEntry is returned when a name appears more than once
+	ErrDuplicateEntry = errors.New("duplicate entry")
+	// ErrMissingEntry is returned when a required entry is absent
+	ErrMissingEntry = errors.New("missing entry")
+	// ErrMalformed is returned when the tar stream itself cannot be read
+	ErrMalformed = errors.New("malformed archive")
+)
+
+// reasons maps error kinds to stable machine-readable identifiers
+var reasons = []struct {
+	err    error
+	reason string
+}{
+	{ErrTooManyEntries, "too_many_entries"},
+	{ErrEntryTooLarge, "entry_too_large"},
+	{ErrArchiveTooLarge, "archive_too_large"},
+	{ErrUnsafePath, "unsafe_path"},
+	{ErrUnsupportedEntry, "unsupported_entry"},
+	{ErrDuplicateEntry, "duplicate_entry"},
+	{ErrMissingEntry, "missing_entry"},
+	{ErrMalformed, "malformed_archive"},
+}
+
+// nameRx restricts entry names to a conservative character set
+var nameRx = regexp.MustCompile(`^[A-Za-z0-9._-]+(/[A-Za-z0-9._-]+)*$`)
+
+const maxNameLength = 255
+
+// Error describes why an archive was rejected
+type Error struct {
+	Entry string
+	Err   error
+}
+
+func (e *Error) Error() string {
+	if e.Entry == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %q", e.Err.Error(), e.Entry)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Reason returns a stable identifier for errors produced by this package,
+// or an empty string for unrelated errors
+func Reason(err error) string {
+	for _, r := range reasons {
+		if errors.Is(err, r.err) {
+			return r.reason
+		}
+	}
+	return ""
+}
+
+// Limits bounds the resources an archive may consume while being read
+type Limits struct {
+	MaxEntries   int
+	MaxEntrySize int64
+	MaxTotalSize int64
+}
+
+// DefaultLimits are sized for exchange bundles: a manifest, a configuration
+// and a handful of metadata files
+var DefaultLimits = Limits{
+	MaxEntries:   64,
+	MaxEntrySize: 1 << 20, // 1MB
+	MaxTotalSize: 4 << 20, // 4MB
+}
+
+// Archive holds the regular files of a validated tar archive
+type Archive struct {
+	files map[string][]byte
+	names []string
+}
+
+// Read reads a tar stream enforcing the given limits. Every entry name must
+// already be in canonical form; links, devices and duplicate names are
+// rejected. Directory entries are validated but not returned.
+func Read(r io.Reader, limits Limits) (*Archive, error) {
+	a := &Archive{files: make(map[string][]byte)}
+	seen := make(map[string]struct{})
+	tr := tar.NewReader(r)
+	var total int64
+	entries := 0
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &Error{Err: fmt.Errorf("%w: %v", ErrMalformed, err)}
+		}
+
+		entries++
+		if entries > limits.MaxEntries {
+			return nil, &Error{Entry: hdr.Name, Err: ErrTooManyEntries}
+		}
+
+		name, err := cleanName(hdr.Name, hdr.Typeflag == tar.TypeDir)
+		if err != nil {
+			return nil, &Error{Entry: hdr.Name, Err: err}
+		}
+		if _, dup := seen[name]; dup {
+			return nil, &Error{Entry: hdr.Name, Err: ErrDuplicateEntry}
+		}
+		seen[name] = struct{}{}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg:
+		default:
+			return nil, &Error{Entry: hdr.Name, Err: ErrUnsupportedEntry}
+		}
+
+		if hdr.Size < 0 || hdr.Size > limits.MaxEntrySize {
+			return nil, &Error{Entry: hdr.Name, Err: ErrEntryTooLarge}
+		}
+		total += hdr.Size
+		if total > limits.MaxTotalSize {
+			return nil, &Error{Entry: hdr.Name, Err: ErrArchiveTooLarge}
+		}
+
+		var buf bytes.Buffer
+		n, err := io.Copy(&buf, io.LimitReader(tr, limits.MaxEntrySize+1))
+		if err != nil {
+			return nil, &Error{Entry: hdr.Name, Err: fmt.Errorf("%w: %v", ErrMalformed, err)}
+		}
+		if n != hdr.Size {
+			return nil, &Error{Entry: hdr.Name, Err: ErrMalformed}
+		}
+		a.files[name] = buf.Bytes()
+		a.names = append(a.names, name)
+	}
+
+	sort.Strings(a.names)
+	return a, nil
+}
+
+// cleanName validates an entry name and returns it without the trailing
+// slash of directory entries
+func cleanName(name string, dir bool) (string, error) {
+	if dir {
+		name = strings.TrimSuffix(name, "/")
+	}
+	if name == "" || len(name) > maxNameLength {
+		return "", ErrUnsafePath
+	}
+	if !nameRx.MatchString(name) || path.Clean(name) != name {
+		return "", ErrUnsafePath
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "." || part == ".." {
+			return "", ErrUnsafePath
+		}
+	}
+	return name, nil
+}
+
+// Names returns the names of all regular files in sorted order
+func (a *Archive) Names() []string {
+	out := make([]string, len(a.names))
+	copy(out, a.names)
+	return out
+}
+
+// File returns the content of the named entry
+func (a *Archive) File(name string) ([]byte, bool) {
+	data, ok := a.files[name]
+	return data, ok
+}
+
+// Require returns the content of the named entry or an ErrMissingEntry error
+func (a *Archive) Require(name string) ([]byte, error) {
+	data, ok := a.files[name]
+	if !ok {
+		return nil, &Error{Entry: name, Err: ErrMissingEntry}
+	}
+	return data, nil
+}
+
+// Dir returns all files below the given directory keyed by their full name
+func (a *Archive) Dir(dir string) map[string][]byte {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	out := make(map[string][]byte)
+	for _, name := range a.names {
+		if strings.HasPrefix(name, prefix) {
+			out[name] = a.files[name]
+		}
+	}
+	return out
+}
@@ -0,0 +1,183 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// rawArchive builds a tar stream without the name checks Write performs
+func rawArchive(t *testing.T, headers ...*tar.Header) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range headers {
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0600
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("write header: %v", err)
+		}
+		if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+			if _, err := tw.Write(bytes.Repeat([]byte("x"), int(hdr.Size))); err != nil {
+				t.Fatalf("write body: %v", err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestWriteReadRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	files := []File{
+		{Name: "manifest.json", Data: []byte(`{"interface":"wg0"}`)},
+		{Name: "config.conf", Data: []byte("[Interface]\n")},
+		{Name: "meta/notes.txt", Data: []byte("hello")},
+	}
+	if err := Write(&buf, files); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	a, err := Read(&buf, DefaultLimits)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	for _, f := range files {
+		data, ok := a.File(f.Name)
+		if !ok || !bytes.Equal(data, f.Data) {
+			t.Errorf("Expected %s to round-trip, got %q", f.Name, data)
+		}
+	}
+	if meta := a.Dir("meta"); len(meta) != 1 {
+		t.Errorf("Expected 1 meta entry, got %d", len(meta))
+	}
+	if _, err := a.Require("missing.json"); !errors.Is(err, ErrMissingEntry) {
+		t.Errorf("Expected ErrMissingEntry, got %v", err)
+	}
+}
+
+func TestReadRejectsUnsafePaths(t *testing.T) {
+	names := []string{
+		"/etc/passwd",
+		"../escape",
+		"meta/../../escape",
+		"meta/./file",
+		"meta//file",
+		"./manifest.json",
+		"meta\\file",
+		"",
+		strings.Repeat("a", 300),
+	}
+
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			data := rawArchive(t, &tar.Header{Name: name, Size: 1})
+			_, err := Read(bytes.NewReader(data), DefaultLimits)
+			if !errors.Is(err, ErrUnsafePath) {
+				t.Errorf("Expected ErrUnsafePath for %q, got %v", name, err)
+			}
+		})
+	}
+}
+
+func TestReadRejectsSpecialEntries(t *testing.T) {
+	headers := []*tar.Header{
+		{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/shadow"},
+		{Name: "hard", Typeflag: tar.TypeLink, Linkname: "config.conf"},
+		{Name: "dev", Typeflag: tar.TypeChar},
+		{Name: "blk", Typeflag: tar.TypeBlock},
+		{Name: "fifo", Typeflag: tar.TypeFifo},
+	}
+
+	for _, hdr := range headers {
+		t.Run(hdr.Name, func(t *testing.T) {
+			data := rawArchive(t, hdr)
+			_, err := Read(bytes.NewReader(data), DefaultLimits)
+			if !errors.Is(err, ErrUnsupportedEntry) {
+				t.Errorf("Expected ErrUnsupportedEntry, got %v", err)
+			}
+			if Reason(err) != "unsupported_entry" {
+				t.Errorf("Expected reason unsupported_entry, got %q", Reason(err))
+			}
+		})
+	}
+}
+
+func TestReadRejectsDuplicates(t *testing.T) {
+	data := rawArchive(t,
+		&tar.Header{Name: "config.conf", Size: 1},
+		&tar.Header{Name: "config.conf", Size: 2},
+	)
+	if _, err := Read(bytes.NewReader(data), DefaultLimits); !errors.Is(err, ErrDuplicateEntry) {
+		t.Errorf("Expected ErrDuplicateEntry, got %v", err)
+	}
+
+	data = rawArchive(t,
+		&tar.Header{Name: "meta", Typeflag: tar.TypeDir},
+		&tar.Header{Name: "meta/", Typeflag: tar.TypeDir},
+	)
+	if _, err := Read(bytes.NewReader(data), DefaultLimits); !errors.Is(err, ErrDuplicateEntry) {
+		t.Errorf("Expected ErrDuplicateEntry for directories, got %v", err)
+	}
+}
+
+func TestReadEnforcesLimits(t *testing.T) {
+	limits := Limits{MaxEntries: 2, MaxEntrySize: 10, MaxTotalSize: 15}
+
+	testCases := []struct {
+		name    string
+		headers []*tar.Header
+		want    error
+	}{
+		{
+			name:    "too many entries",
+			headers: []*tar.Header{{Name: "a", Size: 1}, {Name: "b", Size: 1}, {Name: "c", Size: 1}},
+			want:    ErrTooManyEntries,
+		},
+		{
+			name:    "entry too large",
+			headers: []*tar.Header{{Name: "a", Size: 11}},
+			want:    ErrEntryTooLarge,
+		},
+		{
+			name:    "archive too large",
+			headers: []*tar.Header{{Name: "a", Size: 10}, {Name: "b", Size: 10}},
+			want:    ErrArchiveTooLarge,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data := rawArchive(t, tc.headers...)
+			if _, err := Read(bytes.NewReader(data), limits); !errors.Is(err, tc.want) {
+				t.Errorf("Expected %v, got %v", tc.want, err)
+			}
+		})
+	}
+}
+
+func TestReadMalformed(t *testing.T) {
+	_, err := Read(strings.NewReader("definitely not a tar archive, but long enough to need a header block"+strings.Repeat(" ", 512)), DefaultLimits)
+	if !errors.Is(err, ErrMalformed) {
+		t.Errorf("Expected ErrMalformed, got %v", err)
+	}
+	if Reason(err) != "malformed_archive" {
+		t.Errorf("Expected reason malformed_archive, got %q", Reason(err))
+	}
+}
+
+func TestWriteRejectsUnsafeNames(t *testing.T) {
+	var buf bytes.Buffer
+	err := Write(&buf, []File{{Name: "../escape", Data: []byte("x")}})
+	if !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("Expected ErrUnsafePath, got %v", err)
+	}
+}
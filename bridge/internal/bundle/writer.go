@@ -0,0 +1,45 @@
+package bundle
+
+import (
+	"archive/tar"
+	"io"
+	"time"
+)
+
+// File is a single regular file written to an archive
+type File struct {
+	Name string
+	Data []byte
+}
+
+// Write writes the files as a tar stream. Names are validated with the same
+// rules Read applies so that every archive produced here can be read back.
+func Write(w io.Writer, files []File) error {
+	tw := tar.NewWriter(w)
+	seen := make(map[string]struct{})
+	now := time.Now()
+	for _, f := range files {
+		name, err := cleanName(f.Name, false)
+		if err != nil {
+			return &Error{Entry: f.Name, Err: err}
+		}
+		if _, dup := seen[name]; dup {
+			return &Error{Entry: f.Name, Err: ErrDuplicateEntry}
+		}
+		seen[name] = struct{}{}
+		hdr := &tar.Header{
+			Name:     name,
+			Mode:     0600,
+			Size:     int64(len(f.Data)),
+			ModTime:  now,
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.Data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
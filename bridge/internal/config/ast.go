@@ -0,0 +1,544 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// LineKind classifies a line of a WireGuard configuration
+type LineKind int
+
+const (
+	// Blank is an empty or whitespace-only line
+	Blank LineKind = iota
+	// Comment is a line starting with # or ;
+	Comment
+	// Header is a section header such as [Peer]
+	Header
+	// Entry is a Key = Value line
+	Entry
+	// Invalid is a line ParseAll could not read; Parse rejects them
+	Invalid
+)
+
+// Line is one line of a configuration. Lines that were not edited are
+// written back exactly as they were read.
+type Line struct {
+	Kind LineKind
+	// Num is the 1-based line number in the parsed text, 0 for added lines
+	Num   int
+	Key   string
+	Value string
+	// Comment is an inline comment after the value, including the #
+	Comment string
+
+	raw   string
+	eol   string
+	dirty bool
+}
+
+// Section is an [Interface] or [Peer] section. Comment lines directly
+// above the header belong to the section, so that removing a peer also
+// removes the comments describing it.
+type Section struct {
+	Name string
+	// Disabled sections are commented out line by line, the way the bridge
+	// stores disabled peers, and are ignored by wg-quick
+	Disabled bool
+	Leading  []*Line
+	Header   *Line
+	Body     []*Line
+
+	eol string
+}
+
+// File is a lossless syntax tree of a WireGuard configuration. Bytes
+// reproduces the parsed text byte for byte until nodes are edited.
+type File struct {
+	// Preamble holds the lines before the first section
+	Preamble []*Line
+	Sections []*Section
+
+	eol string
+}
+
+// Parse parses the text of a configuration into a File. Only syntax is
+// checked; Summary and the validator check the contents.
+func Parse(text string) (*File, error) {
+	f, errs := parse(text)
+	if len(errs) > 0 {
+		return nil, errs[0].err
+	}
+	return f, nil
+}
+
+// ParseAll parses like Parse but reads past syntax errors, for editors
+// that show every problem at once. Lines it cannot read are kept as
+// Invalid, and so are the lines of an unknown section; each syntax error
+// yields one diagnostic.
+func ParseAll(text string) (*File, []Diagnostic) {
+	f, errs := parse(text)
+	diags := make([]Diagnostic, 0, len(errs))
+	for _, e := range errs {
+		diags = append(diags, e.diag)
+	}
+	return f, diags
+}
+
+// syntaxError pairs the error Parse returns with the diagnostic ParseAll
+// reports for the same line.
+type syntaxError struct {
+	err  error
+	diag Diagnostic
+}
+
+func parse(text string) (*File, []syntaxError) {
+	f := &File{eol: "\n"}
+	var errs []syntaxError
+	fail := func(s *Section, l *Line, rule, fix, msg string, err error) {
+		l.Kind = Invalid
+		d := At(s, l, 0, 0)
+		d.Col, d.EndCol = l.Range()
+		d.Severity, d.Rule, d.Message, d.Fix = SeverityError, rule, msg, fix
+		errs = append(errs, syntaxError{err: err, diag: d})
+	}
+	lines := splitLines(text)
+	if len(lines) > 0 && lines[0].eol == "\r\n" {
+		f.eol = "\r\n"
+	}
+	var curr *Section
+	// skip is set inside an unknown section, whose lines are kept as
+	// Invalid without reporting each of them
+	skip := false
+	for i := 0; i < len(lines); i++ {
+		l := lines[i]
+		t := strings.TrimSpace(l.raw)
+		switch {
+		case t == "":
+			l.Kind = Blank
+		case isComment(t):
+			l.Kind = Comment
+			if curr != nil && curr.Disabled {
+				u := uncomment(t)
+				if key, val, ok := splitEntry(u); ok && key != "" {
+					l.Kind, l.Key, l.Value = Entry, key, val
+					if i := strings.IndexByte(u, '#'); i >= 0 {
+						l.Comment = strings.TrimSpace(u[i:])
+					}
+				}
+			}
+			if uncomment(t) == "[Peer]" && disabledSection(lines[i+1:]) {
+				l.Kind = Header
+				curr, skip = f.startSection("Peer", l, true), false
+				continue
+			}
+		case strings.HasPrefix(t, "[") && strings.HasSuffix(t, "]"):
+			name := strings.TrimSpace(t[1 : len(t)-1])
+			if name != "Interface" && name != "Peer" {
+				fail(curr, l, "unknown-section", "use [Interface] or [Peer]",
+					fmt.Sprintf("unknown section %q", name),
+					fmt.Errorf("unknown section %q at line %d", name, l.Num))
+				skip = true
+				break
+			}
+			l.Kind = Header
+			curr, skip = f.startSection(name, l, false), false
+			continue
+		case skip:
+			l.Kind = Invalid
+		case curr == nil:
+			fail(nil, l, "outside-section", "move the line into an [Interface] or [Peer] section",
+				"key-value outside of section",
+				fmt.Errorf("key-value outside of section at line %d", l.Num))
+		default:
+			key, val, ok := splitEntry(t)
+			if !ok {
+				fail(curr, l, "invalid-line", "write the line as Key = Value",
+					"expected Key = Value",
+					fmt.Errorf("invalid line %d: %s", l.Num, t))
+				break
+			}
+			if key == "" {
+				fail(curr, l, "empty-key", "add the key name before the =",
+					"empty key",
+					fmt.Errorf("empty key at line %d", l.Num))
+				break
+			}
+			l.Kind, l.Key, l.Value = Entry, key, val
+			if i := strings.IndexByte(l.raw, '#'); i >= 0 {
+				l.Comment = strings.TrimSpace(l.raw[i:])
+			}
+		}
+		if curr == nil {
+			f.Preamble = append(f.Preamble, l)
+		} else {
+			curr.Body = append(curr.Body, l)
+		}
+	}
+	return f, errs
+}
+
+func splitLines(text string) []*Line {
+	var out []*Line
+	for n := 1; text != ""; n++ {
+		l := &Line{Num: n}
+		if i := strings.IndexByte(text, '\n'); i >= 0 {
+			l.raw, l.eol, text = text[:i], "\n", text[i+1:]
+		} else {
+			l.raw, text = text, ""
+		}
+		if strings.HasSuffix(l.raw, "\r") && l.eol != "" {
+			l.raw, l.eol = l.raw[:len(l.raw)-1], "\r\n"
+		}
+		out = append(out, l)
+	}
+	return out
+}
+
+func isComment(t string) bool {
+	return strings.HasPrefix(t, "#") || strings.HasPrefix(t, ";")
+}
+
+func uncomment(t string) string {
+	return strings.TrimSpace(strings.TrimLeft(t, "#;"))
+}
+
+// splitEntry splits "Key = Value # comment" the way wg-quick does, dropping
+// everything after the first #.
+func splitEntry(t string) (string, string, bool) {
+	if i := strings.IndexByte(t, '#'); i >= 0 {
+		t = t[:i]
+	}
+	key, val, ok := strings.Cut(t, "=")
+	return strings.TrimSpace(key), strings.TrimSpace(val), ok
+}
+
+// disabledSection reports whether the lines after a commented-out [Peer]
+// header, up to the next header, are all comments or blank. Otherwise the
+// header is an ordinary comment.
+func disabledSection(rest []*Line) bool {
+	for _, l := range rest {
+		t := strings.TrimSpace(l.raw)
+		if strings.HasPrefix(t, "[") || isComment(t) && uncomment(t) == "[Peer]" {
+			return true
+		}
+		if t != "" && !isComment(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// startSection begins a section, taking over the comment lines directly
+// above its header.
+func (f *File) startSection(name string, header *Line, disabled bool) *Section {
+	s := &Section{Name: name, Disabled: disabled, Header: header, eol: f.eol}
+	prev := &f.Preamble
+	if n := len(f.Sections); n > 0 {
+		prev = &f.Sections[n-1].Body
+	}
+	i := len(*prev)
+	for i > 0 && (*prev)[i-1].Kind == Comment {
+		i--
+	}
+	s.Leading = append([]*Line{}, (*prev)[i:]...)
+	*prev = (*prev)[:i]
+	f.Sections = append(f.Sections, s)
+	return s
+}
+
+// Bytes renders the configuration.
+func (f *File) Bytes() []byte {
+	var b strings.Builder
+	for _, l := range f.Preamble {
+		l.write(&b, false)
+	}
+	for _, s := range f.Sections {
+		for _, l := range s.Leading {
+			l.write(&b, false)
+		}
+		s.Header.write(&b, s.Disabled)
+		for _, l := range s.Body {
+			l.write(&b, s.Disabled)
+		}
+	}
+	return []byte(b.String())
+}
+
+func (f *File) String() string {
+	return string(f.Bytes())
+}
+
+func (l *Line) write(b *strings.Builder, disabled bool) {
+	if l.dirty {
+		prefix := ""
+		if disabled {
+			prefix = "# "
+		}
+		switch l.Kind {
+		case Header:
+			l.raw = prefix + "[" + l.Key + "]"
+		case Entry:
+			l.raw = prefix + l.Key + " = " + l.Value
+			if l.Comment != "" {
+				l.raw += " " + l.Comment
+			}
+		}
+		l.dirty = false
+	}
+	b.WriteString(l.raw)
+	b.WriteString(l.eol)
+}
+
+// Interface returns the first enabled [Interface] section or nil.
+func (f *File) Interface() *Section {
+	for _, s := range f.Sections {
+		if s.Name == "Interface" && !s.Disabled {
+			return s
+		}
+	}
+	return nil
+}
+
+// Peers returns every [Peer] section, including disabled ones.
+func (f *File) Peers() []*Section {
+	var out []*Section
+	for _, s := range f.Sections {
+		if s.Name == "Peer" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Peer returns the [Peer] section with the given public key or nil.
+func (f *File) Peer(publicKey string) *Section {
+	for _, s := range f.Peers() {
+		if v, ok := s.Get("PublicKey"); ok && v == publicKey {
+			return s
+		}
+	}
+	return nil
+}
+
+// AddSection appends an empty section, separated from the previous one by
+// a blank line.
+func (f *File) AddSection(name string) *Section {
+	s := &Section{Name: name, Header: &Line{Kind: Header, Key: name, eol: f.eol, dirty: true}, eol: f.eol}
+	f.AppendSection(s)
+	return s
+}
+
+// AppendSection appends s, which may come from another File, separated
+// from the previous section by a blank line.
+func (f *File) AppendSection(s *Section) {
+	last := f.Preamble
+	if n := len(f.Sections); n > 0 {
+		s := f.Sections[n-1]
+		last = append(append(append([]*Line{}, s.Leading...), s.Header), s.Body...)
+	}
+	if n := len(last); n > 0 {
+		if last[n-1].eol == "" {
+			last[n-1].eol = f.eol
+		}
+		if last[n-1].Kind != Blank {
+			blank := &Line{Kind: Blank, eol: f.eol}
+			if k := len(f.Sections); k > 0 {
+				f.Sections[k-1].Body = append(f.Sections[k-1].Body, blank)
+			} else {
+				f.Preamble = append(f.Preamble, blank)
+			}
+		}
+	}
+	f.Sections = append(f.Sections, s)
+}
+
+// RemoveSection removes s together with its leading comments.
+func (f *File) RemoveSection(s *Section) bool {
+	for i, cur := range f.Sections {
+		if cur == s {
+			f.Sections = append(f.Sections[:i], f.Sections[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Values returns every value of key in order. Keys are matched
+// case-insensitively, as wg-quick does.
+func (s *Section) Values(key string) []string {
+	var out []string
+	for _, l := range s.Body {
+		if l.Kind == Entry && strings.EqualFold(l.Key, key) {
+			out = append(out, l.Value)
+		}
+	}
+	return out
+}
+
+// Get returns the value of key. The values of a repeatable key are joined;
+// otherwise the last value wins, as in wg-quick.
+func (s *Section) Get(key string) (string, bool) {
+	values := s.Values(key)
+	if len(values) == 0 {
+		return "", false
+	}
+	if spec, ok := LookupKey(s.Name, key); ok && spec.Repeatable {
+		return spec.join(values), true
+	}
+	return values[len(values)-1], true
+}
+
+// Set replaces the value of key, keeping its inline comment, or inserts
+// key after the last entry of the section. Further lines of a repeated key
+// are removed.
+func (s *Section) Set(key, value string) {
+	last := -1
+	var found *Line
+	body := s.Body[:0]
+	for _, l := range s.Body {
+		if l.Kind == Entry && strings.EqualFold(l.Key, key) {
+			if found != nil {
+				continue
+			}
+			found = l
+		}
+		body = append(body, l)
+		if l.Kind == Entry {
+			last = len(body) - 1
+		}
+	}
+	s.Body = body
+	if found != nil {
+		if found.Value != value {
+			found.Value, found.dirty = value, true
+		}
+		return
+	}
+	prev := s.Header
+	if last >= 0 {
+		prev = s.Body[last]
+	}
+	if prev.eol == "" {
+		prev.eol = s.eol
+	}
+	l := &Line{Kind: Entry, Key: key, Value: value, eol: s.eol, dirty: true}
+	s.Body = append(s.Body[:last+1], append([]*Line{l}, s.Body[last+1:]...)...)
+}
+
+// Delete removes every entry of key and reports whether there was one.
+func (s *Section) Delete(key string) bool {
+	out := s.Body[:0]
+	found := false
+	for _, l := range s.Body {
+		if l.Kind == Entry && strings.EqualFold(l.Key, key) {
+			found = true
+			continue
+		}
+		out = append(out, l)
+	}
+	s.Body = out
+	return found
+}
+
+// SetDisabled comments out or restores the header and entries of s.
+// Comments are left as they are.
+func (s *Section) SetDisabled(disabled bool) {
+	if s.Disabled == disabled {
+		return
+	}
+	s.Disabled = disabled
+	s.Header.Key, s.Header.dirty = s.Name, true
+	for _, l := range s.Body {
+		if l.Kind == Entry {
+			l.dirty = true
+		}
+	}
+}
+
+// Map returns the entries of s under their canonical names. The values of
+// repeatable keys are joined; otherwise the last value wins.
+func (s *Section) Map() map[string]string {
+	m, _ := s.entries()
+	return m
+}
+
+// entries is Map plus warnings about unknown, repeated and extension keys.
+func (s *Section) entries() (map[string]string, []Diagnostic) {
+	m := make(map[string]string)
+	var warnings []Diagnostic
+	warn := func(l *Line, rule, fix, format string, args ...interface{}) {
+		d := At(s, l, 0, 0)
+		d.Col, d.EndCol = l.KeyRange()
+		d.Severity, d.Rule, d.Message, d.Fix = SeverityWarning, rule, fmt.Sprintf(format, args...), fix
+		warnings = append(warnings, d)
+	}
+	values := map[string][]string{}
+	first := map[string]int{}
+	for _, l := range s.Body {
+		if l.Kind != Entry {
+			continue
+		}
+		spec, known := LookupKey(s.Name, l.Key)
+		name := l.Key
+		switch {
+		case !known:
+			warn(l, "unknown-key", "check the spelling or remove the line", "unknown key %q in [%s]", l.Key, s.Name)
+		case spec.Extension:
+			name = spec.Name
+			warn(l, "unsupported-key", "use "+strings.TrimSuffix(spec.Name, "File")+" if wg-quick reads this config", "%s is not supported by wg-quick", spec.Name)
+		default:
+			name = spec.Name
+		}
+		if n, seen := first[name]; seen && known && !spec.Repeatable {
+			warn(l, "repeated-key", fmt.Sprintf("remove line %d", n), "%s repeats line %d, the last value is used", name, n)
+		}
+		if _, seen := first[name]; !seen {
+			first[name] = l.Num
+		}
+		values[name] = append(values[name], l.Value)
+		if known && spec.Repeatable {
+			m[name] = spec.join(values[name])
+		} else {
+			m[name] = l.Value
+		}
+	}
+	return m, warnings
+}
+
+// Warnings returns the warnings about the keys of the enabled sections of
+// f: unknown keys, single-value keys given twice and keys wg-quick does
+// not support.
+func (f *File) Warnings() []Diagnostic {
+	var out []Diagnostic
+	for _, s := range f.Sections {
+		if !s.Disabled {
+			_, warnings := s.entries()
+			out = append(out, warnings...)
+		}
+	}
+	return out
+}
+
+// Summary flattens the enabled sections of f.
+func (f *File) Summary() *Summary {
+	summary := &Summary{Interface: make(map[string]string)}
+	for _, s := range f.Sections {
+		if s.Disabled {
+			continue
+		}
+		m, warnings := s.entries()
+		for _, w := range warnings {
+			summary.Warnings = append(summary.Warnings, w.String())
+		}
+		switch s.Name {
+		case "Interface":
+			for k, v := range m {
+				summary.Interface[k] = v
+			}
+		case "Peer":
+			summary.Peers = append(summary.Peers, m)
+		}
+	}
+	return summary
+}
@@ -0,0 +1,305 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const astConfig = `# wg0 on the office gateway
+[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+ListenPort = 51820   # fixed in the firewall
+  Address=10.192.122.1/24
+
+# laptop
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+AllowedIPs = 10.192.122.2/32
+; old endpoint: 192.0.2.1:51820
+
+# retired phone
+# [Peer]
+# PublicKey = TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=
+# AllowedIPs = 10.192.122.3/32
+`
+
+func TestFileRoundTrip(t *testing.T) {
+	inputs := map[string]string{
+		"comments":         astConfig,
+		"crlf":             strings.ReplaceAll(astConfig, "\n", "\r\n"),
+		"no final newline": strings.TrimSuffix(astConfig, "\n"),
+		"blank lines":      "\n\n[Interface]\n\n\nPrivateKey = x\n\n\n",
+		"empty":            "",
+	}
+	for _, name := range []string{"valid_basic.conf", "valid_complex.conf", "catchall_routes.conf"} {
+		b, err := os.ReadFile(filepath.Join("../../testdata", name))
+		if err != nil {
+			t.Fatalf("read %s: %v", name, err)
+		}
+		inputs[name] = string(b)
+	}
+	for name, text := range inputs {
+		t.Run(name, func(t *testing.T) {
+			f, err := Parse(text)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if got := f.String(); got != text {
+				t.Errorf("round trip changed the text:\n%q\nwant\n%q", got, text)
+			}
+		})
+	}
+}
+
+func TestFileStructure(t *testing.T) {
+	f, err := Parse(astConfig)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if len(f.Sections) != 3 || len(f.Preamble) != 0 {
+		t.Fatalf("expected 3 sections and no preamble, got %d and %d", len(f.Sections), len(f.Preamble))
+	}
+	iface := f.Interface()
+	if len(iface.Leading) != 1 || iface.Leading[0].Num != 1 {
+		t.Errorf("expected the first comment to lead [Interface]")
+	}
+	if port, _ := iface.Get("ListenPort"); port != "51820" {
+		t.Errorf("ListenPort = %q, inline comment not stripped", port)
+	}
+	if addr, _ := iface.Get("Address"); addr != "10.192.122.1/24" {
+		t.Errorf("Address = %q", addr)
+	}
+	peers := f.Peers()
+	if len(peers) != 2 || peers[0].Disabled || !peers[1].Disabled {
+		t.Fatalf("expected one enabled and one disabled peer")
+	}
+	if pk, _ := peers[1].Get("PublicKey"); pk != "TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=" {
+		t.Errorf("disabled peer PublicKey = %q", pk)
+	}
+	summary := f.Summary()
+	if len(summary.Peers) != 1 || summary.Interface["ListenPort"] != "51820" {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+}
+
+func TestFileCommentedHeaderIsNotAPeer(t *testing.T) {
+	f, err := Parse("[Interface]\nPrivateKey = x\n# [Peer]\nListenPort = 1\n")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if len(f.Peers()) != 0 {
+		t.Fatal("a commented header followed by settings must stay a comment")
+	}
+	if port, _ := f.Interface().Get("ListenPort"); port != "1" {
+		t.Errorf("ListenPort = %q", port)
+	}
+}
+
+func TestFileEdits(t *testing.T) {
+	f, err := Parse(astConfig)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	f.Interface().Set("ListenPort", "51821")
+	laptop := f.Peer("xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=")
+	laptop.Set("Endpoint", "198.51.100.7:51820")
+	laptop.SetDisabled(true)
+	phone := f.Peer("TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=")
+	phone.SetDisabled(false)
+	s := f.AddSection("Peer")
+	s.Set("PublicKey", "HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw=")
+	s.Set("AllowedIPs", "10.192.122.4/32")
+
+	want := `# wg0 on the office gateway
+[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+ListenPort = 51821 # fixed in the firewall
+  Address=10.192.122.1/24
+
+# laptop
+# [Peer]
+# PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+# AllowedIPs = 10.192.122.2/32
+# Endpoint = 198.51.100.7:51820
+; old endpoint: 192.0.2.1:51820
+
+# retired phone
+[Peer]
+PublicKey = TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=
+AllowedIPs = 10.192.122.3/32
+
+[Peer]
+PublicKey = HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw=
+AllowedIPs = 10.192.122.4/32
+`
+	if got := f.String(); got != want {
+		t.Fatalf("unexpected result:\n%s", got)
+	}
+
+	f, _ = Parse(want)
+	if !f.RemoveSection(f.Peer("TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=")) {
+		t.Fatal("RemoveSection found nothing")
+	}
+	if strings.Contains(f.String(), "retired phone") {
+		t.Error("comments above a removed peer should go with it")
+	}
+	if !f.Interface().Delete("Address") || strings.Contains(f.String(), "Address") {
+		t.Error("Delete did not remove Address")
+	}
+}
+
+func TestFileEditsWithoutFinalNewline(t *testing.T) {
+	f, err := Parse("[Interface]\r\nPrivateKey = x")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	f.Interface().Set("ListenPort", "51820")
+	f.AddSection("Peer").Set("PublicKey", "y")
+	want := "[Interface]\r\nPrivateKey = x\r\nListenPort = 51820\r\n\r\n[Peer]\r\nPublicKey = y\r\n"
+	if got := f.String(); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestFileSyntaxErrors(t *testing.T) {
+	for text, want := range map[string]string{
+		"[Interface]\n[Foo]\n":         "unknown section",
+		"PrivateKey = x\n":             "outside of section",
+		"[Interface]\nPrivateKey x\n":  "invalid line 2",
+		"[Interface]\n = x\n":          "empty key",
+		"# [Peer]\nPublicKey = x\n":    "outside of section",
+		"[Interface]\nPrivateKey = x#": "",
+	} {
+		_, err := Parse(text)
+		if want == "" && err != nil {
+			t.Errorf("%q: unexpected error %v", text, err)
+		}
+		if want != "" && (err == nil || !strings.Contains(err.Error(), want)) {
+			t.Errorf("%q: expected error containing %q, got %v", text, want, err)
+		}
+	}
+}
+
+func TestRepeatedKeys(t *testing.T) {
+	f, err := Parse(`[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+Address = 10.0.0.1/24
+address = fd00::1/64
+DNS = 10.0.0.53
+DNS = corp.example
+PostUp = iptables -A FORWARD -i %i -j ACCEPT
+PostUp = sysctl -w net.ipv4.ip_forward=1
+ListenPort = 51820
+ListenPort = 51821
+PrivateKeyFile = /etc/wireguard/wg0.key
+Frobnicate = yes
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+AllowedIPs = 10.0.0.2/32
+AllowedIPs = 10.1.0.0/16
+`)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	summary := f.Summary()
+	want := map[string]string{
+		"Address":        "10.0.0.1/24, fd00::1/64",
+		"DNS":            "10.0.0.53, corp.example",
+		"PostUp":         "iptables -A FORWARD -i %i -j ACCEPT\nsysctl -w net.ipv4.ip_forward=1",
+		"ListenPort":     "51821",
+		"PrivateKeyFile": "/etc/wireguard/wg0.key",
+		"Frobnicate":     "yes",
+	}
+	for k, v := range want {
+		if summary.Interface[k] != v {
+			t.Errorf("%s = %q, want %q", k, summary.Interface[k], v)
+		}
+	}
+	if got := summary.Peers[0]["AllowedIPs"]; got != "10.0.0.2/32, 10.1.0.0/16" {
+		t.Errorf("AllowedIPs = %q", got)
+	}
+	if got := f.Interface().Values("Address"); len(got) != 2 {
+		t.Errorf("Values(Address) = %v", got)
+	}
+	warnings := strings.Join(summary.Warnings, "\n")
+	for _, w := range []string{
+		"line 10: ListenPort repeats line 9",
+		"line 11: PrivateKeyFile is not supported by wg-quick",
+		`line 12: unknown key "Frobnicate" in [Interface]`,
+	} {
+		if !strings.Contains(warnings, w) {
+			t.Errorf("missing warning %q in:\n%s", w, warnings)
+		}
+	}
+	if len(summary.Warnings) != 3 {
+		t.Errorf("expected 3 warnings, got %v", summary.Warnings)
+	}
+
+	peer := f.Peers()[0]
+	peer.Set("AllowedIPs", "10.2.0.0/16")
+	if got := peer.Values("AllowedIPs"); len(got) != 1 || got[0] != "10.2.0.0/16" {
+		t.Errorf("Set should replace every line of a repeated key, got %v", got)
+	}
+}
+
+func TestParseAllReadsPastErrors(t *testing.T) {
+	text := "PrivateKey = x\n[Interface]\nListenPort 51820\n = 1\n[Foo]\nBar = 1\n[Peer]\nPublicKey = y\n"
+	f, diags := ParseAll(text)
+	rules := []string{}
+	for _, d := range diags {
+		rules = append(rules, fmt.Sprintf("%d:%s", d.Line, d.Rule))
+		if d.Severity != SeverityError || d.Fix == "" {
+			t.Errorf("unexpected diagnostic %+v", d)
+		}
+	}
+	if got := strings.Join(rules, ","); got != "1:outside-section,3:invalid-line,4:empty-key,5:unknown-section" {
+		t.Errorf("diagnostics = %s", got)
+	}
+	if f.String() != text {
+		t.Error("ParseAll should keep invalid lines")
+	}
+	if pk, _ := f.Peers()[0].Get("PublicKey"); pk != "y" {
+		t.Errorf("section after the errors not parsed, PublicKey = %q", pk)
+	}
+	if _, ok := f.Interface().Get("Bar"); ok {
+		t.Error("entries of an unknown section must not be read")
+	}
+}
+
+func TestLineRanges(t *testing.T) {
+	f, err := Parse("[Interface]\n  Address=10.0.0.1/24, fd00::1/64  # lan\nDNS =\n")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	addr, dns := f.Interface().Body[0], f.Interface().Body[1]
+	for name, got := range map[string][2]int{
+		"range":   pair(addr.Range()),
+		"key":     pair(addr.KeyRange()),
+		"value":   pair(addr.ValueRange()),
+		"item":    pair(addr.FindValue("fd00::1/64")),
+		"missing": pair(addr.FindValue("10.9.9.9")),
+		"empty":   pair(dns.ValueRange()),
+		"header":  pair(f.Interface().Header.Range()),
+	} {
+		want := map[string][2]int{
+			"range":   {3, 41},
+			"key":     {3, 10},
+			"value":   {11, 34},
+			"item":    {24, 34},
+			"missing": {11, 34},
+			"empty":   {6, 6},
+			"header":  {1, 12},
+		}[name]
+		if got != want {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func pair(a, b int) [2]int {
+	return [2]int{a, b}
+}
@@ -0,0 +1,134 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Severity tells errors, which make a config invalid, from warnings and
+// hints
+type Severity string
+
+const (
+	// SeverityError marks a config that must not be installed
+	SeverityError Severity = "error"
+	// SeverityWarning marks a config that works but probably not as meant
+	SeverityWarning Severity = "warning"
+	// SeverityInfo marks a suggestion
+	SeverityInfo Severity = "info"
+)
+
+// Diagnostic is one finding about a configuration, located the way an
+// editor underlines it. Lines and columns are 1-based byte offsets into
+// the parsed text and EndCol is exclusive. Findings about the file as a
+// whole point at the start of line 1.
+type Diagnostic struct {
+	Line     int      `json:"line"`
+	Col      int      `json:"col"`
+	EndLine  int      `json:"endLine"`
+	EndCol   int      `json:"endCol"`
+	Section  string   `json:"section,omitempty"`
+	Key      string   `json:"key,omitempty"`
+	Severity Severity `json:"severity"`
+	// Rule is a stable identifier such as "invalid-value" that tooling may
+	// match on; Message is meant for people
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+	// Fix suggests how to resolve the finding
+	Fix string `json:"fix,omitempty"`
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("line %d: %s", d.Line, d.Message)
+}
+
+// At returns a diagnostic located at columns start to end of l in section
+// s, which may be nil for lines outside any section.
+func At(s *Section, l *Line, start, end int) Diagnostic {
+	d := Diagnostic{Line: l.Num, Col: start, EndLine: l.Num, EndCol: end}
+	if s != nil {
+		d.Section = s.Name
+	}
+	if l.Kind == Entry {
+		d.Key = l.Key
+		if spec, ok := LookupKey(d.Section, l.Key); ok {
+			d.Key = spec.Name
+		}
+	}
+	return d
+}
+
+// AtFile returns a diagnostic about the file as a whole.
+func AtFile() Diagnostic {
+	return Diagnostic{Line: 1, Col: 1, EndLine: 1, EndCol: 1}
+}
+
+// SortDiagnostics orders diagnostics by position, keeping the order of
+// findings at the same position.
+func SortDiagnostics(diags []Diagnostic) {
+	sort.SliceStable(diags, func(i, j int) bool {
+		if diags[i].Line != diags[j].Line {
+			return diags[i].Line < diags[j].Line
+		}
+		return diags[i].Col < diags[j].Col
+	})
+}
+
+// HasErrors reports whether any diagnostic is an error.
+func HasErrors(diags []Diagnostic) bool {
+	for _, d := range diags {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// Range returns the columns of the text of l without surrounding
+// whitespace. Columns refer to the parsed text and are meaningless once
+// the line has been edited.
+func (l *Line) Range() (int, int) {
+	start := len(l.raw) - len(strings.TrimLeft(l.raw, " \t"))
+	end := len(strings.TrimRight(l.raw, " \t"))
+	if end < start {
+		end = start
+	}
+	return start + 1, end + 1
+}
+
+// KeyRange returns the columns of the key of an entry.
+func (l *Line) KeyRange() (int, int) {
+	i := strings.Index(l.raw, l.Key)
+	if l.Key == "" || i < 0 {
+		return l.Range()
+	}
+	return i + 1, i + len(l.Key) + 1
+}
+
+// ValueRange returns the columns of the value of an entry. An empty value
+// is an empty range right after the =.
+func (l *Line) ValueRange() (int, int) {
+	_, keyEnd := l.KeyRange()
+	eq := strings.IndexByte(l.raw[keyEnd-1:], '=')
+	if eq < 0 {
+		return l.Range()
+	}
+	off := keyEnd - 1 + eq + 1
+	i := strings.Index(l.raw[off:], l.Value)
+	if l.Value == "" || i < 0 {
+		return off + 1, off + 1
+	}
+	return off + i + 1, off + i + len(l.Value) + 1
+}
+
+// FindValue returns the columns of item, such as one address of a list,
+// within the value of an entry, or those of the whole value if item does
+// not occur in it.
+func (l *Line) FindValue(item string) (int, int) {
+	start, end := l.ValueRange()
+	if i := strings.Index(l.raw[start-1:end-1], item); item != "" && i >= 0 {
+		return start + i, start + i + len(item)
+	}
+	return start, end
+}
@@ -0,0 +1,98 @@
+package config
+
+import "strings"
+
+// KeyType selects how the value of a key is validated
+type KeyType int
+
+const (
+	// TypeString is free text
+	TypeString KeyType = iota
+	// TypeKey is a base64 Curve25519 key
+	TypeKey
+	// TypeKeyFile is the absolute path of a file holding a key
+	TypeKeyFile
+	// TypeAddresses is a comma-separated list of IPs or CIDRs
+	TypeAddresses
+	// TypeAllowedIPs is a comma-separated list of IPs or CIDRs routed to a peer
+	TypeAllowedIPs
+	// TypeDNS is a comma-separated list of DNS servers and search domains
+	TypeDNS
+	// TypePort is a UDP port
+	TypePort
+	// TypeMTU is an interface MTU
+	TypeMTU
+	// TypeTable is a routing table: auto, off, a number or a name
+	TypeTable
+	// TypeFwMark is a firewall mark: off or a decimal or hex number
+	TypeFwMark
+	// TypeBool is true or false
+	TypeBool
+	// TypeCommand is a shell command run by wg-quick
+	TypeCommand
+	// TypeEndpoint is host:port
+	TypeEndpoint
+	// TypeKeepalive is off or a number of seconds
+	TypeKeepalive
+)
+
+// KeySpec describes a key known to wg-quick or wg
+type KeySpec struct {
+	Name string
+	Type KeyType
+	// Repeatable keys may be given on several lines; wg-quick uses every
+	// value
+	Repeatable bool
+	// Extension keys are understood by other WireGuard tools, such as
+	// systemd-networkd, but not by wg-quick
+	Extension bool
+}
+
+var interfaceKeys = []KeySpec{
+	{Name: "PrivateKey", Type: TypeKey},
+	{Name: "PrivateKeyFile", Type: TypeKeyFile, Extension: true},
+	{Name: "ListenPort", Type: TypePort},
+	{Name: "FwMark", Type: TypeFwMark},
+	{Name: "Address", Type: TypeAddresses, Repeatable: true},
+	{Name: "DNS", Type: TypeDNS, Repeatable: true},
+	{Name: "MTU", Type: TypeMTU},
+	{Name: "Table", Type: TypeTable},
+	{Name: "PreUp", Type: TypeCommand, Repeatable: true},
+	{Name: "PostUp", Type: TypeCommand, Repeatable: true},
+	{Name: "PreDown", Type: TypeCommand, Repeatable: true},
+	{Name: "PostDown", Type: TypeCommand, Repeatable: true},
+	{Name: "SaveConfig", Type: TypeBool},
+}
+
+var peerKeys = []KeySpec{
+	{Name: "PublicKey", Type: TypeKey},
+	{Name: "PresharedKey", Type: TypeKey},
+	{Name: "PresharedKeyFile", Type: TypeKeyFile, Extension: true},
+	{Name: "AllowedIPs", Type: TypeAllowedIPs, Repeatable: true},
+	{Name: "Endpoint", Type: TypeEndpoint},
+	{Name: "PersistentKeepalive", Type: TypeKeepalive},
+}
+
+// LookupKey returns the spec of key in the given section. Like wg-quick,
+// key names are matched case-insensitively.
+func LookupKey(section, key string) (KeySpec, bool) {
+	keys := interfaceKeys
+	if section == "Peer" {
+		keys = peerKeys
+	}
+	for _, spec := range keys {
+		if strings.EqualFold(spec.Name, key) {
+			return spec, true
+		}
+	}
+	return KeySpec{}, false
+}
+
+// join combines the values of a repeated key the way wg-quick reads them:
+// hook commands run one after another, lists add up.
+func (spec KeySpec) join(values []string) string {
+	if spec.Type == TypeCommand {
+		return strings.Join(values, "\n")
+	}
+	return strings.Join(values, ", ")
+}
@@ -1,16 +1,21 @@
 package config
 
 import (
-	"bufio"
 	"fmt"
 	"net"
+	"sort"
 	"strings"
 )
 
-// Summary represents a parsed WireGuard configuration
+// Summary represents a parsed WireGuard configuration. Known keys appear
+// under their canonical names; the values of repeated keys such as Address
+// or AllowedIPs are joined.
 type Summary struct {
 	Interface map[string]string   `json:"interface"`
 	Peers     []map[string]string `json:"peers"`
+	// Warnings lists unknown keys, repeated single-value keys and keys
+	// wg-quick does not support
+	Warnings []string `json:"warnings,omitempty"`
 }
 
 // Parser handles WireGuard configuration parsing
@@ -26,59 +31,11 @@ func NewParser(strict bool) *Parser {
 
 // Parse parses a WireGuard configuration from text
 func (p *Parser) Parse(text string) (*Summary, error) {
-	summary := &Summary{Interface: make(map[string]string)}
-	var curr map[string]string
-	scanner := bufio.NewScanner(strings.NewReader(text))
-	line := 0
-
-	for scanner.Scan() {
-		line++
-		l := strings.TrimSpace(scanner.Text())
-
-		// Skip empty lines and comments
-		if l == "" || strings.HasPrefix(l, "#") || strings.HasPrefix(l, ";") {
-			continue
-		}
-
-		// Handle section headers
-		if strings.HasPrefix(l, "[") && strings.HasSuffix(l, "]") {
-			sect := strings.TrimSpace(l[1 : len(l)-1])
-			switch sect {
-			case "Interface":
-				curr = summary.Interface
-			case "Peer":
-				m := make(map[string]string)
-				summary.Peers = append(summary.Peers, m)
-				curr = m
-			default:
-				return nil, fmt.Errorf("unknown section %q at line %d", sect, line)
-			}
-			continue
-		}
-
-		// Handle key-value pairs
-		if curr == nil {
-			return nil, fmt.Errorf("key-value outside of section at line %d", line)
-		}
-
-		parts := strings.SplitN(l, "=", 2)
-		if len(parts) != 2 {
-			return nil, fmt.Errorf("invalid line %d: %s", line, l)
-		}
-
-		key := strings.TrimSpace(parts[0])
-		val := strings.TrimSpace(parts[1])
-
-		if key == "" {
-			return nil, fmt.Errorf("empty key at line %d", line)
-		}
-
-		curr[key] = val
-	}
-
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("scanner error: %w", err)
+	f, err := Parse(text)
+	if err != nil {
+		return nil, err
 	}
+	summary := f.Summary()
 
 	// Basic validation
 	if len(summary.Interface) == 0 {
@@ -92,39 +49,70 @@ func (p *Parser) Parse(text string) (*Summary, error) {
 	return summary, nil
 }
 
-// ValidateIPs validates AllowedIPs format and constraints
+// Text renders s as a config, keys in sorted order. Hook commands joined
+// by Summary get a line each again; an empty Interface is left out.
+func (s *Summary) Text() string {
+	var b strings.Builder
+	section := func(name string, m map[string]string) {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(&b, "[%s]\n", name)
+		for _, k := range keys {
+			values := []string{m[k]}
+			if spec, ok := LookupKey(name, k); ok && spec.Type == TypeCommand {
+				values = strings.Split(m[k], "\n")
+			}
+			for _, v := range values {
+				fmt.Fprintf(&b, "%s = %s\n", k, v)
+			}
+		}
+		b.WriteString("\n")
+	}
+	if len(s.Interface) > 0 {
+		section("Interface", s.Interface)
+	}
+	for _, p := range s.Peers {
+		section("Peer", p)
+	}
+	return b.String()
+}
+
+// ValidateIPs validates AllowedIPs format and constraints. Routes are read
+// with ParseRoute, as the validator reads them; strictMode rejects
+// catch-all routes.
 func ValidateIPs(allowedIPs string, strictMode bool) error {
 	if allowedIPs == "" {
 		return fmt.Errorf("empty AllowedIPs")
 	}
 
-	ips := strings.Split(allowedIPs, ",")
-	for _, ip := range ips {
+	for _, ip := range strings.Split(allowedIPs, ",") {
 		ip = strings.TrimSpace(ip)
 		if ip == "" {
 			continue
 		}
-
-		// Check for disallowed catch-all routes
-		if strictMode && (ip == "0.0.0.0/0" || ip == "::/0") {
-			return fmt.Errorf("disallowed AllowedIPs %s", ip)
+		network, ok := ParseRoute(ip)
+		if !ok {
+			return fmt.Errorf("invalid AllowedIPs %s", ip)
 		}
-
-		// Try CIDR first, then single IP
-		if _, _, err := net.ParseCIDR(ip); err != nil {
-			if net.ParseIP(ip) == nil {
-				return fmt.Errorf("invalid AllowedIPs %s", ip)
-			}
+		if ones, _ := network.Mask.Size(); strictMode && ones == 0 {
+			return fmt.Errorf("disallowed AllowedIPs %s", ip)
 		}
 	}
 
 	return nil
 }
 
-// DetectIPConflicts checks for overlapping CIDR ranges
+// DetectIPConflicts checks for AllowedIPs claimed by more than one route,
+// with the overlap rule the validator reports as overlapping-allowed-ips.
 func DetectIPConflicts(peers []map[string]string) error {
-	var ranges []*net.IPNet
-	var ips []net.IP
+	type claim struct {
+		network *net.IPNet
+		text    string
+	}
+	var claimed []claim
 
 	for peerIdx, peer := range peers {
 		pk, ok := peer["PublicKey"]
@@ -137,43 +125,45 @@ func DetectIPConflicts(peers []map[string]string) error {
 			return fmt.Errorf("peer %s missing AllowedIPs", pk)
 		}
 
-		ipList := strings.Split(allowed, ",")
-		for _, ip := range ipList {
+		for _, ip := range strings.Split(allowed, ",") {
 			ip = strings.TrimSpace(ip)
-			if ip == "" {
+			network, ok := ParseRoute(ip)
+			if !ok {
 				continue
 			}
-
-			// Parse CIDR
-			if _, network, err := net.ParseCIDR(ip); err == nil {
-				// Check for conflicts with existing ranges
-				for _, existing := range ranges {
-					if networksOverlap(network, existing) {
-						return fmt.Errorf("overlapping AllowedIPs: %s conflicts with existing range", ip)
-					}
-				}
-				ranges = append(ranges, network)
-			} else if parsedIP := net.ParseIP(ip); parsedIP != nil {
-				// Check single IP against ranges and other IPs
-				for _, existing := range ranges {
-					if existing.Contains(parsedIP) {
-						return fmt.Errorf("IP %s conflicts with existing range %s", ip, existing.String())
-					}
+			for _, c := range claimed {
+				if c.network.String() == network.String() {
+					return fmt.Errorf("duplicate AllowedIPs %s", ip)
 				}
-				for _, existingIP := range ips {
-					if parsedIP.Equal(existingIP) {
-						return fmt.Errorf("duplicate IP %s", ip)
-					}
+				if RoutesOverlap(network, c.network) {
+					return fmt.Errorf("AllowedIPs %s conflicts with %s", ip, c.text)
 				}
-				ips = append(ips, parsedIP)
 			}
+			claimed = append(claimed, claim{network: network, text: ip})
 		}
 	}
 
 	return nil
 }
 
-// networksOverlap checks if two CIDR networks overlap
-func networksOverlap(a, b *net.IPNet) bool {
+// ParseRoute parses an address with a prefix length, or a plain address
+// as a single-host route.
+func ParseRoute(s string) (*net.IPNet, bool) {
+	if _, network, err := net.ParseCIDR(s); err == nil {
+		return network, true
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, false
+	}
+	bits := 8 * len(ip)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, true
+}
+
+// RoutesOverlap checks if two routes share addresses
+func RoutesOverlap(a, b *net.IPNet) bool {
 	return a.Contains(b.IP) || b.Contains(a.IP)
 }
@@ -1,8 +1,10 @@
 package validator
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -12,10 +14,10 @@ import (
 
 var (
 	// Common validation patterns
-	ifaceNameRx    = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,16}$`)
-	publicKeyRx    = regexp.MustCompile(`^[A-Za-z0-9+/]{43}=$`)
-	privateKeyRx   = regexp.MustCompile(`^[A-Za-z0-9+/]{43}=$`)
-	presharedKeyRx = regexp.MustCompile(`^[A-Za-z0-9+/]{43}=$`)
+	ifaceNameRx = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,16}$`)
+	publicKeyRx = regexp.MustCompile(`^[A-Za-z0-9+/]{43}=$`)
+	domainRx    = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?\.)*[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?\.?$`)
+	tableNameRx = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
 )
 
 // ConfigValidator validates WireGuard configurations
@@ -23,7 +25,9 @@ type ConfigValidator struct {
 	strictMode    bool
 	maxPeers      int
 	allowCatchAll bool
+	routeLimits   RouteLimits
 	requiredKeys  map[string][]string // section -> required keys
+	publicKey     string              // interface public key peers have on file
 }
 
 // NewValidator creates a new configuration validator
@@ -39,142 +43,72 @@ func NewValidator(strict bool) *ConfigValidator {
 	}
 }
 
-// ValidateConfig performs comprehensive validation of a WireGuard config
-func (v *ConfigValidator) ValidateConfig(summary *config.Summary) error {
-	if err := v.validateInterface(summary.Interface); err != nil {
-		return fmt.Errorf("interface validation failed: %w", err)
-	}
-
-	if err := v.validatePeers(summary.Peers); err != nil {
-		return fmt.Errorf("peer validation failed: %w", err)
-	}
-
-	if err := config.DetectIPConflicts(summary.Peers); err != nil {
-		return fmt.Errorf("IP conflict detected: %w", err)
-	}
+// ExpectPublicKey makes ValidateConfig and Diagnose require the interface
+// PrivateKey to match pub, the public key peers have on file for the
+// interface
+func (v *ConfigValidator) ExpectPublicKey(pub string) {
+	v.publicKey = pub
+}
 
-	return nil
+// ValidateConfig reports the first error Diagnose finds in summary
+func (v *ConfigValidator) ValidateConfig(summary *config.Summary) error {
+	_, diags := v.Diagnose(summary.Text())
+	return firstError(diags, func(config.Diagnostic) bool { return true })
 }
 
-// validateInterface validates the [Interface] section
+// validateInterface checks an [Interface] section on its own
 func (v *ConfigValidator) validateInterface(iface map[string]string) error {
-	// Check required keys
-	for _, key := range v.requiredKeys["Interface"] {
-		if _, ok := iface[key]; !ok {
-			return fmt.Errorf("missing required key: %s", key)
-		}
-	}
-
-	// Validate PrivateKey
-	if privateKey, ok := iface["PrivateKey"]; ok {
-		if !privateKeyRx.MatchString(privateKey) {
-			return fmt.Errorf("invalid PrivateKey format")
-		}
-	}
-
-	// Validate Address
-	if address, ok := iface["Address"]; ok {
-		if err := v.validateAddresses(address); err != nil {
-			return fmt.Errorf("invalid Address: %w", err)
-		}
-	}
-
-	// Validate ListenPort
-	if port, ok := iface["ListenPort"]; ok {
-		if err := v.validatePort(port); err != nil {
-			return fmt.Errorf("invalid ListenPort: %w", err)
-		}
-	}
-
-	// Validate DNS
-	if dns, ok := iface["DNS"]; ok {
-		if err := v.validateDNS(dns); err != nil {
-			return fmt.Errorf("invalid DNS: %w", err)
-		}
-	}
+	_, diags := v.Diagnose((&config.Summary{Interface: iface}).Text())
+	return firstError(diags, func(d config.Diagnostic) bool {
+		return d.Section == "Interface" && d.Rule != "no-peers"
+	})
+}
 
-	// Validate MTU
-	if mtu, ok := iface["MTU"]; ok {
-		if err := v.validateMTU(mtu); err != nil {
-			return fmt.Errorf("invalid MTU: %w", err)
-		}
+// validatePeer checks a single peer configuration
+func (v *ConfigValidator) validatePeer(peer map[string]string, index int) error {
+	_, diags := v.Diagnose((&config.Summary{Peers: []map[string]string{peer}}).Text())
+	if err := firstError(diags, func(d config.Diagnostic) bool { return d.Section == "Peer" }); err != nil {
+		return fmt.Errorf("peer %d: %w", index, err)
 	}
-
 	return nil
 }
 
-// validatePeers validates all peer configurations
-func (v *ConfigValidator) validatePeers(peers []map[string]string) error {
-	if v.strictMode && len(peers) == 0 {
-		return fmt.Errorf("no peers defined")
-	}
-
-	if len(peers) > v.maxPeers {
-		return fmt.Errorf("too many peers: %d (max %d)", len(peers), v.maxPeers)
-	}
-
-	seen := make(map[string]struct{})
-
-	for i, peer := range peers {
-		if err := v.validatePeer(peer, i); err != nil {
-			return err
+// firstError returns the first error among the diagnostics keep accepts
+func firstError(diags []config.Diagnostic, keep func(config.Diagnostic) bool) error {
+	for _, d := range diags {
+		if d.Severity == config.SeverityError && keep(d) {
+			return errors.New(d.Message)
 		}
-
-		// Check for duplicate public keys
-		pk := peer["PublicKey"]
-		if _, dup := seen[pk]; dup {
-			return fmt.Errorf("duplicate peer PublicKey: %s", pk)
-		}
-		seen[pk] = struct{}{}
 	}
-
 	return nil
 }
 
-// validatePeer validates a single peer configuration
-func (v *ConfigValidator) validatePeer(peer map[string]string, index int) error {
-	// Check required keys
-	for _, key := range v.requiredKeys["Peer"] {
-		if _, ok := peer[key]; !ok {
-			return fmt.Errorf("peer %d missing required key: %s", index, key)
-		}
-	}
-
-	// Validate PublicKey
-	if publicKey, ok := peer["PublicKey"]; ok {
-		if !publicKeyRx.MatchString(publicKey) {
-			return fmt.Errorf("peer %d: invalid PublicKey format", index)
-		}
-	}
-
-	// Validate PresharedKey
-	if presharedKey, ok := peer["PresharedKey"]; ok && presharedKey != "" {
-		if !presharedKeyRx.MatchString(presharedKey) {
-			return fmt.Errorf("peer %d: invalid PresharedKey format", index)
-		}
-	}
-
-	// Validate AllowedIPs
-	if allowedIPs, ok := peer["AllowedIPs"]; ok {
-		if err := config.ValidateIPs(allowedIPs, v.strictMode); err != nil {
-			return fmt.Errorf("peer %d: %w", index, err)
-		}
-	}
-
-	// Validate Endpoint
-	if endpoint, ok := peer["Endpoint"]; ok && endpoint != "" {
-		if err := v.validateEndpoint(endpoint); err != nil {
-			return fmt.Errorf("peer %d: invalid Endpoint: %w", index, err)
-		}
+// validateValue validates a value of the given type
+func (v *ConfigValidator) validateValue(typ config.KeyType, value string) error {
+	switch typ {
+	case config.TypeKeyFile:
+		return v.validateKeyFile(value)
+	case config.TypeAddresses:
+		return v.validateAddresses(value)
+	case config.TypeDNS:
+		return v.validateDNS(value)
+	case config.TypePort:
+		return v.validatePort(value)
+	case config.TypeMTU:
+		return v.validateMTU(value)
+	case config.TypeTable:
+		return v.validateTable(value)
+	case config.TypeFwMark:
+		return v.validateFwMark(value)
+	case config.TypeBool:
+		return v.validateBool(value)
+	case config.TypeCommand:
+		return v.validateCommands(value)
+	case config.TypeEndpoint:
+		return v.validateEndpoint(value)
+	case config.TypeKeepalive:
+		return v.validateKeepalive(value)
 	}
-
-	// Validate PersistentKeepalive
-	if keepalive, ok := peer["PersistentKeepalive"]; ok && keepalive != "" {
-		if err := v.validateKeepalive(keepalive); err != nil {
-			return fmt.Errorf("peer %d: invalid PersistentKeepalive: %w", index, err)
-		}
-	}
-
 	return nil
 }
 
@@ -217,7 +151,8 @@ func (v *ConfigValidator) validatePort(port string) error {
 	return nil
 }
 
-// validateDNS validates DNS server addresses
+// validateDNS validates DNS servers; other entries are search domains, as
+// in wg-quick
 func (v *ConfigValidator) validateDNS(dns string) error {
 	servers := strings.Split(dns, ",")
 	for _, server := range servers {
@@ -225,8 +160,60 @@ func (v *ConfigValidator) validateDNS(dns string) error {
 		if server == "" {
 			continue
 		}
-		if net.ParseIP(server) == nil {
-			return fmt.Errorf("invalid DNS server: %s", server)
+		if net.ParseIP(server) == nil && !domainRx.MatchString(server) {
+			return fmt.Errorf("invalid DNS server or search domain: %s", server)
+		}
+	}
+	return nil
+}
+
+// validateKeyFile validates the path of a PrivateKeyFile or PresharedKeyFile
+func (v *ConfigValidator) validateKeyFile(path string) error {
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+		return fmt.Errorf("key file must be a clean absolute path: %s", path)
+	}
+	return nil
+}
+
+// validateTable validates a routing table: auto, off, a number or a name
+// from /etc/iproute2/rt_tables
+func (v *ConfigValidator) validateTable(table string) error {
+	if table == "auto" || table == "off" {
+		return nil
+	}
+	if _, err := strconv.ParseUint(table, 10, 32); err == nil {
+		return nil
+	}
+	if !tableNameRx.MatchString(table) {
+		return fmt.Errorf("invalid table: %s", table)
+	}
+	return nil
+}
+
+// validateFwMark validates a firewall mark: off or a 32-bit number
+func (v *ConfigValidator) validateFwMark(mark string) error {
+	if mark == "off" {
+		return nil
+	}
+	if _, err := strconv.ParseUint(mark, 0, 32); err != nil {
+		return fmt.Errorf("invalid fwmark: %s", mark)
+	}
+	return nil
+}
+
+// validateBool validates SaveConfig-style flags
+func (v *ConfigValidator) validateBool(b string) error {
+	if !strings.EqualFold(b, "true") && !strings.EqualFold(b, "false") {
+		return fmt.Errorf("expected true or false: %s", b)
+	}
+	return nil
+}
+
+// validateCommands validates hook commands, one per line
+func (v *ConfigValidator) validateCommands(commands string) error {
+	for _, cmd := range strings.Split(commands, "\n") {
+		if strings.TrimSpace(cmd) == "" {
+			return fmt.Errorf("empty command")
 		}
 	}
 	return nil
@@ -275,6 +262,9 @@ func (v *ConfigValidator) validateEndpoint(endpoint string) error {
 
 // validateKeepalive validates PersistentKeepalive values
 func (v *ConfigValidator) validateKeepalive(keepalive string) error {
+	if keepalive == "off" {
+		return nil
+	}
 	k, err := strconv.Atoi(keepalive)
 	if err != nil {
 		return fmt.Errorf("invalid keepalive: %s", keepalive)
@@ -481,6 +481,76 @@ func TestValidateConfigStrictMode(t *testing.T) {
 	}
 }
 
+func TestValidateKeyTypes(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		valid bool
+	}{
+		{"Table", "auto", true},
+		{"Table", "off", true},
+		{"Table", "1234", true},
+		{"Table", "vpn", true},
+		{"Table", "1 2", false},
+		{"FwMark", "0xca6c", true},
+		{"FwMark", "51820", true},
+		{"FwMark", "off", true},
+		{"FwMark", "-1", false},
+		{"SaveConfig", "true", true},
+		{"SaveConfig", "yes", false},
+		{"PostUp", "iptables -A FORWARD -i %i -j ACCEPT", true},
+		{"PreDown", "", false},
+		{"DNS", "10.0.0.53, corp.example", true},
+		{"DNS", "not a domain!", false},
+		{"MTU", "1420", true},
+		{"MTU", "100", false},
+		{"PrivateKeyFile", "/etc/wireguard/wg0.key", true},
+		{"PrivateKeyFile", "wg0.key", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key+"="+tt.value, func(t *testing.T) {
+			iface := map[string]string{tt.key: tt.value}
+			if tt.key != "PrivateKeyFile" {
+				iface["PrivateKey"] = "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+			}
+			err := NewValidator(true).validateInterface(iface)
+			if tt.valid && err != nil {
+				t.Errorf("expected %s = %q to pass, got: %v", tt.key, tt.value, err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("expected %s = %q to fail", tt.key, tt.value)
+			}
+		})
+	}
+}
+
+func TestValidateKeyFileExclusive(t *testing.T) {
+	iface := map[string]string{
+		"PrivateKey":     "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=",
+		"PrivateKeyFile": "/etc/wireguard/wg0.key",
+	}
+	if err := NewValidator(true).validateInterface(iface); err == nil {
+		t.Error("Expected PrivateKey and PrivateKeyFile together to fail")
+	}
+}
+
+func TestValidateConfigRepeatedAllowedIPs(t *testing.T) {
+	summary, err := config.NewParser(false).Parse(`[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+AllowedIPs = 10.0.0.2/32
+AllowedIPs = 0.0.0.0/0`)
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if err := NewValidator(true).ValidateConfig(summary); err == nil {
+		t.Error("Expected a catch-all route on a second AllowedIPs line to fail in strict mode")
+	}
+}
+
 // Benchmark tests
 func BenchmarkValidateConfig(b *testing.B) {
 	validator := NewValidator(false)
@@ -0,0 +1,262 @@
+package validator
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"wg-bridge/internal/config"
+)
+
+// typeFixes suggests how to correct an invalid value of each key type
+var typeFixes = map[config.KeyType]string{
+	config.TypeKeyFile:   "use a clean absolute path such as /etc/wireguard/wg0.key",
+	config.TypeAddresses: "use addresses with a prefix length, such as 10.0.0.1/24",
+	config.TypeDNS:       "use IP addresses of DNS servers or search domains",
+	config.TypePort:      "use a port between 1 and 65535",
+	config.TypeMTU:       "use an MTU between 576 and 65535",
+	config.TypeTable:     "use auto, off, a table number or a name from /etc/iproute2/rt_tables",
+	config.TypeFwMark:    "use off or a 32-bit number such as 0xca6c",
+	config.TypeBool:      "use true or false",
+	config.TypeCommand:   "remove the empty hook",
+	config.TypeEndpoint:  "use host:port, or [address]:port for IPv6",
+	config.TypeKeepalive: "use off or a number of seconds, typically 25",
+}
+
+// routeFixes suggests how to bring a route within the route limits
+var routeFixes = map[string]string{
+	"catch-all-route":         "route only the networks behind this peer",
+	"route-too-wide":          "route a narrower network, or raise the prefix limit in the AllowedIPs policy",
+	"route-outside-supernets": "route a network within the supernets the AllowedIPs policy permits",
+}
+
+// Diagnose parses text and reports every problem found, where
+// ValidateConfig stops at the first one. Syntax errors, warnings about keys
+// and the checks of the validator are located at the line and columns
+// they concern. The text is valid when no diagnostic is an error. The File
+// is returned for callers that also want its Summary; after syntax errors
+// it lacks the lines that could not be read.
+func (v *ConfigValidator) Diagnose(text string) (*config.File, []config.Diagnostic) {
+	f, diags := config.ParseAll(text)
+	d := &diagnoser{v: v, diags: append(diags, f.Warnings()...)}
+	d.file(f)
+	config.SortDiagnostics(d.diags)
+	return f, d.diags
+}
+
+type diagnoser struct {
+	v     *ConfigValidator
+	diags []config.Diagnostic
+	// routes are the AllowedIPs seen so far, to find overlaps
+	routes []route
+}
+
+type route struct {
+	network *net.IPNet
+	text    string
+	line    int
+}
+
+func (d *diagnoser) report(at config.Diagnostic, rule, fix, format string, args ...interface{}) {
+	at.Severity, at.Rule, at.Fix = config.SeverityError, rule, fix
+	at.Message = fmt.Sprintf(format, args...)
+	d.diags = append(d.diags, at)
+}
+
+func onHeader(s *config.Section) config.Diagnostic {
+	start, end := s.Header.Range()
+	return config.At(s, s.Header, start, end)
+}
+
+func onKey(s *config.Section, l *config.Line) config.Diagnostic {
+	start, end := l.KeyRange()
+	return config.At(s, l, start, end)
+}
+
+func onValue(s *config.Section, l *config.Line) config.Diagnostic {
+	start, end := l.ValueRange()
+	return config.At(s, l, start, end)
+}
+
+func onItem(s *config.Section, l *config.Line, item string) config.Diagnostic {
+	start, end := l.FindValue(item)
+	return config.At(s, l, start, end)
+}
+
+// lastEntry returns the line wg-quick takes key from, the last one.
+func lastEntry(s *config.Section, key string) *config.Line {
+	var found *config.Line
+	for _, l := range s.Body {
+		if l.Kind == config.Entry && strings.EqualFold(l.Key, key) {
+			found = l
+		}
+	}
+	return found
+}
+
+// enabledPeers returns the [Peer] sections wg-quick reads.
+func enabledPeers(f *config.File) []*config.Section {
+	var out []*config.Section
+	for _, s := range f.Peers() {
+		if !s.Disabled {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func (d *diagnoser) file(f *config.File) {
+	self := ""
+	iface := f.Interface()
+	if iface == nil {
+		d.report(config.AtFile(), "missing-interface", "add an [Interface] section with a PrivateKey", "missing [Interface] section")
+	} else {
+		self = d.iface(iface)
+	}
+
+	peers := enabledPeers(f)
+	if d.v.strictMode && len(peers) == 0 {
+		at := config.AtFile()
+		if iface != nil {
+			at = onHeader(iface)
+		}
+		d.report(at, "no-peers", "add a [Peer] section", "no peers defined")
+	}
+	seen := map[string]int{}
+	for i, s := range peers {
+		if i == d.v.maxPeers {
+			d.report(onHeader(s), "too-many-peers", "move some peers to another interface", "too many peers: %d (max %d)", len(peers), d.v.maxPeers)
+		}
+		d.peer(s, self, seen)
+	}
+}
+
+// iface checks the [Interface] section and returns the public key of its
+// PrivateKey, if that is valid.
+func (d *diagnoser) iface(s *config.Section) string {
+	d.entries(s)
+	priv, file := lastEntry(s, "PrivateKey"), lastEntry(s, "PrivateKeyFile")
+	for _, key := range d.v.requiredKeys["Interface"] {
+		if lastEntry(s, key) == nil && (key != "PrivateKey" || file == nil || file.Value == "") {
+			d.report(onHeader(s), "missing-key", "add "+key+" = <key>, generated with wg genkey", "missing required key: %s", key)
+		}
+	}
+	if priv != nil && file != nil && file.Value != "" {
+		d.report(onKey(s, file), "exclusive-keys", "remove PrivateKey or PrivateKeyFile", "PrivateKey and PrivateKeyFile are mutually exclusive")
+	}
+	if priv == nil {
+		return ""
+	}
+	if d.v.publicKey != "" {
+		if err := CheckKeyPair(priv.Value, d.v.publicKey); errors.Is(err, ErrKeyMismatch) {
+			d.report(onValue(s, priv), "key-mismatch", "restore the private key of this interface, or send its new public key to the peers",
+				"invalid PrivateKey: %v", err)
+		}
+	}
+	self, _ := DerivePublicKey(priv.Value)
+	return self
+}
+
+// peer checks a [Peer] section. seen maps the public keys of the peers
+// checked so far to their lines.
+func (d *diagnoser) peer(s *config.Section, self string, seen map[string]int) {
+	d.entries(s)
+	for _, key := range d.v.requiredKeys["Peer"] {
+		if lastEntry(s, key) == nil {
+			d.report(onHeader(s), "missing-key", "add the "+key+" of the peer", "peer missing required key: %s", key)
+		}
+	}
+	if allowed := lastEntry(s, "AllowedIPs"); allowed != nil && strings.Trim(strings.Join(s.Values("AllowedIPs"), ""), ", ") == "" {
+		d.report(onValue(s, allowed), "invalid-allowed-ips", "list the addresses routed to this peer", "empty AllowedIPs")
+	}
+	if psk, file := lastEntry(s, "PresharedKey"), lastEntry(s, "PresharedKeyFile"); psk != nil && file != nil && file.Value != "" {
+		d.report(onKey(s, file), "exclusive-keys", "remove PresharedKey or PresharedKeyFile", "PresharedKey and PresharedKeyFile are mutually exclusive")
+	}
+	pub := lastEntry(s, "PublicKey")
+	if pub == nil {
+		return
+	}
+	if n, dup := seen[pub.Value]; dup {
+		d.report(onValue(s, pub), "duplicate-peer", "merge the two peers into one", "duplicate peer PublicKey, also on line %d", n)
+	} else {
+		seen[pub.Value] = pub.Num
+	}
+	if self != "" && pub.Value == self {
+		d.report(onValue(s, pub), "own-key", "use the public key of the remote peer", "PublicKey is the interface's own key")
+	}
+}
+
+// entries checks the value of every known key of s. Earlier lines of a
+// single-value key are skipped since wg-quick ignores them.
+func (d *diagnoser) entries(s *config.Section) {
+	last := map[string]*config.Line{}
+	for _, l := range s.Body {
+		if spec, ok := config.LookupKey(s.Name, l.Key); ok && l.Kind == config.Entry {
+			last[spec.Name] = l
+		}
+	}
+	for _, l := range s.Body {
+		if l.Kind != config.Entry {
+			continue
+		}
+		spec, ok := config.LookupKey(s.Name, l.Key)
+		if !ok || !spec.Repeatable && last[spec.Name] != l {
+			continue
+		}
+		switch spec.Type {
+		case config.TypeKey:
+			d.key(s, l, spec.Name)
+		case config.TypeAllowedIPs:
+			d.allowedIPs(s, l)
+		default:
+			if l.Value == "" && (spec.Type == config.TypeEndpoint || spec.Type == config.TypeKeepalive) {
+				continue
+			}
+			if err := d.v.validateValue(spec.Type, l.Value); err != nil {
+				d.report(onValue(s, l), "invalid-value", typeFixes[spec.Type], "invalid %s: %v", spec.Name, err)
+			}
+		}
+	}
+}
+
+func (d *diagnoser) key(s *config.Section, l *config.Line, name string) {
+	if name == "PresharedKey" && l.Value == "" {
+		return
+	}
+	if !publicKeyRx.MatchString(l.Value) {
+		d.report(onValue(s, l), "invalid-key", "use a base64 key of 44 characters, as printed by wg genkey", "invalid %s format", name)
+		return
+	}
+	if _, err := ParseKey(l.Value); err != nil {
+		d.report(onValue(s, l), "weak-key", "generate a new key with wg genkey", "invalid %s: %v", name, err)
+	}
+}
+
+// allowedIPs checks each route of an AllowedIPs line.
+func (d *diagnoser) allowedIPs(s *config.Section, l *config.Line) {
+	for _, item := range strings.Split(l.Value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		at := onItem(s, l, item)
+		network, ok := config.ParseRoute(item)
+		if !ok {
+			d.report(at, "invalid-allowed-ips", "use an address with a prefix length, such as 10.0.0.2/32", "invalid AllowedIPs %s", item)
+			continue
+		}
+		if rule, err := d.v.checkRoute(network, item); err != nil {
+			d.report(at, rule, routeFixes[rule], "%v", err)
+			continue
+		}
+		for _, r := range d.routes {
+			if config.RoutesOverlap(network, r.network) {
+				d.report(at, "overlapping-allowed-ips", "route each address to one peer only",
+					"AllowedIPs %s overlaps %s on line %d", item, r.text, r.line)
+				break
+			}
+		}
+		d.routes = append(d.routes, route{network: network, text: item, line: l.Num})
+	}
+}
@@ -0,0 +1,114 @@
+package validator
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"wg-bridge/internal/config"
+)
+
+func TestDiagnoseReportsEveryProblem(t *testing.T) {
+	text := `[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+ListenPort = 99999
+MTU = 1420
+Frobnicate = 1
+this line is broken
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+AllowedIPs = 10.0.0.0/24, 0.0.0.0/0
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+AllowedIPs = 10.0.0.7/32
+PersistentKeepalive = -1
+`
+	_, diags := NewValidator(true).Diagnose(text)
+	want := []struct {
+		line, col, endCol int
+		severity          config.Severity
+		rule, key         string
+	}{
+		{3, 14, 19, config.SeverityError, "invalid-value", "ListenPort"},
+		{5, 1, 11, config.SeverityWarning, "unknown-key", "Frobnicate"},
+		{6, 1, 20, config.SeverityError, "invalid-line", ""},
+		{10, 27, 36, config.SeverityError, "catch-all-route", "AllowedIPs"},
+		{13, 13, 57, config.SeverityError, "duplicate-peer", "PublicKey"},
+		{14, 14, 25, config.SeverityError, "overlapping-allowed-ips", "AllowedIPs"},
+		{15, 23, 25, config.SeverityError, "invalid-value", "PersistentKeepalive"},
+	}
+	if len(diags) != len(want) {
+		t.Fatalf("got %d diagnostics, want %d:\n%v", len(diags), len(want), diags)
+	}
+	for i, w := range want {
+		d := diags[i]
+		if d.Line != w.line || d.Col != w.col || d.EndLine != w.line || d.EndCol != w.endCol ||
+			d.Severity != w.severity || d.Rule != w.rule || d.Key != w.key {
+			t.Errorf("diagnostic %d = %+v, want %+v", i, d, w)
+		}
+		if d.Message == "" || d.Severity == config.SeverityError && d.Fix == "" {
+			t.Errorf("diagnostic %d lacks a message or fix: %+v", i, d)
+		}
+	}
+	if diags[4].Section != "Peer" || !strings.Contains(diags[4].Message, "line 9") {
+		t.Errorf("duplicate peer should point back at line 9: %+v", diags[4])
+	}
+}
+
+func TestDiagnoseFileLevelProblems(t *testing.T) {
+	_, diags := NewValidator(true).Diagnose("# nothing here\n")
+	rules := []string{}
+	for _, d := range diags {
+		rules = append(rules, d.Rule)
+		if d.Line != 1 || d.Col != 1 {
+			t.Errorf("file-level diagnostic not at the start: %+v", d)
+		}
+	}
+	if strings.Join(rules, ",") != "missing-interface,no-peers" {
+		t.Errorf("rules = %v", rules)
+	}
+
+	_, diags = NewValidator(false).Diagnose("[Interface]\nListenPort = 51820\n")
+	if len(diags) != 1 || diags[0].Rule != "missing-key" || diags[0].Line != 1 {
+		t.Errorf("expected one missing-key on the header, got %v", diags)
+	}
+}
+
+// Diagnose must find an error exactly when the parser or ValidateConfig
+// rejects a config, so that both agree on what is valid.
+func TestDiagnoseAgreesWithValidateConfig(t *testing.T) {
+	inputs := map[string]string{
+		"empty":          "",
+		"no peers":       "[Interface]\nPrivateKey = " + testPrivateKey + "\n",
+		"weak psk":       "[Interface]\nPrivateKey = " + testPrivateKey + "\n[Peer]\nPublicKey = " + testPublicKey + "\nAllowedIPs = 10.0.0.2/32\nPresharedKey = " + dummyKey + "\n",
+		"empty allowed":  "[Interface]\nPrivateKey = " + testPrivateKey + "\n[Peer]\nPublicKey = " + testPublicKey + "\nAllowedIPs =\n",
+		"repeated port":  "[Interface]\nPrivateKey = " + testPrivateKey + "\nListenPort = x\nListenPort = 51820\n",
+		"disabled peer":  "[Interface]\nPrivateKey = " + testPrivateKey + "\n# [Peer]\n# PublicKey = x\n",
+		"key file":       "[Interface]\nPrivateKeyFile = /etc/wireguard/wg0.key\nPrivateKey = " + testPrivateKey + "\n",
+		"unknown header": "[Interface]\nPrivateKey = " + testPrivateKey + "\n[Foo]\nBar = 1\n",
+	}
+	files, _ := filepath.Glob("../../testdata/*.conf")
+	for _, name := range files {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inputs[filepath.Base(name)] = string(b)
+	}
+	for name, text := range inputs {
+		for _, strict := range []bool{true, false} {
+			v := NewValidator(strict)
+			summary, err := config.NewParser(strict).Parse(text)
+			if err == nil {
+				err = v.ValidateConfig(summary)
+			}
+			_, diags := v.Diagnose(text)
+			if config.HasErrors(diags) != (err != nil) {
+				t.Errorf("%s (strict %v): ValidateConfig says %v, Diagnose says %v", name, strict, err, diags)
+			}
+		}
+	}
+}
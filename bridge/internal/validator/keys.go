@@ -0,0 +1,70 @@
+package validator
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var (
+	// ErrKeyMismatch is returned when a private key does not belong to the
+	// public key it is checked against
+	ErrKeyMismatch = errors.New("private key does not match public key")
+	// ErrWeakKey is returned for placeholder keys such as the all-A key
+	ErrWeakKey = errors.New("low-entropy key")
+)
+
+// minKeyBytes is the number of distinct byte values below which a key is
+// treated as a placeholder. A random 32-byte key has about 30.
+const minKeyBytes = 8
+
+// ParseKey parses a base64 WireGuard key and rejects low-entropy keys
+func ParseKey(s string) (wgtypes.Key, error) {
+	k, err := wgtypes.ParseKey(s)
+	if err != nil {
+		return k, fmt.Errorf("invalid key: %w", err)
+	}
+	if err := CheckKeyEntropy(k); err != nil {
+		return k, err
+	}
+	return k, nil
+}
+
+// CheckKeyEntropy rejects keys made of only a few distinct bytes, which no
+// key generator produces
+func CheckKeyEntropy(k wgtypes.Key) error {
+	seen := map[byte]struct{}{}
+	for _, b := range k {
+		seen[b] = struct{}{}
+	}
+	if len(seen) < minKeyBytes {
+		return ErrWeakKey
+	}
+	return nil
+}
+
+// DerivePublicKey returns the public key of a base64 private key
+func DerivePublicKey(private string) (string, error) {
+	k, err := ParseKey(private)
+	if err != nil {
+		return "", err
+	}
+	return k.PublicKey().String(), nil
+}
+
+// CheckKeyPair verifies that private is the private half of public
+func CheckKeyPair(private, public string) error {
+	derived, err := DerivePublicKey(private)
+	if err != nil {
+		return fmt.Errorf("private key: %w", err)
+	}
+	pub, err := wgtypes.ParseKey(public)
+	if err != nil {
+		return fmt.Errorf("public key: invalid key: %w", err)
+	}
+	if derived != pub.String() {
+		return ErrKeyMismatch
+	}
+	return nil
+}
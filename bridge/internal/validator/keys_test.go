@@ -0,0 +1,81 @@
+package validator
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"wg-bridge/internal/config"
+)
+
+const (
+	testPrivateKey = "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+	testPublicKey  = "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+	dummyKey       = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+)
+
+func TestDerivePublicKey(t *testing.T) {
+	// key pair from the wg(8) man page
+	pub, err := DerivePublicKey(testPrivateKey)
+	if err != nil {
+		t.Fatalf("DerivePublicKey: %v", err)
+	}
+	if pub != "HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw=" {
+		t.Errorf("unexpected public key %s", pub)
+	}
+	if _, err := DerivePublicKey(dummyKey); !errors.Is(err, ErrWeakKey) {
+		t.Errorf("expected ErrWeakKey for the all-A key, got %v", err)
+	}
+	if _, err := DerivePublicKey("not a key"); err == nil {
+		t.Error("expected invalid key to fail")
+	}
+}
+
+func TestCheckKeyPair(t *testing.T) {
+	if err := CheckKeyPair(testPrivateKey, "HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw="); err != nil {
+		t.Errorf("expected matching pair, got %v", err)
+	}
+	if err := CheckKeyPair(testPrivateKey, testPublicKey); !errors.Is(err, ErrKeyMismatch) {
+		t.Errorf("expected ErrKeyMismatch, got %v", err)
+	}
+	if err := CheckKeyPair(dummyKey, testPublicKey); !errors.Is(err, ErrWeakKey) {
+		t.Errorf("expected ErrWeakKey, got %v", err)
+	}
+}
+
+func TestValidateConfigKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		private string
+		peer    string
+		expect  string
+		wantErr string
+	}{
+		{"valid", testPrivateKey, testPublicKey, "", ""},
+		{"dummy private key", dummyKey, testPublicKey, "", "low-entropy"},
+		{"dummy peer key", testPrivateKey, dummyKey, "", "low-entropy"},
+		{"own key as peer", testPrivateKey, "HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw=", "", "own key"},
+		{"expected key", testPrivateKey, testPublicKey, "HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw=", ""},
+		{"mismatched key", testPrivateKey, testPublicKey, testPublicKey, "does not match"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			summary, err := config.NewParser(false).Parse("[Interface]\nPrivateKey = " + tt.private +
+				"\n\n[Peer]\nPublicKey = " + tt.peer + "\nAllowedIPs = 10.0.0.2/32\n")
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			v := NewValidator(false)
+			if tt.expect != "" {
+				v.ExpectPublicKey(tt.expect)
+			}
+			err = v.ValidateConfig(summary)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("expected valid config, got %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
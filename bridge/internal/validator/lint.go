@@ -0,0 +1,305 @@
+package validator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"wg-bridge/internal/config"
+)
+
+// LintRule is a built-in check for configurations that are valid but
+// probably not what was meant. Options are tunable numbers with their
+// defaults.
+type LintRule struct {
+	ID          string
+	Description string
+	Severity    config.Severity
+	Options     map[string]int
+
+	check func(f *config.File, opts map[string]int) []config.Diagnostic
+}
+
+var lintRules = []LintRule{
+	{
+		ID:          "missing-keepalive",
+		Description: "a peer reached at an Endpoint has no PersistentKeepalive, or one longer than NAT mappings last",
+		Severity:    config.SeverityWarning,
+		Options:     map[string]int{"maxInterval": 120},
+		check:       lintKeepalive,
+	},
+	{
+		ID:          "missing-preshared-key",
+		Description: "a peer has no PresharedKey",
+		Severity:    config.SeverityInfo,
+		check:       lintPresharedKey,
+	},
+	{
+		ID:          "mtu-too-large",
+		Description: "the MTU leaves no room for the WireGuard overhead on the uplink",
+		Severity:    config.SeverityWarning,
+		Options:     map[string]int{"uplinkMTU": 1500, "overhead": 80},
+		check:       lintMTU,
+	},
+	{
+		ID:          "listen-port-on-client",
+		Description: "ListenPort is set although the only peer is reached at its Endpoint",
+		Severity:    config.SeverityInfo,
+		check:       lintListenPort,
+	},
+	{
+		ID:          "address-outside-routes",
+		Description: "an interface Address is outside the AllowedIPs of every peer",
+		Severity:    config.SeverityWarning,
+		check:       lintAddressRoutes,
+	},
+}
+
+// LintRules returns the built-in rules in the order they run
+func LintRules() []LintRule {
+	return append([]LintRule{}, lintRules...)
+}
+
+func lookupLintRule(id string) (*LintRule, bool) {
+	for i := range lintRules {
+		if lintRules[i].ID == id {
+			return &lintRules[i], true
+		}
+	}
+	return nil, false
+}
+
+// RuleConfig enables, disables or tunes a lint rule. Unset fields keep the
+// value of the level below: interface, then global, then built-in.
+type RuleConfig struct {
+	Enabled  *bool           `yaml:"enabled"`
+	Severity config.Severity `yaml:"severity"`
+	Options  map[string]int  `yaml:"options"`
+}
+
+// LintConfig is the contents of lint.yaml. Rules applies to every
+// interface; Interfaces overrides it per interface.
+type LintConfig struct {
+	Rules      map[string]RuleConfig            `yaml:"rules"`
+	Interfaces map[string]map[string]RuleConfig `yaml:"interfaces"`
+}
+
+// ParseLintConfig parses lint.yaml, rejecting unknown rules, options and
+// fields so that a typo does not silently leave a rule on.
+func ParseLintConfig(b []byte) (*LintConfig, error) {
+	c := &LintConfig{}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if err := checkRuleConfigs(c.Rules); err != nil {
+		return nil, err
+	}
+	for name, rules := range c.Interfaces {
+		if err := ValidateInterfaceName(name); err != nil {
+			return nil, err
+		}
+		if err := checkRuleConfigs(rules); err != nil {
+			return nil, fmt.Errorf("interface %s: %w", name, err)
+		}
+	}
+	return c, nil
+}
+
+func checkRuleConfigs(rules map[string]RuleConfig) error {
+	for id, rc := range rules {
+		rule, ok := lookupLintRule(id)
+		if !ok {
+			return fmt.Errorf("unknown lint rule %q", id)
+		}
+		switch rc.Severity {
+		case "", config.SeverityError, config.SeverityWarning, config.SeverityInfo:
+		default:
+			return fmt.Errorf("rule %s: invalid severity %q", id, rc.Severity)
+		}
+		for name, value := range rc.Options {
+			if _, ok := rule.Options[name]; !ok {
+				return fmt.Errorf("rule %s: unknown option %q", id, name)
+			}
+			if value < 0 {
+				return fmt.Errorf("rule %s: option %s must not be negative", id, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Linter runs the built-in lint rules as a LintConfig sets them up
+type Linter struct {
+	config *LintConfig
+}
+
+// NewLinter creates a linter. A nil config runs every rule with its
+// defaults.
+func NewLinter(c *LintConfig) *Linter {
+	if c == nil {
+		c = &LintConfig{}
+	}
+	return &Linter{config: c}
+}
+
+// resolve merges the built-in, global and interface settings of rule.
+func (l *Linter) resolve(rule *LintRule, iface string) (bool, config.Severity, map[string]int) {
+	enabled, severity := true, rule.Severity
+	opts := make(map[string]int, len(rule.Options))
+	for k, v := range rule.Options {
+		opts[k] = v
+	}
+	for _, rc := range []RuleConfig{l.config.Rules[rule.ID], l.config.Interfaces[iface][rule.ID]} {
+		if rc.Enabled != nil {
+			enabled = *rc.Enabled
+		}
+		if rc.Severity != "" {
+			severity = rc.Severity
+		}
+		for k, v := range rc.Options {
+			opts[k] = v
+		}
+	}
+	return enabled, severity, opts
+}
+
+// Lint runs the enabled rules on f, the config of iface, and returns
+// their findings in order of position.
+func (l *Linter) Lint(iface string, f *config.File) []config.Diagnostic {
+	var out []config.Diagnostic
+	for i := range lintRules {
+		rule := &lintRules[i]
+		enabled, severity, opts := l.resolve(rule, iface)
+		if !enabled {
+			continue
+		}
+		for _, d := range rule.check(f, opts) {
+			d.Rule, d.Severity = rule.ID, severity
+			out = append(out, d)
+		}
+	}
+	config.SortDiagnostics(out)
+	return out
+}
+
+// finding builds a diagnostic for a rule; Lint sets its rule and severity.
+func finding(at config.Diagnostic, fix, format string, args ...interface{}) config.Diagnostic {
+	at.Fix, at.Message = fix, fmt.Sprintf(format, args...)
+	return at
+}
+
+func hasValue(s *config.Section, key string) bool {
+	l := lastEntry(s, key)
+	return l != nil && l.Value != ""
+}
+
+func lintKeepalive(f *config.File, opts map[string]int) []config.Diagnostic {
+	var out []config.Diagnostic
+	for _, s := range enabledPeers(f) {
+		ep := lastEntry(s, "Endpoint")
+		if ep == nil || ep.Value == "" {
+			continue
+		}
+		ka := lastEntry(s, "PersistentKeepalive")
+		if ka == nil || ka.Value == "" || ka.Value == "off" || ka.Value == "0" {
+			out = append(out, finding(onKey(s, ep), "add PersistentKeepalive = 25 if either side is behind NAT",
+				"peer at %s has no PersistentKeepalive", ep.Value))
+			continue
+		}
+		if n, err := strconv.Atoi(ka.Value); err == nil && n > opts["maxInterval"] {
+			out = append(out, finding(onValue(s, ka), "use PersistentKeepalive = 25",
+				"PersistentKeepalive %d is longer than NAT mappings are kept (%ds)", n, opts["maxInterval"]))
+		}
+	}
+	return out
+}
+
+func lintPresharedKey(f *config.File, _ map[string]int) []config.Diagnostic {
+	var out []config.Diagnostic
+	for _, s := range enabledPeers(f) {
+		if !hasValue(s, "PresharedKey") && !hasValue(s, "PresharedKeyFile") {
+			out = append(out, finding(onHeader(s), "add a PresharedKey, generated with wg genpsk, on both sides",
+				"peer has no PresharedKey"))
+		}
+	}
+	return out
+}
+
+func lintMTU(f *config.File, opts map[string]int) []config.Diagnostic {
+	iface := f.Interface()
+	if iface == nil {
+		return nil
+	}
+	l := lastEntry(iface, "MTU")
+	if l == nil {
+		return nil
+	}
+	mtu, err := strconv.Atoi(l.Value)
+	limit := opts["uplinkMTU"] - opts["overhead"]
+	if err != nil || mtu <= limit {
+		return nil
+	}
+	return []config.Diagnostic{finding(onValue(iface, l), fmt.Sprintf("use MTU = %d or less", limit),
+		"MTU %d leaves no room for %d bytes of WireGuard overhead on a %d-byte uplink", mtu, opts["overhead"], opts["uplinkMTU"])}
+}
+
+func lintListenPort(f *config.File, _ map[string]int) []config.Diagnostic {
+	iface := f.Interface()
+	if iface == nil {
+		return nil
+	}
+	port := lastEntry(iface, "ListenPort")
+	peers := enabledPeers(f)
+	if port == nil || len(peers) != 1 || !hasValue(peers[0], "Endpoint") {
+		return nil
+	}
+	return []config.Diagnostic{finding(onKey(iface, port), "remove ListenPort unless the peer also connects to this host",
+		"ListenPort is set although the only peer is reached at its Endpoint")}
+}
+
+func lintAddressRoutes(f *config.File, _ map[string]int) []config.Diagnostic {
+	iface := f.Interface()
+	peers := enabledPeers(f)
+	if iface == nil || len(peers) == 0 {
+		return nil
+	}
+	var routes []route
+	for _, s := range peers {
+		for _, v := range s.Values("AllowedIPs") {
+			for _, item := range strings.Split(v, ",") {
+				if network, ok := config.ParseRoute(strings.TrimSpace(item)); ok {
+					routes = append(routes, route{network: network})
+				}
+			}
+		}
+	}
+	var out []config.Diagnostic
+	for _, l := range iface.Body {
+		if l.Kind != config.Entry || !strings.EqualFold(l.Key, "Address") {
+			continue
+		}
+		for _, item := range strings.Split(l.Value, ",") {
+			item = strings.TrimSpace(item)
+			network, ok := config.ParseRoute(item)
+			if !ok {
+				continue
+			}
+			routed := false
+			for _, r := range routes {
+				routed = routed || config.RoutesOverlap(network, r.network)
+			}
+			if !routed {
+				out = append(out, finding(onItem(iface, l, item), "add its network to the AllowedIPs of the peer that routes it, or correct the Address",
+					"Address %s is outside the AllowedIPs of every peer", item))
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,110 @@
+package validator
+
+import (
+	"strings"
+	"testing"
+
+	"wg-bridge/internal/config"
+)
+
+const lintConfigText = `[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+Address = 10.9.0.2/32, 10.0.0.2/32
+ListenPort = 51820
+MTU = 1480
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+Endpoint = vpn.example.com:51820
+AllowedIPs = 10.0.0.0/24
+`
+
+func lintRulesOf(t *testing.T, l *Linter, iface, text string) string {
+	t.Helper()
+	f, err := config.Parse(text)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	var out []string
+	for _, d := range l.Lint(iface, f) {
+		out = append(out, string(d.Severity)+":"+d.Rule)
+		if d.Message == "" || d.Fix == "" || d.Line == 0 {
+			t.Errorf("incomplete finding %+v", d)
+		}
+	}
+	return strings.Join(out, ",")
+}
+
+func TestLintBuiltinRules(t *testing.T) {
+	got := lintRulesOf(t, NewLinter(nil), "wg0", lintConfigText)
+	want := "warning:address-outside-routes,info:listen-port-on-client,warning:mtu-too-large,info:missing-preshared-key,warning:missing-keepalive"
+	if got != want {
+		t.Errorf("findings = %s\nwant %s", got, want)
+	}
+
+	clean := `[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+Address = 10.0.0.2/32
+MTU = 1420
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+PresharedKey = FpCyhws9cxwWoV4xELtfJvjJN+zQVRPISllRWgeopVE=
+Endpoint = vpn.example.com:51820
+PersistentKeepalive = 25
+AllowedIPs = 0.0.0.0/0
+`
+	if got := lintRulesOf(t, NewLinter(nil), "wg0", clean); got != "" {
+		t.Errorf("clean config has findings: %s", got)
+	}
+	long := strings.Replace(clean, "PersistentKeepalive = 25", "PersistentKeepalive = 300", 1)
+	if got := lintRulesOf(t, NewLinter(nil), "wg0", long); got != "warning:missing-keepalive" {
+		t.Errorf("long keepalive findings = %s", got)
+	}
+}
+
+func TestLintConfig(t *testing.T) {
+	c, err := ParseLintConfig([]byte(`
+rules:
+  missing-preshared-key:
+    enabled: false
+  mtu-too-large:
+    severity: error
+    options:
+      uplinkMTU: 1560
+interfaces:
+  wg1:
+    missing-keepalive:
+      enabled: false
+    mtu-too-large:
+      options:
+        uplinkMTU: 1500
+`))
+	if err != nil {
+		t.Fatalf("ParseLintConfig: %v", err)
+	}
+	l := NewLinter(c)
+	if got := lintRulesOf(t, l, "wg0", lintConfigText); got != "warning:address-outside-routes,info:listen-port-on-client,warning:missing-keepalive" {
+		t.Errorf("wg0 findings = %s", got)
+	}
+	if got := lintRulesOf(t, l, "wg1", lintConfigText); got != "warning:address-outside-routes,info:listen-port-on-client,error:mtu-too-large" {
+		t.Errorf("wg1 findings = %s", got)
+	}
+
+	for _, bad := range []string{
+		"rules:\n  no-such-rule: {}\n",
+		"rules:\n  mtu-too-large:\n    severity: fatal\n",
+		"rules:\n  mtu-too-large:\n    options:\n      uplink: 1500\n",
+		"rules:\n  mtu-too-large:\n    options:\n      uplinkMTU: -1\n",
+		"rules:\n  mtu-too-large:\n    enable: false\n",
+		"interfaces:\n  wg@0: {}\n",
+		"rules: [",
+	} {
+		if _, err := ParseLintConfig([]byte(bad)); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+	if _, err := ParseLintConfig(nil); err != nil {
+		t.Errorf("empty lint.yaml: %v", err)
+	}
+}
@@ -4,9 +4,20 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"regexp"
 	"strings"
+	"time"
+)
+
+var (
+	// ErrChecksumMismatch is returned when the config data does not match
+	// the checksum recorded in the manifest
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrReplay is returned when a manifest is not newer than the last one
+	// accepted for the same interface
+	ErrReplay = errors.New("replayed or stale manifest")
 )
 
 // Manifest represents a .wgx exchange manifest
@@ -16,6 +27,35 @@ type Manifest struct {
 	Checksum  string `json:"checksum"`
 	Timestamp int64  `json:"timestamp,omitempty"`
 	Source    string `json:"source,omitempty"`
+	Sequence  uint64 `json:"sequence,omitempty"`
+	Type      string `json:"type,omitempty"`
+}
+
+// Bundle payload types. An empty type is treated as TypeConfig so that
+// bundles predating typed payloads keep working.
+const (
+	TypeConfig          = "config"
+	TypePeerAdd         = "peer-add"
+	TypePeerRemove      = "peer-remove"
+	TypePeerEndpoint    = "peer-endpoint"
+	TypePeerKeyRotation = "peer-key-rotation"
+	TypeReceipt         = "receipt"
+	TypeNodeKeyRotation = "node-key-rotation"
+)
+
+// PayloadType returns the manifest type, defaulting to TypeConfig
+func (m *Manifest) PayloadType() string {
+	if m.Type == "" {
+		return TypeConfig
+	}
+	return m.Type
+}
+
+// ReplayState records the newest manifest accepted for an interface
+type ReplayState struct {
+	Sequence  uint64 `json:"sequence"`
+	Timestamp int64  `json:"timestamp"`
+	Checksum  string `json:"checksum"`
 }
 
 // ManifestValidator validates .wgx manifest files
@@ -23,6 +63,8 @@ type ManifestValidator struct {
 	strictMode      bool
 	maxManifestSize int
 	allowedVersions []int
+	allowedTypes    []string
+	now             func() time.Time
 }
 
 // NewManifestValidator creates a new manifest validator
@@ -31,6 +73,11 @@ func NewManifestValidator(strict bool) *ManifestValidator {
 		strictMode:      strict,
 		maxManifestSize: 1024 * 1024, // 1MB
 		allowedVersions: []int{1, 2},
+		allowedTypes: []string{
+			TypeConfig, TypePeerAdd, TypePeerRemove, TypePeerEndpoint, TypePeerKeyRotation,
+			TypeReceipt, TypeNodeKeyRotation,
+		},
+		now: time.Now,
 	}
 }
 
@@ -47,6 +94,15 @@ func (v *ManifestValidator) ValidateManifest(manifest *Manifest, configData []by
 	return nil
 }
 
+// ValidateChecksum checks data against the checksum of a manifest already
+// validated by ValidateManifestJSON.
+func (v *ManifestValidator) ValidateChecksum(manifest *Manifest, data []byte) error {
+	if err := v.validateChecksum(manifest, data); err != nil {
+		return fmt.Errorf("checksum validation failed: %w", err)
+	}
+	return nil
+}
+
 // ValidateManifestJSON validates raw JSON manifest data
 func (v *ManifestValidator) ValidateManifestJSON(data []byte) (*Manifest, error) {
 	if len(data) > v.maxManifestSize {
@@ -78,6 +134,12 @@ func (v *ManifestValidator) validateManifestFields(manifest *Manifest) error {
 			manifest.Version, v.allowedVersions)
 	}
 
+	// Validate payload type
+	if !v.isTypeAllowed(manifest.PayloadType()) {
+		return fmt.Errorf("unsupported type: %q (supported: %v)",
+			manifest.Type, v.allowedTypes)
+	}
+
 	// Validate checksum format
 	if err := v.validateChecksumFormat(manifest.Checksum); err != nil {
 		return fmt.Errorf("invalid checksum: %w", err)
@@ -110,7 +172,7 @@ func (v *ManifestValidator) validateChecksum(manifest *Manifest, data []byte) er
 	expected := hex.EncodeToString(hash[:])
 
 	if !strings.EqualFold(manifest.Checksum, expected) {
-		return fmt.Errorf("checksum mismatch: expected %s, got %s", expected, manifest.Checksum)
+		return fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, expected, manifest.Checksum)
 	}
 
 	return nil
@@ -140,6 +202,16 @@ func (v *ManifestValidator) isVersionAllowed(version int) bool {
 	return false
 }
 
+// isTypeAllowed checks if a payload type is supported
+func (v *ManifestValidator) isTypeAllowed(typ string) bool {
+	for _, allowed := range v.allowedTypes {
+		if typ == allowed {
+			return true
+		}
+	}
+	return false
+}
+
 // validateSource validates source field format
 func (v *ManifestValidator) validateSource(source string) error {
 	if len(source) == 0 || len(source) > 255 {
@@ -165,7 +237,7 @@ func (v *ManifestValidator) validateTimestamp(timestamp int64) error {
 	// Check if timestamp is reasonable (not too far in future)
 	// This is a basic sanity check
 	const maxFutureSeconds = 24 * 60 * 60 // 24 hours
-	now := int64(1691587200)              // 2023-08-09 as baseline
+	now := v.now().Unix()
 	if timestamp > now+maxFutureSeconds {
 		return fmt.Errorf("timestamp too far in future: %d", timestamp)
 	}
@@ -173,6 +245,25 @@ func (v *ManifestValidator) validateTimestamp(timestamp int64) error {
 	return nil
 }
 
+// ValidateFreshness rejects manifests that are not strictly newer than the
+// last manifest accepted from the same sender for the interface. A nil last state accepts any
+// manifest carrying a sequence number and timestamp.
+func (v *ManifestValidator) ValidateFreshness(manifest *Manifest, last *ReplayState) error {
+	if manifest.Sequence == 0 || manifest.Timestamp == 0 {
+		return fmt.Errorf("%w: manifest has no sequence number or timestamp", ErrReplay)
+	}
+	if last == nil {
+		return nil
+	}
+	if manifest.Sequence <= last.Sequence {
+		return fmt.Errorf("%w: sequence %d not newer than %d", ErrReplay, manifest.Sequence, last.Sequence)
+	}
+	if manifest.Timestamp < last.Timestamp {
+		return fmt.Errorf("%w: timestamp %d older than %d", ErrReplay, manifest.Timestamp, last.Timestamp)
+	}
+	return nil
+}
+
 // GenerateChecksum generates SHA256 checksum for config data
 func GenerateChecksum(data []byte) string {
 	hash := sha256.Sum256(data)
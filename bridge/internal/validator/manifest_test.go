@@ -1,10 +1,17 @@
 package validator
 
 import (
+	"errors"
 	"strings"
 	"testing"
+	"time"
 )
 
+// fixedClock pins the validator clock to 2023-08-09
+func fixedClock() time.Time {
+	return time.Unix(1691587200, 0)
+}
+
 func TestValidateManifestValid(t *testing.T) {
 	validator := NewManifestValidator(true)
 
@@ -253,6 +260,7 @@ func TestValidateManifestValidSource(t *testing.T) {
 
 func TestValidateManifestInvalidTimestamp(t *testing.T) {
 	validator := NewManifestValidator(true)
+	validator.now = fixedClock
 
 	invalidTimestamps := []int64{
 		-1,
@@ -280,6 +288,7 @@ func TestValidateManifestInvalidTimestamp(t *testing.T) {
 
 func TestValidateManifestValidTimestamp(t *testing.T) {
 	validator := NewManifestValidator(true)
+	validator.now = fixedClock
 
 	validTimestamps := []int64{
 		1691587200,
@@ -324,6 +333,95 @@ func TestValidateManifestNonStrictMode(t *testing.T) {
 	}
 }
 
+func TestValidateManifestChecksumMismatchIsTyped(t *testing.T) {
+	validator := NewManifestValidator(true)
+
+	manifest := &Manifest{
+		Interface: "wg0",
+		Version:   1,
+		Checksum:  "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+	}
+
+	err := validator.ValidateManifest(manifest, []byte("other"))
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected ErrChecksumMismatch, got: %v", err)
+	}
+}
+
+func TestValidateManifestTypes(t *testing.T) {
+	validator := NewManifestValidator(true)
+
+	testCases := []struct {
+		typ string
+		ok  bool
+	}{
+		{"", true},
+		{TypeConfig, true},
+		{TypePeerAdd, true},
+		{TypePeerRemove, true},
+		{TypePeerEndpoint, true},
+		{TypePeerKeyRotation, true},
+		{TypeReceipt, true},
+		{TypeNodeKeyRotation, true},
+		{"shell", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.typ, func(t *testing.T) {
+			manifest := &Manifest{
+				Interface: "wg0",
+				Version:   2,
+				Checksum:  "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+				Type:      tc.typ,
+			}
+			err := validator.ValidateManifest(manifest, []byte("hello"))
+			if tc.ok && err != nil {
+				t.Errorf("Expected type %q to be accepted, got: %v", tc.typ, err)
+			}
+			if !tc.ok && err == nil {
+				t.Errorf("Expected type %q to be rejected", tc.typ)
+			}
+		})
+	}
+
+	if (&Manifest{}).PayloadType() != TypeConfig {
+		t.Error("Expected empty type to default to config")
+	}
+}
+
+func TestValidateFreshness(t *testing.T) {
+	validator := NewManifestValidator(true)
+	last := &ReplayState{Sequence: 5, Timestamp: 1691587200}
+
+	testCases := []struct {
+		name     string
+		manifest Manifest
+		last     *ReplayState
+		ok       bool
+	}{
+		{"first bundle", Manifest{Sequence: 1, Timestamp: 1691587200}, nil, true},
+		{"newer bundle", Manifest{Sequence: 6, Timestamp: 1691587300}, last, true},
+		{"same timestamp", Manifest{Sequence: 6, Timestamp: 1691587200}, last, true},
+		{"missing sequence", Manifest{Timestamp: 1691587200}, nil, false},
+		{"missing timestamp", Manifest{Sequence: 1}, nil, false},
+		{"replayed sequence", Manifest{Sequence: 5, Timestamp: 1691587300}, last, false},
+		{"older sequence", Manifest{Sequence: 4, Timestamp: 1691587300}, last, false},
+		{"older timestamp", Manifest{Sequence: 6, Timestamp: 1691587100}, last, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validator.ValidateFreshness(&tc.manifest, tc.last)
+			if tc.ok && err != nil {
+				t.Errorf("Expected manifest to be fresh, got: %v", err)
+			}
+			if !tc.ok && !errors.Is(err, ErrReplay) {
+				t.Errorf("Expected ErrReplay, got: %v", err)
+			}
+		})
+	}
+}
+
 func TestGenerateChecksum(t *testing.T) {
 	testCases := []struct {
 		data     []byte
@@ -0,0 +1,74 @@
+package validator
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"wg-bridge/internal/config"
+)
+
+// RouteLimits restricts the AllowedIPs peers may claim. Routes must lie
+// within one of Supernets, if any are given, and be no wider than
+// MinPrefixV4/MinPrefixV6. AllowCatchAll permits 0.0.0.0/0 and ::/0, which
+// are then exempt from the other limits.
+type RouteLimits struct {
+	Supernets     []*net.IPNet
+	MinPrefixV4   int
+	MinPrefixV6   int
+	AllowCatchAll bool
+}
+
+// SetRouteLimits makes ValidateConfig and Diagnose enforce l. It replaces
+// the catch-all setting NewValidator derives from the strict flag.
+func (v *ConfigValidator) SetRouteLimits(l RouteLimits) {
+	v.routeLimits = l
+	v.allowCatchAll = l.AllowCatchAll
+}
+
+// CheckRoutes checks routes, such as the AllowedIPs of a peer about to be
+// added, against the route limits.
+func (v *ConfigValidator) CheckRoutes(routes []string) error {
+	for _, item := range routes {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		network, ok := config.ParseRoute(item)
+		if !ok {
+			return fmt.Errorf("invalid AllowedIPs %s", item)
+		}
+		if _, err := v.checkRoute(network, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRoute checks one route, written as text, against the route limits
+// and returns the rule it breaks.
+func (v *ConfigValidator) checkRoute(network *net.IPNet, text string) (string, error) {
+	ones, bits := network.Mask.Size()
+	if ones == 0 {
+		if v.allowCatchAll {
+			return "", nil
+		}
+		return "catch-all-route", fmt.Errorf("disallowed AllowedIPs %s", text)
+	}
+	if bits == 32 && ones < v.routeLimits.MinPrefixV4 {
+		return "route-too-wide", fmt.Errorf("AllowedIPs %s is wider than /%d", text, v.routeLimits.MinPrefixV4)
+	}
+	if bits == 128 && ones < v.routeLimits.MinPrefixV6 {
+		return "route-too-wide", fmt.Errorf("AllowedIPs %s is wider than /%d", text, v.routeLimits.MinPrefixV6)
+	}
+	if len(v.routeLimits.Supernets) == 0 {
+		return "", nil
+	}
+	for _, s := range v.routeLimits.Supernets {
+		sOnes, sBits := s.Mask.Size()
+		if sBits == bits && sOnes <= ones && s.Contains(network.IP) {
+			return "", nil
+		}
+	}
+	return "route-outside-supernets", fmt.Errorf("AllowedIPs %s is outside the permitted networks", text)
+}
@@ -0,0 +1,64 @@
+package validator
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"wg-bridge/internal/config"
+)
+
+func TestRouteLimits(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("10.0.0.0/16")
+	_, ula, _ := net.ParseCIDR("fd00::/48")
+	limits := RouteLimits{Supernets: []*net.IPNet{lan, ula}, MinPrefixV4: 24, MinPrefixV6: 64}
+
+	cases := []struct {
+		routes string
+		rule   string
+	}{
+		{"10.0.1.0/24, fd00::5/128", ""},
+		{"10.0.0.7", ""},
+		{"10.0.0.0/16", "route-too-wide"},
+		{"fd00::/56", "route-too-wide"},
+		{"10.1.0.0/24", "route-outside-supernets"},
+		{"192.168.0.1/32", "route-outside-supernets"},
+		{"fd01::1/128", "route-outside-supernets"},
+		{"0.0.0.0/0", "catch-all-route"},
+		{"::/0", "catch-all-route"},
+	}
+	for _, tc := range cases {
+		v := NewValidator(false)
+		v.SetRouteLimits(limits)
+		err := v.CheckRoutes(strings.Split(tc.routes, ","))
+		if (err == nil) != (tc.rule == "") {
+			t.Errorf("CheckRoutes(%s) = %v, want rule %q", tc.routes, err, tc.rule)
+		}
+
+		text := "[Interface]\nPrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=\n\n[Peer]\n" +
+			"PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=\nAllowedIPs = " + tc.routes + "\n"
+		var rules []string
+		_, diags := v.Diagnose(text)
+		for _, d := range diags {
+			if d.Severity == config.SeverityError {
+				rules = append(rules, d.Rule)
+			}
+		}
+		if got := strings.Join(rules, ","); got != tc.rule {
+			t.Errorf("Diagnose(%s) rules = %q, want %q", tc.routes, got, tc.rule)
+		}
+	}
+
+	// Catch-all routes may be allowed regardless of the other limits
+	v := NewValidator(true)
+	v.SetRouteLimits(RouteLimits{Supernets: []*net.IPNet{lan}, MinPrefixV4: 24, AllowCatchAll: true})
+	if err := v.CheckRoutes([]string{"0.0.0.0/0", "::/0"}); err != nil {
+		t.Errorf("catch-all should be allowed: %v", err)
+	}
+	if err := v.CheckRoutes([]string{"10.0.0.0/8"}); err == nil {
+		t.Error("other routes should still be limited")
+	}
+	if err := v.CheckRoutes([]string{"10.0.0.300/32"}); err == nil || !strings.Contains(err.Error(), "invalid AllowedIPs") {
+		t.Errorf("expected invalid AllowedIPs, got %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// keyPolicyFile holds settings for the exchange and signing keys.
+const keyPolicyFile = "/etc/cockpit-wg/key-policy"
+
+// defaultKeyRetain is the number of archived key generations kept when no
+// key policy sets one.
+const defaultKeyRetain = 5
+
+// keyPolicy controls key rotation. Retain is the number of archived
+// generations kept after a rotation; 0 keeps all of them. RotateDays
+// schedules automatic rotation; 0 leaves rotation to the operator.
+type keyPolicy struct {
+	Retain     int `json:"retain"`
+	RotateDays int `json:"rotateDays"`
+}
+
+// loadKeyPolicy returns the defaults when no policy file exists.
+func loadKeyPolicy(path string) (*keyPolicy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &keyPolicy{Retain: defaultKeyRetain}, nil
+		}
+		return nil, err
+	}
+	return parseKeyPolicy(path, b)
+}
+
+func parseKeyPolicy(path string, b []byte) (*keyPolicy, error) {
+	p := &keyPolicy{Retain: defaultKeyRetain}
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if p.Retain < 0 {
+		return nil, fmt.Errorf("%s: retain must not be negative", path)
+	}
+	if p.RotateDays < 0 {
+		return nil, fmt.Errorf("%s: rotateDays must not be negative", path)
+	}
+	return p, nil
+}
+
+// keyGeneration is one set of keys archived by a rotation.
+type keyGeneration struct {
+	Timestamp          string   `json:"timestamp"`
+	Retired            string   `json:"retired"`
+	Files              []string `json:"files"`
+	ExchangeKey        string   `json:"exchangeKey,omitempty"`
+	SigningFingerprint string   `json:"signingFingerprint,omitempty"`
+}
+
+func listKeyArchive() (interface{}, error) {
+	policy, err := loadKeyPolicy(keyPolicyFile)
+	if err != nil {
+		return nil, err
+	}
+	gens, err := keyArchive(keyDir)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"retain": policy.Retain, "generations": gens}, nil
+}
+
+// keyArchive groups the archived key files in dir by rotation, newest first.
+func keyArchive(dir string) ([]*keyGeneration, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []*keyGeneration{}, nil
+		}
+		return nil, err
+	}
+	byTS := map[string]*keyGeneration{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		for _, name := range keyFiles {
+			suffix, ok := strings.CutPrefix(e.Name(), name)
+			if !ok {
+				continue
+			}
+			m := archiveSuffixRx.FindStringSubmatch(suffix)
+			if m == nil {
+				continue
+			}
+			g := byTS[m[1]]
+			if g == nil {
+				g = &keyGeneration{Timestamp: m[1], Files: []string{}}
+				if t, err := time.ParseInLocation(archiveTimeFormat, m[1], time.Local); err == nil {
+					g.Retired = t.UTC().Format(time.RFC3339)
+				}
+				byTS[m[1]] = g
+			}
+			g.Files = append(g.Files, e.Name())
+			if name == "exchange.pub" || name == "signing.pub" {
+				if data, err := os.ReadFile(filepath.Join(dir, e.Name())); err == nil {
+					fp, _ := keyFingerprint(name, data)
+					if name == "exchange.pub" {
+						g.ExchangeKey = fp
+					} else {
+						g.SigningFingerprint = fp
+					}
+				}
+			}
+		}
+	}
+	gens := make([]*keyGeneration, 0, len(byTS))
+	for _, g := range byTS {
+		sort.Strings(g.Files)
+		gens = append(gens, g)
+	}
+	sort.Slice(gens, func(i, j int) bool { return gens[i].Timestamp > gens[j].Timestamp })
+	return gens, nil
+}
+
+// pruneKeyArchive deletes all but the retain newest archived generations
+// and returns the removed files.
+func pruneKeyArchive(dir string, retain int) ([]string, error) {
+	removed := []string{}
+	if retain <= 0 {
+		return removed, nil
+	}
+	gens, err := keyArchive(dir)
+	if err != nil || len(gens) <= retain {
+		return removed, err
+	}
+	for _, g := range gens[retain:] {
+		for _, f := range g.Files {
+			if err := os.Remove(filepath.Join(dir, f)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return removed, err
+			}
+			removed = append(removed, f)
+		}
+	}
+	if len(removed) > 0 {
+		params, _ := json.Marshal(map[string]interface{}{"removed": removed})
+		auditLog("PruneKeyArchive", params, nil)
+	}
+	return removed, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readKeys(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	out := map[string]string{}
+	for _, name := range keyFiles {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("read %s: %v", name, err)
+		}
+		out[name] = string(b)
+	}
+	return out
+}
+
+func TestSwapKeys(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := repairKeyDir(dir); err != nil {
+		t.Fatalf("repairKeyDir: %v", err)
+	}
+	old := readKeys(t, dir)
+	pub, err := swapKeys(dir, "20240101120000")
+	if err != nil {
+		t.Fatalf("swapKeys: %v", err)
+	}
+	cur := readKeys(t, dir)
+	if cur["exchange.pub"] != pub+"\n" {
+		t.Fatalf("exchange.pub %q does not hold %s", cur["exchange.pub"], pub)
+	}
+	for _, name := range keyFiles {
+		if cur[name] == old[name] {
+			t.Fatalf("%s was not replaced", name)
+		}
+		b, err := os.ReadFile(filepath.Join(dir, name+".20240101120000"))
+		if err != nil || string(b) != old[name] {
+			t.Fatalf("%s not archived: %v", name, err)
+		}
+	}
+	if st := inspectKeys(dir); len(st.Problems) > 0 && os.Getuid() == 0 {
+		t.Fatalf("new keys unhealthy: %v", st.Problems)
+	}
+	if _, err := swapKeys(dir, "20240101120000"); !errors.Is(err, ErrValidation) {
+		t.Fatalf("expected second rotation with the same timestamp to be refused, got %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 8 {
+		t.Fatalf("expected current and archived keys only, found %d entries", len(entries))
+	}
+}
+
+func TestSwapKeysRollback(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := repairKeyDir(dir); err != nil {
+		t.Fatalf("repairKeyDir: %v", err)
+	}
+	old := readKeys(t, dir)
+	defer func() { keyRename = os.Rename }()
+	calls := 0
+	keyRename = func(from, to string) error {
+		calls++
+		// fail while installing signing.key, after exchange.* are swapped
+		if calls == 6 {
+			return errors.New("disk full")
+		}
+		return os.Rename(from, to)
+	}
+	if _, err := swapKeys(dir, "20240101120000"); err == nil {
+		t.Fatal("expected swapKeys to fail")
+	}
+	cur := readKeys(t, dir)
+	for _, name := range keyFiles {
+		if cur[name] != old[name] {
+			t.Fatalf("%s not restored", name)
+		}
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 4 {
+		t.Fatalf("rollback left %d entries behind", len(entries))
+	}
+}
+
+func TestRotationKeepsInboxBundles(t *testing.T) {
+	dir, sender, inbox := t.TempDir(), t.TempDir(), t.TempDir()
+	if _, err := repairKeyDir(dir); err != nil {
+		t.Fatalf("repairKeyDir: %v", err)
+	}
+	if _, err := repairKeyDir(sender); err != nil {
+		t.Fatalf("repairKeyDir: %v", err)
+	}
+	pub := readKeys(t, dir)["exchange.pub"]
+	plain := filepath.Join(t.TempDir(), "bundle.tar")
+	os.WriteFile(plain, []byte("tar contents"), 0600)
+	path := filepath.Join(inbox, "wg0.wgx")
+	if err := encryptFile(plain, path, []string{pub}); err != nil {
+		t.Fatalf("encryptFile: %v", err)
+	}
+	if err := signFile(path, filepath.Join(sender, "signing.key")); err != nil {
+		t.Fatalf("signFile: %v", err)
+	}
+	if _, err := swapKeys(dir, "20240101120000"); err != nil {
+		t.Fatalf("swapKeys: %v", err)
+	}
+	if inboxDrained(inbox) {
+		t.Fatal("inbox with a bundle reported as drained")
+	}
+
+	// The bundle still verifies and opens with the retired key.
+	data, _ := os.ReadFile(path)
+	sig, _ := os.ReadFile(path + ".minisig")
+	if err := verifyData(readKeys(t, sender)["signing.pub"], data, sig); err != nil {
+		t.Fatalf("signature no longer verifies: %v", err)
+	}
+	keys := exchangeKeyFiles(dir)
+	if len(keys) != 2 || keys[1] != filepath.Join(dir, "exchange.key.20240101120000") {
+		t.Fatalf("unexpected exchange keys %v", keys)
+	}
+	out := filepath.Join(t.TempDir(), "out.tar")
+	if err := decryptFile(path, out, keys...); err != nil {
+		t.Fatalf("decrypt after rotation: %v", err)
+	}
+	if b, _ := os.ReadFile(out); string(b) != "tar contents" {
+		t.Fatalf("decrypted %q", b)
+	}
+	os.Remove(path)
+	if !inboxDrained(inbox) {
+		t.Fatal("empty inbox not reported as drained")
+	}
+}
+
+func TestPruneKeyArchive(t *testing.T) {
+	dir := t.TempDir()
+	for _, ts := range []string{"20240101000000", "20240201000000", "20240301000000"} {
+		for _, name := range keyFiles {
+			os.WriteFile(filepath.Join(dir, name+"."+ts), []byte("x"), 0600)
+		}
+	}
+	os.WriteFile(filepath.Join(dir, "exchange.key"), []byte("x"), 0600)
+
+	gens, err := keyArchive(dir)
+	if err != nil || len(gens) != 3 || gens[0].Timestamp != "20240301000000" || len(gens[0].Files) != 4 {
+		t.Fatalf("unexpected archive %+v: %v", gens, err)
+	}
+	removed, err := pruneKeyArchive(dir, 2)
+	if err != nil || len(removed) != 4 {
+		t.Fatalf("expected one generation removed, got %v: %v", removed, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "signing.key.20240101000000")); !os.IsNotExist(err) {
+		t.Fatal("oldest generation still present")
+	}
+	if removed, _ := pruneKeyArchive(dir, 0); len(removed) != 0 {
+		t.Fatalf("retain 0 must keep everything, removed %v", removed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "exchange.key")); err != nil {
+		t.Fatal("current key removed")
+	}
+}
+
+func TestLoadKeyPolicy(t *testing.T) {
+	dir := t.TempDir()
+	p, err := loadKeyPolicy(filepath.Join(dir, "missing"))
+	if err != nil || p.Retain != defaultKeyRetain {
+		t.Fatalf("expected defaults, got %+v %v", p, err)
+	}
+	path := filepath.Join(dir, "key-policy")
+	os.WriteFile(path, []byte(`{"retain":2}`), 0600)
+	if p, err := loadKeyPolicy(path); err != nil || p.Retain != 2 {
+		t.Fatalf("unexpected policy %+v %v", p, err)
+	}
+	os.WriteFile(path, []byte(`{"retain":-1}`), 0600)
+	if _, err := loadKeyPolicy(path); err == nil {
+		t.Fatal("expected negative retain to be rejected")
+	}
+}
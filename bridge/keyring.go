@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const keyringFile = "/var/lib/cockpit-wg/keyring.json"
+
+// Signer rejection reasons, see bundleReason.
+var (
+	ErrUnknownSigner    = fmt.Errorf("%w: unknown signer", ErrBundle)
+	ErrSignerRevoked    = fmt.Errorf("%w: signer revoked", ErrBundle)
+	ErrSignerExpired    = fmt.Errorf("%w: signer expired", ErrBundle)
+	ErrSignerNotAllowed = fmt.Errorf("%w: signer not allowed for interface", ErrBundle)
+)
+
+// signer is a trusted minisign public key. Fingerprint is the minisign key
+// id in the upper case hex form minisign itself prints. An empty Interfaces
+// list allows the signer to send bundles for any interface.
+type signer struct {
+	Name          string   `json:"name"`
+	Fingerprint   string   `json:"fingerprint"`
+	PublicKey     string   `json:"publicKey"`
+	Interfaces    []string `json:"interfaces"`
+	Added         string   `json:"added"`
+	Expires       string   `json:"expires,omitempty"`
+	Revoked       string   `json:"revoked,omitempty"`
+	RevokedReason string   `json:"revokedReason,omitempty"`
+	// Previous lists fingerprints replaced through key rotation
+	// announcements, oldest first.
+	Previous []string `json:"previous,omitempty"`
+	Rotated  string   `json:"rotated,omitempty"`
+}
+
+type keyring struct {
+	Signers []*signer `json:"signers"`
+	// LegacyMigrated records that the key in trustedPubKey was taken into
+	// the keyring. It is not trusted on its own after that, so removing
+	// the signer really removes it.
+	LegacyMigrated bool `json:"legacyMigrated,omitempty"`
+}
+
+var keyringMu sync.Mutex
+
+// loadKeyring reads the keyring. Nodes set up before the keyring existed
+// trust the single key in trustedPubKey; the first load finding it adds it
+// to the keyring as signer "legacy".
+func loadKeyring() (*keyring, error) {
+	kr := &keyring{Signers: []*signer{}}
+	b, err := os.ReadFile(keyringFile)
+	if err == nil {
+		if err := json.Unmarshal(b, kr); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if kr.Signers == nil {
+		kr.Signers = []*signer{}
+	}
+	if kr.LegacyMigrated {
+		return kr, nil
+	}
+	pub, err := os.ReadFile(trustedPubKey)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return kr, nil
+		}
+		return nil, err
+	}
+	migrateLegacySigner(kr, pub, time.Now())
+	if err := saveKeyring(kr); err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+// migrateLegacySigner adds the legacy key pub to kr unless kr holds it
+// already, and marks it migrated either way.
+func migrateLegacySigner(kr *keyring, pub []byte, now time.Time) {
+	kr.LegacyMigrated = true
+	line, id, err := publicKeyFingerprint(string(pub))
+	if err != nil || kr.find(id) != nil || kr.find("legacy") != nil {
+		return
+	}
+	kr.Signers = append(kr.Signers, &signer{
+		Name:        "legacy",
+		Fingerprint: id,
+		PublicKey:   line,
+		Interfaces:  []string{},
+		Added:       now.UTC().Format(time.RFC3339),
+	})
+	sort.Slice(kr.Signers, func(i, j int) bool { return kr.Signers[i].Name < kr.Signers[j].Name })
+}
+
+func saveKeyring(kr *keyring) error {
+	if err := os.MkdirAll(filepath.Dir(keyringFile), 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(kr, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := keyringFile + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, keyringFile)
+}
+
+// minisignKeyID decodes the base64 body of a minisign public key or
+// signature line and returns its key id. want is the decoded length.
+func minisignKeyID(line string, want int) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line))
+	if err != nil || len(b) != want || b[0] != 'E' || (b[1] != 'd' && b[1] != 'D') {
+		return "", fmt.Errorf("not a minisign key or signature")
+	}
+	return fmt.Sprintf("%016X", binary.LittleEndian.Uint64(b[2:10])), nil
+}
+
+// publicKeyFingerprint returns the key id of a minisign public key given
+// either as the bare base64 line or as the contents of a .pub file.
+func publicKeyFingerprint(pub string) (string, string, error) {
+	line := minisignPayloadLine([]byte(pub))
+	id, err := minisignKeyID(line, 42)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: invalid minisign public key", ErrValidation)
+	}
+	return line, id, nil
+}
+
+// signatureKeyID returns the key id a .minisig file was made with.
+func signatureKeyID(data []byte) (string, error) {
+	return minisignKeyID(minisignPayloadLine(data), 74)
+}
+
+// minisignPayloadLine returns the first line that is not a comment.
+func minisignPayloadLine(data []byte) string {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		l := strings.TrimSpace(sc.Text())
+		if l == "" || strings.HasPrefix(l, "untrusted comment:") || strings.HasPrefix(l, "trusted comment:") {
+			continue
+		}
+		return l
+	}
+	return ""
+}
+
+func (kr *keyring) find(ref string) *signer {
+	for _, s := range kr.Signers {
+		if s.Name == ref || s.Fingerprint == strings.ToUpper(ref) {
+			return s
+		}
+	}
+	return nil
+}
+
+// usable reports why s may not sign bundles at time now, if at all.
+func (s *signer) usable(now time.Time) error {
+	if s.Revoked != "" {
+		return fmt.Errorf("%w: %s", ErrSignerRevoked, s.Name)
+	}
+	if s.Expires != "" {
+		exp, err := time.Parse(time.RFC3339, s.Expires)
+		if err != nil || !now.Before(exp) {
+			return fmt.Errorf("%w: %s", ErrSignerExpired, s.Name)
+		}
+	}
+	return nil
+}
+
+// allows reports whether s may send bundles for iface.
+func (s *signer) allows(iface string) error {
+	if len(s.Interfaces) == 0 || contains(s.Interfaces, iface) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s may not send bundles for %s", ErrSignerNotAllowed, s.Name, iface)
+}
+
+// trustedSigners returns the keyring.
+func trustedSigners() (*keyring, error) {
+	keyringMu.Lock()
+	defer keyringMu.Unlock()
+	return loadKeyring()
+}
+
+// verifySignature picks the signer named by the key id in sig and checks the
+// signature of path against it.
+func verifySignature(path, sig string) (*signer, error) {
+	data, err := os.ReadFile(sig)
+	if err != nil {
+		return nil, ErrMissingSignature
+	}
+	id, err := signatureKeyID(data)
+	if err != nil {
+		return nil, ErrSignatureInvalid
+	}
+	kr, err := trustedSigners()
+	if err != nil {
+		return nil, err
+	}
+	s := kr.find(id)
+	if s == nil || s.Fingerprint != id {
+		return nil, fmt.Errorf("%w: key id %s", ErrUnknownSigner, id)
+	}
+	if err := s.usable(time.Now()); err != nil {
+		return nil, err
+	}
+	msg, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyData(s.PublicKey, msg, data); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func listSigners() ([]*signer, error) {
+	kr, err := trustedSigners()
+	if err != nil {
+		return nil, err
+	}
+	return kr.Signers, nil
+}
+
+// addSigner adds a trusted key. The fingerprint is derived from the key, so
+// callers cannot register a key under a different id.
+func addSigner(s signer) (*signer, error) {
+	s.Name = strings.TrimSpace(s.Name)
+	if !nodeNameRx.MatchString(s.Name) {
+		return nil, fmt.Errorf("%w: invalid signer name", ErrValidation)
+	}
+	line, id, err := publicKeyFingerprint(s.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	s.PublicKey, s.Fingerprint = line, id
+	if s.Interfaces == nil {
+		s.Interfaces = []string{}
+	}
+	for _, iface := range s.Interfaces {
+		if !ifaceRx.MatchString(iface) {
+			return nil, fmt.Errorf("%w: invalid interface name %s", ErrValidation, iface)
+		}
+	}
+	if s.Expires != "" {
+		if _, err := time.Parse(time.RFC3339, s.Expires); err != nil {
+			return nil, fmt.Errorf("%w: expires must be an RFC 3339 time", ErrValidation)
+		}
+	}
+	s.Added = time.Now().UTC().Format(time.RFC3339)
+	s.Revoked, s.RevokedReason = "", ""
+
+	keyringMu.Lock()
+	defer keyringMu.Unlock()
+	kr, err := loadKeyring()
+	if err != nil {
+		return nil, err
+	}
+	for _, old := range kr.Signers {
+		if old.Name == s.Name || old.Fingerprint == s.Fingerprint {
+			return nil, fmt.Errorf("%w: signer %s already exists", ErrValidation, old.Name)
+		}
+	}
+	kr.Signers = append(kr.Signers, &s)
+	sort.Slice(kr.Signers, func(i, j int) bool { return kr.Signers[i].Name < kr.Signers[j].Name })
+	if err := saveKeyring(kr); err != nil {
+		return nil, err
+	}
+	params, _ := json.Marshal(map[string]string{"name": s.Name, "fingerprint": s.Fingerprint})
+	auditLog("AddSigner", params, nil)
+	return &s, nil
+}
+
+// revokeSigner marks a signer as revoked. Revoked signers stay in the
+// keyring so that later bundles from the same key are reported as revoked
+// rather than unknown.
+func revokeSigner(ref, reason string) (*signer, error) {
+	keyringMu.Lock()
+	defer keyringMu.Unlock()
+	kr, err := loadKeyring()
+	if err != nil {
+		return nil, err
+	}
+	s := kr.find(ref)
+	if s == nil {
+		return nil, fmt.Errorf("%w: unknown signer %s", ErrValidation, ref)
+	}
+	if s.Revoked == "" {
+		s.Revoked = time.Now().UTC().Format(time.RFC3339)
+		s.RevokedReason = reason
+	}
+	if err := saveKeyring(kr); err != nil {
+		return nil, err
+	}
+	params, _ := json.Marshal(map[string]string{"name": s.Name, "fingerprint": s.Fingerprint, "reason": reason})
+	auditLog("RevokeSigner", params, nil)
+	return s, nil
+}
+
+func removeSigner(ref string) (interface{}, error) {
+	keyringMu.Lock()
+	defer keyringMu.Unlock()
+	kr, err := loadKeyring()
+	if err != nil {
+		return nil, err
+	}
+	s := kr.find(ref)
+	if s == nil {
+		return nil, fmt.Errorf("%w: unknown signer %s", ErrValidation, ref)
+	}
+	out := kr.Signers[:0]
+	for _, o := range kr.Signers {
+		if o != s {
+			out = append(out, o)
+		}
+	}
+	kr.Signers = out
+	if err := saveKeyring(kr); err != nil {
+		return nil, err
+	}
+	params, _ := json.Marshal(map[string]string{"name": s.Name, "fingerprint": s.Fingerprint})
+	auditLog("RemoveSigner", params, nil)
+	return map[string]string{"status": "ok"}, nil
+}
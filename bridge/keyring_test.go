@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+)
+
+func testMinisignLine(alg string, size int) string {
+	b := make([]byte, size)
+	copy(b, alg)
+	copy(b[2:], []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func TestPublicKeyFingerprint(t *testing.T) {
+	pub := "untrusted comment: minisign public key 0807060504030201\n" + testMinisignLine("Ed", 42) + "\n"
+	line, id, err := publicKeyFingerprint(pub)
+	if err != nil {
+		t.Fatalf("publicKeyFingerprint: %v", err)
+	}
+	if id != "0807060504030201" || line != testMinisignLine("Ed", 42) {
+		t.Fatalf("unexpected key id %s / line %s", id, line)
+	}
+	if _, _, err := publicKeyFingerprint(testMinisignLine("Ed", 74)); !errors.Is(err, ErrValidation) {
+		t.Fatalf("expected signature line to be rejected as key, got %v", err)
+	}
+
+	sig := "untrusted comment: signature\n" + testMinisignLine("ED", 74) + "\ntrusted comment: x\nAAAA\n"
+	if id, err := signatureKeyID([]byte(sig)); err != nil || id != "0807060504030201" {
+		t.Fatalf("unexpected signature key id %s: %v", id, err)
+	}
+}
+
+func TestSignerChecks(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := &signer{Name: "hq", Interfaces: []string{"wg0"}}
+	if err := s.usable(now); err != nil {
+		t.Fatalf("expected usable signer, got %v", err)
+	}
+	if err := s.allows("wg0"); err != nil {
+		t.Fatalf("expected wg0 allowed, got %v", err)
+	}
+	if err := s.allows("wg1"); !errors.Is(err, ErrSignerNotAllowed) || bundleReason(err) != "signer_not_allowed" {
+		t.Fatalf("expected signer_not_allowed, got %v", err)
+	}
+
+	s.Expires = "2023-12-31T00:00:00Z"
+	if err := s.usable(now); !errors.Is(err, ErrSignerExpired) {
+		t.Fatalf("expected expired signer, got %v", err)
+	}
+	s.Revoked = "2023-06-01T00:00:00Z"
+	if err := s.usable(now); !errors.Is(err, ErrSignerRevoked) || bundleReason(err) != "signer_revoked" {
+		t.Fatalf("expected revoked signer, got %v", err)
+	}
+}
+
+func TestKeyringFind(t *testing.T) {
+	kr := &keyring{Signers: []*signer{{Name: "hq", Fingerprint: "0807060504030201"}}}
+	if kr.find("hq") == nil || kr.find("0807060504030201") == nil || kr.find("0807060504030201"[:4]) != nil {
+		t.Fatal("unexpected keyring lookup result")
+	}
+}
+
+func TestMigrateLegacySigner(t *testing.T) {
+	pub := []byte("untrusted comment: minisign public key 0807060504030201\n" + testMinisignLine("Ed", 42) + "\n")
+	kr := &keyring{Signers: []*signer{{Name: "hq", Fingerprint: "1111111111111111"}}}
+	migrateLegacySigner(kr, pub, time.Now())
+	if !kr.LegacyMigrated || len(kr.Signers) != 2 || kr.find("legacy") == nil || kr.find("0807060504030201") == nil {
+		t.Fatalf("legacy key not migrated: %+v", kr)
+	}
+
+	// A key already in the keyring is not added twice
+	kr = &keyring{Signers: []*signer{{Name: "hq", Fingerprint: "0807060504030201"}}}
+	migrateLegacySigner(kr, pub, time.Now())
+	if !kr.LegacyMigrated || len(kr.Signers) != 1 {
+		t.Fatalf("unexpected keyring %+v", kr)
+	}
+
+	// An unreadable key is only marked migrated
+	kr = &keyring{Signers: []*signer{}}
+	migrateLegacySigner(kr, []byte("garbage"), time.Now())
+	if !kr.LegacyMigrated || len(kr.Signers) != 0 {
+		t.Fatalf("unexpected keyring %+v", kr)
+	}
+}
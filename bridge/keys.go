@@ -4,9 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,35 +18,19 @@ const (
 	signingPubKey   = keyDir + "/signing.pub"
 )
 
+// ensureKeys creates missing keys on startup. Failures are logged; the
+// details are available through GetKeyStatus.
 func ensureKeys() {
-	if err := os.MkdirAll(keyDir, 0700); err != nil {
-		auditLog("EnsureKeys", json.RawMessage(fmt.Sprintf("{\"error\":\"%v\"}", err)), err)
+	unlock, err := lockKeys()
+	if err != nil {
+		auditLog("GenerateKeys", json.RawMessage("{}"), err)
 		return
 	}
-	generated := false
-	if _, err := os.Stat(exchangePrivKey); os.IsNotExist(err) {
-		if err := exec.Command("age-keygen", "-o", exchangePrivKey).Run(); err == nil {
-			os.Chmod(exchangePrivKey, 0600)
-			os.Chown(exchangePrivKey, 0, 0)
-			cmd := exec.Command("age-keygen", "-y", exchangePrivKey)
-			if out, err := cmd.Output(); err == nil {
-				os.WriteFile(exchangePubKey, out, 0600)
-				os.Chown(exchangePubKey, 0, 0)
-			}
-			generated = true
-		}
-	}
-	if _, err := os.Stat(signingPrivKey); os.IsNotExist(err) {
-		if err := exec.Command("minisign", "-G", "-s", signingPrivKey, "-p", signingPubKey, "-n").Run(); err == nil {
-			os.Chmod(signingPrivKey, 0600)
-			os.Chown(signingPrivKey, 0, 0)
-			os.Chmod(signingPubKey, 0600)
-			os.Chown(signingPubKey, 0, 0)
-			generated = true
-		}
-	}
-	if generated {
-		auditLog("GenerateKeys", json.RawMessage("{}"), nil)
+	defer unlock()
+	actions, err := repairKeyDir(keyDir)
+	if err != nil || len(actions) > 0 {
+		params, _ := json.Marshal(map[string]interface{}{"actions": actions})
+		auditLog("GenerateKeys", params, err)
 	}
 }
 
@@ -58,63 +42,171 @@ func getExchangeKey() (string, error) {
 	return strings.TrimSpace(string(b)), nil
 }
 
+// keyFiles are the files making up one key generation in keyDir.
+var keyFiles = []string{"exchange.key", "exchange.pub", "signing.key", "signing.pub"}
+
+// keysMu serializes changes to keyDir within the bridge; lockKeys also
+// takes a file lock shared with the rotation timer.
+var keysMu sync.Mutex
+
+func lockKeys() (func(), error) {
+	keysMu.Lock()
+	lockDir := "/run/cockpit-wg/locks"
+	if err := os.MkdirAll(lockDir, 0755); err != nil {
+		keysMu.Unlock()
+		return nil, err
+	}
+	lockFile, err := os.OpenFile(filepath.Join(lockDir, "keys.lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		keysMu.Unlock()
+		return nil, err
+	}
+	if err := lockFileDescriptor(int(lockFile.Fd())); err != nil {
+		lockFile.Close()
+		keysMu.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlockFileDescriptor(int(lockFile.Fd()))
+		lockFile.Close()
+		keysMu.Unlock()
+	}, nil
+}
+
+// keyRename is os.Rename, replaced in tests to simulate failures while
+// keys are swapped or a backup is restored.
+var keyRename = os.Rename
+
 func rotateKeys() (string, error) {
-	ts := time.Now().Format("20060102150405")
-	for _, f := range []string{exchangePrivKey, exchangePubKey, signingPrivKey, signingPubKey} {
-		if _, err := os.Stat(f); err == nil {
-			os.Rename(f, f+"."+ts)
+	unlock, err := lockKeys()
+	if err != nil {
+		return "", err
+	}
+	newPub, announcement, err := rotateKeysLocked("manual")
+	unlock()
+	deliverAnnouncement(announcement)
+	return newPub, err
+}
+
+// rotateKeysLocked replaces both key pairs, archiving the current ones with
+// a timestamp suffix, and seals the announcement telling known nodes about
+// the new keys. The announcement is returned rather than sent so that the
+// caller can deliver it with deliverAnnouncement once the keys are
+// unlocked. trigger records whether an operator or the schedule asked for
+// the rotation.
+func rotateKeysLocked(trigger string) (string, string, error) {
+	now := time.Now()
+	ts := now.Format(archiveTimeFormat)
+	params := json.RawMessage(fmt.Sprintf("{\"timestamp\":\"%s\",\"trigger\":\"%s\"}", ts, trigger))
+	newPub, err := swapKeys(keyDir, ts)
+	recordRotation(keyRotationFile, trigger, now, err)
+	if err != nil {
+		auditLog("RotateKeys", params, err)
+		return "", "", err
+	}
+	// Known nodes learn the new keys from a bundle signed with the old one.
+	var announcement string
+	if _, err := os.Stat(signingPrivKey + "." + ts); err == nil {
+		if announcement, err = announceRotation(signingPrivKey+"."+ts, signingPubKey+"."+ts); err != nil {
+			auditLog("AnnounceKeys", params, err)
+		}
+	}
+	// Retired exchange keys are kept until the bundles sealed for them have
+	// left the inbox.
+	if policy, err := loadKeyPolicy(keyPolicyFile); err == nil && inboxDrained(inboxDir) {
+		pruneKeyArchive(keyDir, policy.Retain)
+	}
+	auditLog("RotateKeys", params, nil)
+	return newPub, announcement, nil
+}
+
+// swapKeys generates a new key set in a staging directory inside dir and
+// moves it into place, archiving the current keys with suffix ts. On any
+// failure the previous keys are restored and the new ones discarded.
+func swapKeys(dir, ts string) (string, error) {
+	for _, name := range keyFiles {
+		if _, err := os.Stat(filepath.Join(dir, name+"."+ts)); err == nil {
+			return "", fmt.Errorf("%w: keys were already rotated at %s", ErrValidation, ts)
 		}
 	}
-	oldPriv := exchangePrivKey + "." + ts
-	if err := exec.Command("age-keygen", "-o", exchangePrivKey).Run(); err != nil {
+	stage, err := os.MkdirTemp(dir, ".rotate-")
+	if err != nil {
 		return "", err
 	}
-	os.Chmod(exchangePrivKey, 0600)
-	os.Chown(exchangePrivKey, 0, 0)
-	pubOut, err := exec.Command("age-keygen", "-y", exchangePrivKey).Output()
+	defer os.RemoveAll(stage)
+	newPub, err := generateExchangeKey(filepath.Join(stage, "exchange.key"), filepath.Join(stage, "exchange.pub"))
 	if err != nil {
 		return "", err
 	}
-	os.WriteFile(exchangePubKey, pubOut, 0600)
-	os.Chown(exchangePubKey, 0, 0)
-	if err := exec.Command("minisign", "-G", "-s", signingPrivKey, "-p", signingPubKey, "-n").Run(); err != nil {
+	if _, err := generateSigningKey(filepath.Join(stage, "signing.key"), filepath.Join(stage, "signing.pub")); err != nil {
 		return "", err
 	}
-	os.Chmod(signingPrivKey, 0600)
-	os.Chown(signingPrivKey, 0, 0)
-	os.Chmod(signingPubKey, 0600)
-	os.Chown(signingPubKey, 0, 0)
-	reencryptInbox(oldPriv, strings.TrimSpace(string(pubOut)))
-	auditLog("RotateKeys", json.RawMessage(fmt.Sprintf("{\"timestamp\":\"%s\"}", ts)), nil)
-	return strings.TrimSpace(string(pubOut)), nil
+	for _, name := range keyFiles {
+		os.Chown(filepath.Join(stage, name), 0, 0)
+	}
+	var archived, installed []string
+	rollback := func() {
+		for _, name := range installed {
+			os.Remove(filepath.Join(dir, name))
+		}
+		for _, name := range archived {
+			keyRename(filepath.Join(dir, name+"."+ts), filepath.Join(dir, name))
+		}
+	}
+	for _, name := range keyFiles {
+		cur := filepath.Join(dir, name)
+		if _, err := os.Stat(cur); err == nil {
+			if err := keyRename(cur, cur+"."+ts); err != nil {
+				rollback()
+				return "", err
+			}
+			archived = append(archived, name)
+		}
+		if err := keyRename(filepath.Join(stage, name), cur); err != nil {
+			rollback()
+			return "", err
+		}
+		installed = append(installed, name)
+	}
+	return newPub, nil
 }
 
-func reencryptInbox(oldPriv, newPub string) {
-	entries, err := os.ReadDir(inboxDir)
+// exchangeKeyFiles returns the exchange key in dir followed by the archived
+// ones, newest first. Bundles stay in the inbox as they arrived across a
+// rotation, since their signature covers the ciphertext, and are opened
+// with the retired key they were sealed for.
+func exchangeKeyFiles(dir string) []string {
+	files := []string{filepath.Join(dir, "exchange.key")}
+	gens, err := keyArchive(dir)
 	if err != nil {
-		return
+		return files
 	}
-	for _, e := range entries {
-		if e.IsDir() || !strings.HasSuffix(e.Name(), ".wgx") {
-			continue
-		}
-		path := filepath.Join(inboxDir, e.Name())
-		tmp := path + ".tmp"
-		dec := exec.Command("age", "-d", "-i", oldPriv, "-o", tmp, path)
-		if err := dec.Run(); err != nil {
-			os.Remove(tmp)
-			continue
+	for _, g := range gens {
+		name := "exchange.key." + g.Timestamp
+		for _, f := range g.Files {
+			if f == name {
+				files = append(files, filepath.Join(dir, name))
+			}
 		}
-		enc := exec.Command("age", "-r", newPub, "-o", path, tmp)
-		enc.Run()
-		os.Remove(tmp)
 	}
+	return files
 }
 
-func getSigningFingerprint() (string, error) {
-	out, err := exec.Command("minisign", "-F", "-p", signingPubKey).Output()
+// inboxDrained reports whether no bundle waits in dir.
+func inboxDrained(dir string) bool {
+	entries, err := os.ReadDir(dir)
 	if err != nil {
-		return "", err
+		return true
 	}
-	return strings.TrimSpace(string(out)), nil
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".wgx") {
+			return false
+		}
+	}
+	return true
+}
+
+func getSigningFingerprint() (string, error) {
+	_, id, err := readPublicKeyFile(signingPubKey)
+	return id, err
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// keyRotationFile records the outcome of the last rotation attempt.
+const keyRotationFile = "/var/lib/cockpit-wg/key-rotation.json"
+
+// keyRotationCheck is how often a running bridge checks the schedule.
+const keyRotationCheck = time.Hour
+
+type rotationState struct {
+	LastRotation string `json:"lastRotation,omitempty"`
+	LastAttempt  string `json:"lastAttempt,omitempty"`
+	LastError    string `json:"lastError,omitempty"`
+	Trigger      string `json:"trigger,omitempty"`
+}
+
+func loadRotationState(path string) (*rotationState, error) {
+	st := &rotationState{}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return st, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// recordRotation stores the result of a rotation attempt. Failures to
+// record are logged only; they must not undo a completed rotation.
+func recordRotation(path, trigger string, at time.Time, rotateErr error) {
+	st, err := loadRotationState(path)
+	if err != nil {
+		st = &rotationState{}
+	}
+	st.LastAttempt = at.UTC().Format(time.RFC3339)
+	st.Trigger = trigger
+	st.LastError = ""
+	if rotateErr != nil {
+		st.LastError = rotateErr.Error()
+	} else {
+		st.LastRotation = st.LastAttempt
+	}
+	b, _ := json.MarshalIndent(st, "", "  ")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err == nil {
+		tmp := path + ".tmp"
+		if err = os.WriteFile(tmp, b, 0600); err == nil {
+			err = os.Rename(tmp, path)
+		}
+		if err == nil {
+			return
+		}
+	}
+	auditLog("RecordKeyRotation", json.RawMessage("{}"), err)
+}
+
+// lastKeyRotation returns when the current keys were put in place: the
+// recorded rotation, else the newest archived generation, else the creation
+// of the exchange key.
+func lastKeyRotation(dir string, st *rotationState) time.Time {
+	if t, err := time.Parse(time.RFC3339, st.LastRotation); err == nil {
+		return t
+	}
+	if gens, err := keyArchive(dir); err == nil && len(gens) > 0 {
+		if t, err := time.Parse(time.RFC3339, gens[0].Retired); err == nil {
+			return t
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, inspectKeyFile(dir, "exchange.key").Created); err == nil {
+		return t
+	}
+	return time.Time{}
+}
+
+// keySchedule is returned by GetKeyRotation.
+type keySchedule struct {
+	RotateDays   int    `json:"rotateDays"`
+	LastRotation string `json:"lastRotation,omitempty"`
+	NextRotation string `json:"nextRotation,omitempty"`
+	Due          bool   `json:"due"`
+	LastAttempt  string `json:"lastAttempt,omitempty"`
+	LastError    string `json:"lastError,omitempty"`
+	Trigger      string `json:"trigger,omitempty"`
+}
+
+func keyRotationSchedule(dir string, policy *keyPolicy, st *rotationState, now time.Time) *keySchedule {
+	s := &keySchedule{
+		RotateDays:  policy.RotateDays,
+		LastAttempt: st.LastAttempt,
+		LastError:   st.LastError,
+		Trigger:     st.Trigger,
+	}
+	last := lastKeyRotation(dir, st)
+	if !last.IsZero() {
+		s.LastRotation = last.UTC().Format(time.RFC3339)
+	}
+	if policy.RotateDays == 0 {
+		return s
+	}
+	next := last.Add(time.Duration(policy.RotateDays) * 24 * time.Hour)
+	if last.IsZero() {
+		next = now
+	}
+	s.NextRotation = next.UTC().Format(time.RFC3339)
+	s.Due = !now.Before(next)
+	return s
+}
+
+func getKeyRotation() (*keySchedule, error) {
+	policy, err := loadKeyPolicy(keyPolicyFile)
+	if err != nil {
+		return nil, err
+	}
+	st, err := loadRotationState(keyRotationFile)
+	if err != nil {
+		return nil, err
+	}
+	return keyRotationSchedule(keyDir, policy, st, time.Now()), nil
+}
+
+// rotateKeysIfDue rotates the keys when the schedule says so. It is run
+// periodically by the bridge and by the cockpit-wg-key-rotation timer.
+func rotateKeysIfDue() (*keySchedule, error) {
+	unlock, err := lockKeys()
+	if err != nil {
+		return nil, err
+	}
+	s, err := getKeyRotation()
+	if err != nil || !s.Due {
+		unlock()
+		return s, err
+	}
+	_, announcement, err := rotateKeysLocked("schedule")
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+	deliverAnnouncement(announcement)
+	return getKeyRotation()
+}
+
+// scheduleKeyRotation checks the rotation schedule while the bridge runs.
+func scheduleKeyRotation() {
+	for {
+		rotateKeysIfDue()
+		time.Sleep(keyRotationCheck)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyRotationSchedule(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	st := &rotationState{LastRotation: "2024-03-01T12:00:00Z"}
+
+	s := keyRotationSchedule(dir, &keyPolicy{}, st, now)
+	if s.Due || s.NextRotation != "" || s.LastRotation != "2024-03-01T12:00:00Z" {
+		t.Fatalf("unscheduled rotation reported as %+v", s)
+	}
+	s = keyRotationSchedule(dir, &keyPolicy{RotateDays: 90}, st, now)
+	if !s.Due || s.NextRotation != "2024-05-30T12:00:00Z" {
+		t.Fatalf("expected rotation due since 2024-05-30, got %+v", s)
+	}
+	s = keyRotationSchedule(dir, &keyPolicy{RotateDays: 120}, st, now)
+	if s.Due || s.NextRotation != "2024-06-29T12:00:00Z" {
+		t.Fatalf("expected rotation on 2024-06-29, got %+v", s)
+	}
+
+	// without recorded state the newest archived generation counts
+	os.WriteFile(filepath.Join(dir, "exchange.key.20240520120000"), []byte("x"), 0600)
+	s = keyRotationSchedule(dir, &keyPolicy{RotateDays: 30}, &rotationState{}, now)
+	if s.Due || s.LastRotation == "" {
+		t.Fatalf("expected archive time to count as last rotation, got %+v", s)
+	}
+}
+
+func TestRecordRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key-rotation.json")
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	recordRotation(path, "schedule", at, nil)
+	recordRotation(path, "manual", at.Add(time.Hour), errors.New("disk full"))
+	st, err := loadRotationState(path)
+	if err != nil {
+		t.Fatalf("loadRotationState: %v", err)
+	}
+	if st.LastRotation != "2024-01-01T00:00:00Z" || st.LastAttempt != "2024-01-01T01:00:00Z" || st.LastError != "disk full" || st.Trigger != "manual" {
+		t.Fatalf("unexpected state %+v", st)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+)
+
+// archiveSuffixRx matches the timestamp rotateKeys appends to retired keys.
+var archiveSuffixRx = regexp.MustCompile(`^\.(\d{14})$`)
+
+const archiveTimeFormat = "20060102150405"
+
+// keyFileStatus describes one file in the key directory.
+type keyFileStatus struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Present bool   `json:"present"`
+	Mode    string `json:"mode,omitempty"`
+	UID     uint32 `json:"uid"`
+	GID     uint32 `json:"gid"`
+	// Secure is false when the file is readable by anyone but root.
+	Secure      bool          `json:"secure"`
+	Fingerprint string        `json:"fingerprint,omitempty"`
+	Created     string        `json:"created,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	Archived    []archivedKey `json:"archived"`
+}
+
+type archivedKey struct {
+	File    string `json:"file"`
+	Retired string `json:"retired"`
+}
+
+type keyStatus struct {
+	Healthy  bool             `json:"healthy"`
+	Problems []string         `json:"problems"`
+	Keys     []*keyFileStatus `json:"keys"`
+}
+
+func getKeyStatus() (*keyStatus, error) {
+	return inspectKeys(keyDir), nil
+}
+
+// inspectKeys reports on the exchange and signing key pairs in dir.
+func inspectKeys(dir string) *keyStatus {
+	st := &keyStatus{Problems: []string{}, Keys: []*keyFileStatus{}}
+	byName := map[string]*keyFileStatus{}
+	for _, name := range keyFiles {
+		k := inspectKeyFile(dir, name)
+		byName[name] = k
+		st.Keys = append(st.Keys, k)
+		switch {
+		case !k.Present:
+			st.Problems = append(st.Problems, name+" is missing")
+		case k.Error != "":
+			st.Problems = append(st.Problems, name+": "+k.Error)
+		case !k.Secure:
+			st.Problems = append(st.Problems, fmt.Sprintf("%s has mode %s and owner %d:%d", name, k.Mode, k.UID, k.GID))
+		}
+	}
+	for _, pair := range [][2]string{{"exchange.key", "exchange.pub"}, {"signing.key", "signing.pub"}} {
+		priv, pub := byName[pair[0]], byName[pair[1]]
+		if priv.Fingerprint != "" && pub.Fingerprint != "" && priv.Fingerprint != pub.Fingerprint {
+			st.Problems = append(st.Problems, pair[1]+" does not match "+pair[0])
+		}
+	}
+	st.Healthy = len(st.Problems) == 0
+	return st
+}
+
+func inspectKeyFile(dir, name string) *keyFileStatus {
+	path := filepath.Join(dir, name)
+	k := &keyFileStatus{Name: name, Path: path, Archived: archivedKeys(dir, name)}
+	info, err := os.Stat(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			k.Error = err.Error()
+		}
+		return k
+	}
+	k.Present = true
+	k.Mode = fmt.Sprintf("%04o", info.Mode().Perm())
+	k.UID, k.GID, _ = fileOwner(info)
+	k.Secure = info.Mode().Perm()&0077 == 0 && k.UID == 0
+	k.Created = info.ModTime().UTC().Format(time.RFC3339)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		k.Error = err.Error()
+		return k
+	}
+	if created := ageKeyCreated(data); created != "" {
+		k.Created = created
+	}
+	fp, err := keyFingerprint(name, data)
+	if err != nil {
+		k.Error = err.Error()
+	}
+	k.Fingerprint = fp
+	return k
+}
+
+// keyFingerprint identifies a key: exchange keys by their age recipient,
+// signing keys by their minisign key id.
+func keyFingerprint(name string, data []byte) (string, error) {
+	switch name {
+	case "exchange.key":
+		return exchangeRecipient(data)
+	case "exchange.pub":
+		r := strings.TrimSpace(string(data))
+		if !ageRecipientRx.MatchString(r) {
+			return "", fmt.Errorf("%w: not an age recipient", ErrExchangeKey)
+		}
+		return r, nil
+	case "signing.key":
+		k, err := parseSigningKey(data)
+		if err != nil {
+			return "", err
+		}
+		return k.fingerprint(), nil
+	default:
+		_, id, err := publicKeyFingerprint(string(data))
+		return id, err
+	}
+}
+
+func exchangeRecipient(data []byte) (string, error) {
+	ids, err := age.ParseIdentities(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrExchangeKey, err)
+	}
+	id, ok := ids[0].(*age.X25519Identity)
+	if !ok || len(ids) != 1 {
+		return "", fmt.Errorf("%w: expected a single X25519 identity", ErrExchangeKey)
+	}
+	return id.Recipient().String(), nil
+}
+
+// ageKeyCreated returns the "# created:" comment age-keygen writes.
+func ageKeyCreated(data []byte) string {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), "# created: "); ok {
+			if t, err := time.Parse(time.RFC3339, strings.TrimSpace(v)); err == nil {
+				return t.UTC().Format(time.RFC3339)
+			}
+		}
+	}
+	return ""
+}
+
+// archivedKeys lists the retired generations of name, newest first.
+func archivedKeys(dir, name string) []archivedKey {
+	out := []archivedKey{}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return out
+	}
+	for _, e := range entries {
+		suffix, ok := strings.CutPrefix(e.Name(), name)
+		if !ok || e.IsDir() {
+			continue
+		}
+		m := archiveSuffixRx.FindStringSubmatch(suffix)
+		if m == nil {
+			continue
+		}
+		a := archivedKey{File: e.Name()}
+		if t, err := time.ParseInLocation(archiveTimeFormat, m[1], time.Local); err == nil {
+			a.Retired = t.UTC().Format(time.RFC3339)
+		}
+		out = append(out, a)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].File > out[j].File })
+	return out
+}
+
+// repairKeys regenerates missing key pairs, restores missing public keys
+// from their private halves and resets ownership and permissions.
+func repairKeys() (*keyStatus, error) {
+	unlock, err := lockKeys()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	actions, err := repairKeyDir(keyDir)
+	params, _ := json.Marshal(map[string]interface{}{"actions": actions})
+	auditLog("RepairKeys", params, err)
+	if err != nil {
+		return nil, err
+	}
+	return inspectKeys(keyDir), nil
+}
+
+func repairKeyDir(dir string) ([]string, error) {
+	actions := []string{}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return actions, err
+	}
+	exPriv, exPub := filepath.Join(dir, "exchange.key"), filepath.Join(dir, "exchange.pub")
+	if _, err := os.Stat(exPriv); os.IsNotExist(err) {
+		if _, err := generateExchangeKey(exPriv, exPub); err != nil {
+			return actions, err
+		}
+		actions = append(actions, "generated exchange key")
+	} else if _, err := os.Stat(exPub); os.IsNotExist(err) {
+		data, err := os.ReadFile(exPriv)
+		if err != nil {
+			return actions, err
+		}
+		r, err := exchangeRecipient(data)
+		if err != nil {
+			return actions, err
+		}
+		if err := os.WriteFile(exPub, []byte(r+"\n"), 0600); err != nil {
+			return actions, err
+		}
+		actions = append(actions, "restored exchange.pub")
+	}
+	sigPriv, sigPub := filepath.Join(dir, "signing.key"), filepath.Join(dir, "signing.pub")
+	if _, err := os.Stat(sigPriv); os.IsNotExist(err) {
+		if _, err := generateSigningKey(sigPriv, sigPub); err != nil {
+			return actions, err
+		}
+		actions = append(actions, "generated signing key")
+	} else if _, err := os.Stat(sigPub); os.IsNotExist(err) {
+		k, err := readSigningKey(sigPriv)
+		if err != nil {
+			return actions, err
+		}
+		if err := os.WriteFile(sigPub, []byte(k.publicKey()), 0600); err != nil {
+			return actions, err
+		}
+		actions = append(actions, "restored signing.pub")
+	}
+	for _, name := range keyFiles {
+		path := filepath.Join(dir, name)
+		info, err := os.Stat(path)
+		if err != nil {
+			return actions, err
+		}
+		uid, gid, ok := fileOwner(info)
+		if info.Mode().Perm() == 0600 && ok && uid == 0 && gid == 0 {
+			continue
+		}
+		if err := os.Chmod(path, 0600); err != nil {
+			return actions, err
+		}
+		if err := os.Chown(path, 0, 0); err != nil {
+			return actions, err
+		}
+		actions = append(actions, "fixed permissions of "+name)
+	}
+	return actions, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRepairAndInspectKeys(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("key ownership checks need root")
+	}
+	dir := t.TempDir()
+	st := inspectKeys(dir)
+	if st.Healthy || len(st.Problems) != 4 {
+		t.Fatalf("expected four missing keys, got %+v", st.Problems)
+	}
+
+	actions, err := repairKeyDir(dir)
+	if err != nil {
+		t.Fatalf("repairKeyDir: %v", err)
+	}
+	if len(actions) != 2 {
+		t.Fatalf("expected both key pairs generated, got %v", actions)
+	}
+	st = inspectKeys(dir)
+	if !st.Healthy {
+		t.Fatalf("expected healthy keys after repair, got %v", st.Problems)
+	}
+	for _, k := range st.Keys {
+		if !k.Present || !k.Secure || k.Fingerprint == "" || k.Created == "" || k.Mode != "0600" {
+			t.Fatalf("unexpected status %+v", k)
+		}
+	}
+
+	// a lost public key is restored from the private one
+	before := st.Keys[3].Fingerprint
+	os.Remove(filepath.Join(dir, "signing.pub"))
+	os.Chmod(filepath.Join(dir, "exchange.key"), 0644)
+	if st := inspectKeys(dir); st.Healthy || len(st.Problems) != 2 {
+		t.Fatalf("expected missing signing.pub and insecure exchange.key, got %v", st.Problems)
+	}
+	if actions, err = repairKeyDir(dir); err != nil || len(actions) != 2 {
+		t.Fatalf("repairKeyDir: %v %v", actions, err)
+	}
+	st = inspectKeys(dir)
+	if !st.Healthy || st.Keys[3].Fingerprint != before {
+		t.Fatalf("signing.pub not restored: %+v %v", st.Keys[3], st.Problems)
+	}
+}
+
+func TestInspectKeysMismatchAndArchive(t *testing.T) {
+	dir := t.TempDir()
+	generateSigningKey(filepath.Join(dir, "signing.key"), filepath.Join(dir, "signing.pub"))
+	generateSigningKey(filepath.Join(dir, "other.key"), filepath.Join(dir, "other.pub"))
+	os.Rename(filepath.Join(dir, "signing.pub"), filepath.Join(dir, "signing.pub.20240101120000"))
+	os.Rename(filepath.Join(dir, "other.pub"), filepath.Join(dir, "signing.pub"))
+	os.WriteFile(filepath.Join(dir, "signing.pub.tmp"), nil, 0600)
+
+	st := inspectKeys(dir)
+	found := false
+	for _, p := range st.Problems {
+		found = found || strings.Contains(p, "signing.pub does not match signing.key")
+	}
+	if !found {
+		t.Fatalf("expected key pair mismatch, got %v", st.Problems)
+	}
+	archived := st.Keys[3].Archived
+	if len(archived) != 1 || archived[0].File != "signing.pub.20240101120000" || archived[0].Retired == "" {
+		t.Fatalf("unexpected archive %+v", archived)
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -18,15 +17,32 @@ import (
 
 	"github.com/coreos/go-systemd/v22/journal"
 	"golang.zx2c4.com/wireguard/wgctrl"
+
+	"wg-bridge/internal/config"
 )
 
 var sensitiveRx = regexp.MustCompile(`(?i)(PrivateKey|PresharedKey)\s*=\s*[^\s]+`)
 
 var actionMap = map[string]string{
-	"InstallPackages": "org.cockpit-project.cockpit-wg.installPackages",
-	"WriteConfig":     "org.cockpit-project.cockpit-wg.writeConfig",
-	"ApplyChanges":    "org.cockpit-project.cockpit-wg.applyChanges",
-	"RotateKeys":      "org.cockpit-project.cockpit-wg.rotateKeys",
+	"InstallPackages":    "org.cockpit-project.cockpit-wg.installPackages",
+	"WriteConfig":        "org.cockpit-project.cockpit-wg.writeConfig",
+	"ApplyChanges":       "org.cockpit-project.cockpit-wg.applyChanges",
+	"RotateKeys":         "org.cockpit-project.cockpit-wg.rotateKeys",
+	"RepairKeys":         "org.cockpit-project.cockpit-wg.rotateKeys",
+	"ImportBundle":       "org.cockpit-project.cockpit-wg.importBundle",
+	"ApplyPending":       "org.cockpit-project.cockpit-wg.applyChanges",
+	"RejectPending":      "org.cockpit-project.cockpit-wg.importBundle",
+	"AddNode":            "org.cockpit-project.cockpit-wg.manageExchange",
+	"RemoveNode":         "org.cockpit-project.cockpit-wg.manageExchange",
+	"AddSigner":          "org.cockpit-project.cockpit-wg.manageExchange",
+	"RevokeSigner":       "org.cockpit-project.cockpit-wg.manageExchange",
+	"RemoveSigner":       "org.cockpit-project.cockpit-wg.manageExchange",
+	"DownloadBundle":     "org.cockpit-project.cockpit-wg.manageExchange",
+	"DeleteOutboxBundle": "org.cockpit-project.cockpit-wg.manageExchange",
+	"DeliverBundle":      "org.cockpit-project.cockpit-wg.manageExchange",
+	"FetchBundles":       "org.cockpit-project.cockpit-wg.manageExchange",
+	"CreateBackup":       "org.cockpit-project.cockpit-wg.manageBackups",
+	"RestoreBackup":      "org.cockpit-project.cockpit-wg.manageBackups",
 }
 
 var allowedMethods = map[string]bool{
@@ -50,8 +66,32 @@ var allowedMethods = map[string]bool{
 	"ListPeers":          true,
 	"GetExchangeKey":     true,
 	"RotateKeys":         true,
+	"GetKeyStatus":       true,
+	"CheckKeyPair":       true,
+	"RepairKeys":         true,
+	"ListKeyArchive":     true,
+	"GetKeyRotation":     true,
+	"CreateBackup":       true,
+	"RestoreBackup":      true,
 	"ExportConfig":       true,
 	"ListInbox":          true,
+	"ImportBundle":       true,
+	"ListPending":        true,
+	"GetPendingDiff":     true,
+	"ApplyPending":       true,
+	"RejectPending":      true,
+	"ListNodes":          true,
+	"AddNode":            true,
+	"RemoveNode":         true,
+	"ListSigners":        true,
+	"AddSigner":          true,
+	"RevokeSigner":       true,
+	"RemoveSigner":       true,
+	"ListOutbox":         true,
+	"DownloadBundle":     true,
+	"DeleteOutboxBundle": true,
+	"DeliverBundle":      true,
+	"FetchBundles":       true,
 }
 
 func authorize(method string) error {
@@ -90,9 +130,20 @@ type response struct {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "--rotate-keys-if-due" {
+		s, err := rotateKeysIfDue()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		json.NewEncoder(os.Stdout).Encode(s)
+		return
+	}
 	ensureKeys()
 	initMetricsCollector()
 	go watchInbox()
+	go pollTransports()
+	go scheduleKeyRotation()
 	scanner := bufio.NewScanner(os.Stdin)
 	writer := bufio.NewWriter(os.Stdout)
 
@@ -132,10 +183,11 @@ func handleRequest(req *request) *response {
 		}
 	case "ValidateConfig":
 		var p struct {
+			Name string `json:"name"`
 			Text string `json:"text"`
 		}
 		if err = json.Unmarshal(req.Params, &p); err == nil {
-			result, err = validateConfig(p.Text)
+			result, err = validateConfig(p.Name, p.Text)
 		}
 	case "ApplyChanges":
 		var p struct {
@@ -237,20 +289,160 @@ func handleRequest(req *request) *response {
 		result, err = getExchangeKey()
 	case "RotateKeys":
 		result, err = rotateKeys()
-	case "ExportConfig":
+	case "GetKeyStatus":
+		result, err = getKeyStatus()
+	case "CheckKeyPair":
 		var p struct {
 			Name      string `json:"name"`
-			Recipient string `json:"recipient"`
+			PublicKey string `json:"publicKey"`
+		}
+		if err = json.Unmarshal(req.Params, &p); err == nil {
+			result, err = checkKeyPair(p.Name, p.PublicKey)
+		}
+	case "RepairKeys":
+		result, err = repairKeys()
+	case "ListKeyArchive":
+		result, err = listKeyArchive()
+	case "GetKeyRotation":
+		result, err = getKeyRotation()
+	case "CreateBackup":
+		var p struct {
+			Passphrase string `json:"passphrase"`
+		}
+		if err = json.Unmarshal(req.Params, &p); err == nil {
+			result, err = createBackup(p.Passphrase)
+		}
+	case "RestoreBackup":
+		var p struct {
+			File       string `json:"file"`
+			Passphrase string `json:"passphrase"`
+			DryRun     bool   `json:"dryRun"`
+		}
+		if err = json.Unmarshal(req.Params, &p); err == nil {
+			result, err = restoreBackup(p.File, p.Passphrase, p.DryRun)
+		}
+	case "ExportConfig":
+		var p struct {
+			Name      string   `json:"name"`
+			Recipient string   `json:"recipient"`
+			Nodes     []string `json:"nodes"`
+			Group     string   `json:"group"`
+			exportOptions
+		}
+		if err = json.Unmarshal(req.Params, &p); err == nil {
+			var recipients []string
+			if recipients, err = exportRecipients(p.Name, p.Recipient, p.Nodes, p.Group); err == nil {
+				var path string
+				path, err = exportBundle(p.Name, recipients, p.exportOptions)
+				if err == nil {
+					result = map[string]interface{}{"path": path, "file": filepath.Base(path), "signature": path + ".minisig", "recipients": len(recipients)}
+				}
+			}
+		}
+	case "ListOutbox":
+		result, err = listOutbox()
+	case "DownloadBundle":
+		var p struct {
+			File   string `json:"file"`
+			Offset int64  `json:"offset"`
+			Length int64  `json:"length"`
+		}
+		if err = json.Unmarshal(req.Params, &p); err == nil {
+			result, err = downloadBundle(p.File, p.Offset, p.Length)
+		}
+	case "DeleteOutboxBundle":
+		var p struct {
+			File string `json:"file"`
+		}
+		if err = json.Unmarshal(req.Params, &p); err == nil {
+			result, err = deleteOutboxBundle(p.File)
+		}
+	case "DeliverBundle":
+		var p struct {
+			File string `json:"file"`
 		}
 		if err = json.Unmarshal(req.Params, &p); err == nil {
 			var path string
-			path, err = exportBundle(p.Name, p.Recipient)
-			if err == nil {
-				result = map[string]string{"path": path, "signature": path + ".minisig"}
+			if path, err = outboxPath(p.File); err == nil {
+				result, err = deliverBundle(path)
 			}
 		}
+	case "FetchBundles":
+		result, err = fetchBundles()
+	case "ListNodes":
+		result, err = listNodes()
+	case "AddNode":
+		var p node
+		if err = json.Unmarshal(req.Params, &p); err == nil {
+			result, err = addNode(p)
+		}
+	case "ListSigners":
+		result, err = listSigners()
+	case "AddSigner":
+		var p signer
+		if err = json.Unmarshal(req.Params, &p); err == nil {
+			result, err = addSigner(p)
+		}
+	case "RevokeSigner":
+		var p struct {
+			Name   string `json:"name"`
+			Reason string `json:"reason"`
+		}
+		if err = json.Unmarshal(req.Params, &p); err == nil {
+			result, err = revokeSigner(p.Name, p.Reason)
+		}
+	case "RemoveSigner":
+		var p struct {
+			Name string `json:"name"`
+		}
+		if err = json.Unmarshal(req.Params, &p); err == nil {
+			result, err = removeSigner(p.Name)
+		}
+	case "RemoveNode":
+		var p struct {
+			Name string `json:"name"`
+		}
+		if err = json.Unmarshal(req.Params, &p); err == nil {
+			result, err = removeNode(p.Name)
+		}
 	case "ListInbox":
 		result, err = listInboxBundles()
+	case "ImportBundle":
+		var p struct {
+			Bundle    string `json:"bundle"`
+			Signature string `json:"signature"`
+		}
+		if err = json.Unmarshal(req.Params, &p); err == nil {
+			result, err = importBundle(p.Bundle, p.Signature)
+		}
+	case "ListPending":
+		result, err = listPending()
+	case "GetPendingDiff":
+		var p struct {
+			Name     string `json:"name"`
+			Checksum string `json:"checksum"`
+		}
+		if err = json.Unmarshal(req.Params, &p); err == nil {
+			result, err = getPendingDiff(p.Name, p.Checksum)
+		}
+	case "ApplyPending":
+		var p struct {
+			Name     string `json:"name"`
+			Checksum string `json:"checksum"`
+		}
+		if err = json.Unmarshal(req.Params, &p); err == nil {
+			result, err = applyPending(p.Name, p.Checksum)
+		}
+	case "RejectPending":
+		var p struct {
+			Name     string `json:"name"`
+			Checksum string `json:"checksum"`
+			Reason   string `json:"reason"`
+			Archive  bool   `json:"archive"`
+		}
+		if err = json.Unmarshal(req.Params, &p); err == nil {
+			result, err = rejectPending(p.Name, p.Checksum, p.Reason, p.Archive)
+		}
 	default:
 		err = errors.New("unknown method")
 	}
@@ -292,10 +484,9 @@ func listInterfaces() (interface{}, error) {
 
 var ifaceRx = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,15}$`)
 
-type configSummary struct {
-	Interface map[string]string   `json:"interface"`
-	Peers     []map[string]string `json:"peers"`
-}
+// configSummary is the parsed form of a config returned by ReadConfig and
+// ValidateConfig, warnings included.
+type configSummary = config.Summary
 
 func readConfig(name string) (interface{}, error) {
 	if !ifaceRx.MatchString(name) {
@@ -309,19 +500,18 @@ func readConfig(name string) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
-	summary, err := parseConfig(string(data))
+	// A config with errors is still returned, with its diagnostics, so that
+	// it can be opened and fixed; only writes refuse it.
+	summary, diags, err := diagnoseConfig(name, string(data))
 	if err != nil {
 		return nil, err
 	}
-	return map[string]interface{}{"raw": string(data), "summary": summary}, nil
-}
-
-func validateConfig(text string) (interface{}, error) {
-	summary, err := parseConfig(text)
-	if err != nil {
-		return nil, fmt.Errorf("%w: %v", ErrValidation, err)
-	}
-	return map[string]interface{}{"summary": summary}, nil
+	return map[string]interface{}{
+		"raw":         string(data),
+		"summary":     summary,
+		"diagnostics": diags,
+		"valid":       !config.HasErrors(diags),
+	}, nil
 }
 
 func applyChanges(name, text string) (interface{}, error) {
@@ -332,29 +522,18 @@ func applyChanges(name, text string) (interface{}, error) {
 		auditApply("failure", name, "validate", err)
 		return nil, err
 	}
-	summary, err := parseConfig(text)
+	summary, err := checkConfig(name, text)
 	if err != nil {
-		wrapped := fmt.Errorf("%w: %v", ErrValidation, err)
 		auditApply("failure", name, "validate", err)
-		return nil, wrapped
-	}
-
-	lockDir := "/run/cockpit-wg/locks"
-	if err := os.MkdirAll(lockDir, 0755); err != nil {
-		auditApply("failure", name, "lock", err)
 		return nil, err
 	}
-	lockFile, err := os.OpenFile(filepath.Join(lockDir, name+".lock"), os.O_CREATE|os.O_RDWR, 0600)
+
+	unlock, err := lockInterface(name)
 	if err != nil {
 		auditApply("failure", name, "lock", err)
 		return nil, err
 	}
-	defer lockFile.Close()
-	if err := lockFileDescriptor(int(lockFile.Fd())); err != nil {
-		auditApply("failure", name, "lock", err)
-		return nil, err
-	}
-	defer unlockFileDescriptor(int(lockFile.Fd()))
+	defer unlock()
 
 	dir := "/etc/wireguard"
 	cfgPath := filepath.Join(dir, name+".conf")
@@ -419,6 +598,26 @@ func applyChanges(name, text string) (interface{}, error) {
 	return map[string]string{"status": "ok"}, nil
 }
 
+// lockInterface takes the lock serializing writes to an interface config.
+func lockInterface(name string) (func(), error) {
+	lockDir := "/run/cockpit-wg/locks"
+	if err := os.MkdirAll(lockDir, 0755); err != nil {
+		return nil, err
+	}
+	lockFile, err := os.OpenFile(filepath.Join(lockDir, name+".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFileDescriptor(int(lockFile.Fd())); err != nil {
+		lockFile.Close()
+		return nil, err
+	}
+	return func() {
+		unlockFileDescriptor(int(lockFile.Fd()))
+		lockFile.Close()
+	}, nil
+}
+
 func verifyAppliedConfig(name string, summary *configSummary) error {
 	client, err := wgctrl.New()
 	if err != nil {
@@ -462,7 +661,7 @@ func writeConfig(name, text string) (interface{}, error) {
 	if !ifaceRx.MatchString(name) {
 		return nil, fmt.Errorf("%w: invalid interface name", ErrValidation)
 	}
-	if _, err := validateConfig(text); err != nil {
+	if _, err := checkConfig(name, text); err != nil {
 		return nil, err
 	}
 	dir := "/etc/wireguard"
@@ -482,7 +681,7 @@ func writeConfig(name, text string) (interface{}, error) {
 	}
 	tmp.Close()
 
-	if _, err := validateConfig(text); err != nil {
+	if _, err := checkConfig(name, text); err != nil {
 		return nil, err
 	}
 
@@ -526,84 +725,6 @@ func reloadInterface(name string) (interface{}, error) {
 	return map[string]string{"status": "ok"}, nil
 }
 
-func parseConfig(text string) (*configSummary, error) {
-	summary := &configSummary{Interface: make(map[string]string)}
-	var curr map[string]string
-	scanner := bufio.NewScanner(strings.NewReader(text))
-	line := 0
-	for scanner.Scan() {
-		line++
-		l := strings.TrimSpace(scanner.Text())
-		if l == "" || strings.HasPrefix(l, "#") || strings.HasPrefix(l, ";") {
-			continue
-		}
-		if strings.HasPrefix(l, "[") && strings.HasSuffix(l, "]") {
-			sect := strings.TrimSpace(l[1 : len(l)-1])
-			switch sect {
-			case "Interface":
-				curr = summary.Interface
-			case "Peer":
-				m := make(map[string]string)
-				summary.Peers = append(summary.Peers, m)
-				curr = m
-			default:
-				return nil, fmt.Errorf("unknown section %q at line %d", sect, line)
-			}
-			continue
-		}
-		if curr == nil {
-			return nil, fmt.Errorf("key-value outside of section at line %d", line)
-		}
-		parts := strings.SplitN(l, "=", 2)
-		if len(parts) != 2 {
-			return nil, fmt.Errorf("invalid line %d", line)
-		}
-		key := strings.TrimSpace(parts[0])
-		val := strings.TrimSpace(parts[1])
-		curr[key] = val
-	}
-	if err := scanner.Err(); err != nil {
-		return nil, err
-	}
-	if len(summary.Interface) == 0 {
-		return nil, fmt.Errorf("missing [Interface] section")
-	}
-	if len(summary.Peers) == 0 {
-		return nil, fmt.Errorf("no peers defined")
-	}
-	seen := make(map[string]struct{})
-	for _, p := range summary.Peers {
-		pk, ok := p["PublicKey"]
-		if !ok || pk == "" {
-			return nil, fmt.Errorf("peer missing PublicKey")
-		}
-		if _, dup := seen[pk]; dup {
-			return nil, fmt.Errorf("duplicate peer %s", pk)
-		}
-		seen[pk] = struct{}{}
-		allowed, ok := p["AllowedIPs"]
-		if !ok {
-			return nil, fmt.Errorf("peer %s missing AllowedIPs", pk)
-		}
-		ips := strings.Split(allowed, ",")
-		for _, ip := range ips {
-			ip = strings.TrimSpace(ip)
-			if ip == "" {
-				continue
-			}
-			if ip == "0.0.0.0/0" || ip == "::/0" {
-				return nil, fmt.Errorf("disallowed AllowedIPs %s", ip)
-			}
-			if _, _, err := net.ParseCIDR(ip); err != nil {
-				if net.ParseIP(ip) == nil {
-					return nil, fmt.Errorf("invalid AllowedIPs %s", ip)
-				}
-			}
-		}
-	}
-	return summary, nil
-}
-
 func restartInterface(name string) (interface{}, error) {
 	if !ifaceRx.MatchString(name) {
 		return nil, fmt.Errorf("invalid interface name")
@@ -772,15 +893,28 @@ func runSelfTest() (interface{}, error) {
 	details["clock"] = clock
 	lines = append(lines, fmt.Sprintf("Clock sync: %s", clock))
 
-	dummy := `[Interface]
+	if lint, err := lintInterfaces(); err != nil {
+		details["lintError"] = err.Error()
+		lines = append(lines, "Lint: "+err.Error())
+	} else {
+		details["lint"] = lint
+		for _, name := range sortedKeys(lint) {
+			lines = append(lines, fmt.Sprintf("Lint %s: %s", name, countSeverities(lint[name])))
+		}
+	}
+
+	// throwaway keys; placeholder keys would fail validation
+	priv, _, _ := genKeyPair()
+	_, peer, _ := genKeyPair()
+	dummy := fmt.Sprintf(`[Interface]
 Address = 10.0.0.1/32
-PrivateKey = AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+PrivateKey = %s
 
 [Peer]
-PublicKey = AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+PublicKey = %s
 AllowedIPs = 10.0.0.2/32
-`
-	if _, err := validateConfig(dummy); err != nil {
+`, priv, peer)
+	if _, err := checkConfig("", dummy); err != nil {
 		details["validateConfig"] = err.Error()
 		lines = append(lines, "Config validation: "+err.Error())
 	} else {
@@ -933,12 +1067,19 @@ func logRPCError(trace, method string, d time.Duration, err *respError) {
 	journal.Send(string(msg), journal.PriInfo, nil)
 }
 
+// maxLoggedValue is the longest string parameter written to the journal as
+// is. Longer ones, such as the contents of an imported bundle, are logged by
+// size only.
+const maxLoggedValue = 256
+
 func redact(v interface{}) interface{} {
 	switch val := v.(type) {
 	case map[string]interface{}:
 		for k, vv := range val {
 			if isSecret(k) {
 				val[k] = "<redacted>"
+			} else if s, ok := vv.(string); ok && isBlob(k) {
+				val[k] = fmt.Sprintf("<%d bytes>", len(s))
 			} else {
 				val[k] = redact(vv)
 			}
@@ -947,11 +1088,25 @@ func redact(v interface{}) interface{} {
 		for i, vv := range val {
 			val[i] = redact(vv)
 		}
+	case string:
+		if len(val) > maxLoggedValue {
+			return fmt.Sprintf("<%d bytes>", len(val))
+		}
 	}
 	return v
 }
 
+// isBlob reports whether key holds encoded file contents, which are never
+// worth logging whatever their size.
+func isBlob(key string) bool {
+	switch strings.ToLower(key) {
+	case "bundle", "signature":
+		return true
+	}
+	return false
+}
+
 func isSecret(key string) bool {
 	k := strings.ToLower(key)
-	return strings.Contains(k, "key") || strings.Contains(k, "password") || strings.Contains(k, "secret") || strings.Contains(k, "psk")
+	return strings.Contains(k, "key") || strings.Contains(k, "password") || strings.Contains(k, "secret") || strings.Contains(k, "psk") || strings.Contains(k, "passphrase")
 }
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"wg-bridge/internal/validator"
+)
+
+const nodesFile = "/var/lib/cockpit-wg/nodes.json"
+
+var (
+	nodeNameRx     = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,62}$`)
+	ageRecipientRx = regexp.MustCompile(`^age1[02-9ac-hj-np-z]{58}$`)
+	fingerprintRx  = regexp.MustCompile(`^[0-9A-F]{16}$`)
+)
+
+// node is a remote peer known to the exchange. ExchangeKey is the age
+// recipient bundles for the node are encrypted to; SigningFingerprint is the
+// minisign key id the node signs its own bundles with.
+type node struct {
+	Name               string `json:"name"`
+	ExchangeKey        string `json:"exchangeKey"`
+	SigningFingerprint string `json:"signingFingerprint,omitempty"`
+	// PublicKey is the WireGuard public key of the node's own peer. Peer
+	// deltas the node signs may only change that peer.
+	PublicKey  string   `json:"publicKey,omitempty"`
+	Interfaces []string `json:"interfaces"`
+	Groups     []string `json:"groups"`
+	Added      string   `json:"added"`
+	// Transport delivers bundles to and fetches bundles from the node.
+	Transport *transportConfig `json:"transport,omitempty"`
+}
+
+// nodeDirectory is the on-disk list of known nodes, kept sorted by name.
+type nodeDirectory struct {
+	Nodes []*node `json:"nodes"`
+}
+
+var nodesMu sync.Mutex
+
+func loadNodes() (*nodeDirectory, error) {
+	dir := &nodeDirectory{Nodes: []*node{}}
+	b, err := os.ReadFile(nodesFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return dir, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, dir); err != nil {
+		return nil, err
+	}
+	if dir.Nodes == nil {
+		dir.Nodes = []*node{}
+	}
+	return dir, nil
+}
+
+func saveNodes(dir *nodeDirectory) error {
+	if err := os.MkdirAll(filepath.Dir(nodesFile), 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(dir, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := nodesFile + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, nodesFile)
+}
+
+func (d *nodeDirectory) find(name string) *node {
+	for _, n := range d.Nodes {
+		if n.Name == name {
+			return n
+		}
+	}
+	return nil
+}
+
+// put adds n or replaces the node with the same name.
+func (d *nodeDirectory) put(n *node) {
+	for i, old := range d.Nodes {
+		if old.Name == n.Name {
+			d.Nodes[i] = n
+			return
+		}
+	}
+	d.Nodes = append(d.Nodes, n)
+	sort.Slice(d.Nodes, func(i, j int) bool { return d.Nodes[i].Name < d.Nodes[j].Name })
+}
+
+func (d *nodeDirectory) remove(name string) bool {
+	for i, n := range d.Nodes {
+		if n.Name == name {
+			d.Nodes = append(d.Nodes[:i], d.Nodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// recipients resolves named nodes and group members to their exchange keys.
+// Group members only count when they take part in iface, or list no
+// interfaces at all. The result is deduplicated and never empty.
+func (d *nodeDirectory) recipients(iface string, names []string, group string) ([]string, error) {
+	keys := []string{}
+	seen := map[string]bool{}
+	add := func(n *node) {
+		if !seen[n.ExchangeKey] {
+			seen[n.ExchangeKey] = true
+			keys = append(keys, n.ExchangeKey)
+		}
+	}
+	for _, name := range names {
+		n := d.find(name)
+		if n == nil {
+			return nil, fmt.Errorf("%w: unknown node %s", ErrValidation, name)
+		}
+		add(n)
+	}
+	if group != "" {
+		members := 0
+		for _, n := range d.Nodes {
+			if contains(n.Groups, group) && (len(n.Interfaces) == 0 || contains(n.Interfaces, iface)) {
+				add(n)
+				members++
+			}
+		}
+		if members == 0 {
+			return nil, fmt.Errorf("%w: group %s has no nodes for %s", ErrValidation, group, iface)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no recipients", ErrValidation)
+	}
+	return keys, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// validateNode normalizes and checks a node supplied over RPC.
+func validateNode(n *node) error {
+	n.Name = strings.TrimSpace(n.Name)
+	n.ExchangeKey = strings.TrimSpace(n.ExchangeKey)
+	n.SigningFingerprint = strings.ToUpper(strings.TrimSpace(n.SigningFingerprint))
+	if !nodeNameRx.MatchString(n.Name) {
+		return fmt.Errorf("%w: invalid node name", ErrValidation)
+	}
+	if !ageRecipientRx.MatchString(n.ExchangeKey) {
+		return fmt.Errorf("%w: exchange key must be an age recipient", ErrValidation)
+	}
+	if n.SigningFingerprint != "" && !fingerprintRx.MatchString(n.SigningFingerprint) {
+		return fmt.Errorf("%w: invalid signing key fingerprint", ErrValidation)
+	}
+	n.PublicKey = strings.TrimSpace(n.PublicKey)
+	if n.PublicKey != "" {
+		if err := validatePeerKey(n.PublicKey); err != nil {
+			return fmt.Errorf("%w: %v", ErrValidation, err)
+		}
+	}
+	if n.Interfaces == nil {
+		n.Interfaces = []string{}
+	}
+	for _, iface := range n.Interfaces {
+		if !ifaceRx.MatchString(iface) {
+			return fmt.Errorf("%w: invalid interface name %s", ErrValidation, iface)
+		}
+	}
+	if n.Groups == nil {
+		n.Groups = []string{}
+	}
+	for _, g := range n.Groups {
+		if !nodeNameRx.MatchString(g) {
+			return fmt.Errorf("%w: invalid group name %s", ErrValidation, g)
+		}
+	}
+	if n.Transport != nil {
+		return validateTransport(n.Transport)
+	}
+	return nil
+}
+
+func listNodes() ([]*node, error) {
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
+	dir, err := loadNodes()
+	if err != nil {
+		return nil, err
+	}
+	return dir.Nodes, nil
+}
+
+// addNode stores n in the directory, replacing a node of the same name.
+func addNode(n node) (*node, error) {
+	if err := validateNode(&n); err != nil {
+		return nil, err
+	}
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
+	dir, err := loadNodes()
+	if err != nil {
+		return nil, err
+	}
+	n.Added = time.Now().UTC().Format(time.RFC3339)
+	if old := dir.find(n.Name); old != nil {
+		n.Added = old.Added
+		if n.PublicKey == "" {
+			n.PublicKey = old.PublicKey
+		}
+	}
+	dir.put(&n)
+	if err := saveNodes(dir); err != nil {
+		return nil, err
+	}
+	params, _ := json.Marshal(map[string]string{"name": n.Name, "exchangeKey": n.ExchangeKey})
+	auditLog("AddNode", params, nil)
+	return &n, nil
+}
+
+func removeNode(name string) (interface{}, error) {
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
+	dir, err := loadNodes()
+	if err != nil {
+		return nil, err
+	}
+	if !dir.remove(name) {
+		return nil, fmt.Errorf("%w: unknown node %s", ErrValidation, name)
+	}
+	if err := saveNodes(dir); err != nil {
+		return nil, err
+	}
+	params, _ := json.Marshal(map[string]string{"name": name})
+	auditLog("RemoveNode", params, nil)
+	return map[string]string{"status": "ok"}, nil
+}
+
+// nodePeerKey returns the WireGuard key recorded for the node signing with
+// fingerprint, or "" if the node has none recorded yet. A signer without a
+// node entry may not send peer deltas at all.
+func nodePeerKey(fingerprint string) (string, error) {
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
+	dir, err := loadNodes()
+	if err != nil {
+		return "", err
+	}
+	for _, n := range dir.Nodes {
+		if n.SigningFingerprint != "" && strings.EqualFold(n.SigningFingerprint, fingerprint) {
+			return n.PublicKey, nil
+		}
+	}
+	return "", fmt.Errorf("%w: signer %s is not a known node", ErrSignerNotAllowed, fingerprint)
+}
+
+// recordPeerKey keeps the key of the node signing with fingerprint current
+// once one of its deltas has been applied: a peer-add records the key of a
+// node that has none, a key rotation replaces it.
+func recordPeerKey(fingerprint, typ string, p *peerPayload) error {
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
+	dir, err := loadNodes()
+	if err != nil {
+		return err
+	}
+	changed := false
+	for _, n := range dir.Nodes {
+		if n.SigningFingerprint == "" || !strings.EqualFold(n.SigningFingerprint, fingerprint) {
+			continue
+		}
+		switch {
+		case typ == validator.TypePeerAdd && n.PublicKey == "":
+			n.PublicKey, changed = p.PublicKey, true
+		case typ == validator.TypePeerKeyRotation && n.PublicKey == p.PublicKey:
+			n.PublicKey, changed = p.NewPublicKey, true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return saveNodes(dir)
+}
+
+// exportRecipients returns the age recipients for an export. A raw recipient
+// string is still accepted alongside named nodes and groups.
+func exportRecipients(iface, recipient string, names []string, group string) ([]string, error) {
+	var keys []string
+	if r := strings.TrimSpace(recipient); r != "" {
+		keys = append(keys, r)
+	}
+	if len(names) == 0 && group == "" {
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("%w: no recipients", ErrValidation)
+		}
+		return keys, nil
+	}
+	nodesMu.Lock()
+	dir, err := loadNodes()
+	nodesMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := dir.recipients(iface, names, group)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range resolved {
+		if !contains(keys, k) {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testAgeKey(c byte) string {
+	return "age1" + strings.Repeat(string(c), 58)
+}
+
+func TestValidateNode(t *testing.T) {
+	n := node{Name: "office", ExchangeKey: " " + testAgeKey('q') + "\n", SigningFingerprint: "0123456789abcdef"}
+	if err := validateNode(&n); err != nil {
+		t.Fatalf("expected valid node, got %v", err)
+	}
+	if n.SigningFingerprint != "0123456789ABCDEF" || n.Interfaces == nil || n.Groups == nil {
+		t.Fatalf("node not normalized: %+v", n)
+	}
+
+	bad := []node{
+		{Name: "../x", ExchangeKey: testAgeKey('q')},
+		{Name: "office", ExchangeKey: "age1short"},
+		{Name: "office", ExchangeKey: testAgeKey('q'), SigningFingerprint: "xyz"},
+		{Name: "office", ExchangeKey: testAgeKey('q'), Interfaces: []string{"wg0;rm"}},
+		{Name: "office", ExchangeKey: testAgeKey('q'), Groups: []string{"a b"}},
+		{Name: "office", ExchangeKey: testAgeKey('q'), PublicKey: "not-a-key"},
+	}
+	for _, b := range bad {
+		if err := validateNode(&b); !errors.Is(err, ErrValidation) {
+			t.Fatalf("expected validation error for %+v, got %v", b, err)
+		}
+	}
+}
+
+func TestNodeDirectoryRecipients(t *testing.T) {
+	d := &nodeDirectory{}
+	d.put(&node{Name: "c", ExchangeKey: testAgeKey('c'), Groups: []string{"branch"}, Interfaces: []string{"wg1"}})
+	d.put(&node{Name: "a", ExchangeKey: testAgeKey('a'), Groups: []string{"branch"}})
+	d.put(&node{Name: "b", ExchangeKey: testAgeKey('d'), Groups: []string{"branch"}, Interfaces: []string{"wg0"}})
+	if d.Nodes[0].Name != "a" || d.Nodes[2].Name != "c" {
+		t.Fatalf("expected nodes sorted by name")
+	}
+
+	keys, err := d.recipients("wg0", []string{"a"}, "branch")
+	if err != nil {
+		t.Fatalf("recipients: %v", err)
+	}
+	if strings.Join(keys, ",") != testAgeKey('a')+","+testAgeKey('d') {
+		t.Fatalf("unexpected recipients %v", keys)
+	}
+
+	if _, err := d.recipients("wg0", []string{"missing"}, ""); !errors.Is(err, ErrValidation) {
+		t.Fatalf("expected unknown node error, got %v", err)
+	}
+	if _, err := d.recipients("wg0", nil, "nobody"); !errors.Is(err, ErrValidation) {
+		t.Fatalf("expected empty group error, got %v", err)
+	}
+	if !d.remove("b") || d.remove("b") || len(d.Nodes) != 2 {
+		t.Fatalf("unexpected remove result: %+v", d.Nodes)
+	}
+}
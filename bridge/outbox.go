@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	outboxDir = "/var/lib/cockpit-wg/outbox"
+	// downloadChunk is the default DownloadBundle chunk size and
+	// maxDownloadChunk the largest accepted, both before base64 encoding.
+	downloadChunk    = 256 * 1024
+	maxDownloadChunk = 1024 * 1024
+)
+
+var outboxNameRx = regexp.MustCompile(`^[a-zA-Z0-9_.-]+\.wgx$`)
+
+// outboxEntry is stored as <bundle>.json next to every exported bundle.
+type outboxEntry struct {
+	File       string   `json:"file"`
+	Interface  string   `json:"interface"`
+	Type       string   `json:"type"`
+	Checksum   string   `json:"checksum"`
+	Sequence   uint64   `json:"sequence"`
+	Recipients []string `json:"recipients"`
+	Nodes      []string `json:"nodes"`
+	Created    string   `json:"created"`
+	Size       int64    `json:"size"`
+	// Deliveries holds the last transport attempt per recipient node and
+	// Receipts the latest delivery receipt.
+	Deliveries map[string]*deliveryStatus `json:"deliveries,omitempty"`
+	Receipts   map[string]*receiptStatus  `json:"receipts,omitempty"`
+}
+
+// ensureOutbox creates the outbox readable by root only.
+func ensureOutbox() error {
+	if err := os.MkdirAll(outboxDir, 0700); err != nil {
+		return err
+	}
+	return os.Chmod(outboxDir, 0700)
+}
+
+// outboxPath validates a bundle file name supplied over RPC.
+func outboxPath(file string) (string, error) {
+	if !outboxNameRx.MatchString(file) || strings.Contains(file, "..") {
+		return "", fmt.Errorf("%w: invalid bundle name", ErrValidation)
+	}
+	return filepath.Join(outboxDir, file), nil
+}
+
+// outboxMu serializes updates to outbox entries, which receipts, deliveries
+// and RPCs make concurrently.
+var outboxMu sync.Mutex
+
+// updateOutboxEntry applies update to the entry of the bundle at path and
+// writes the entry back when update reports a change.
+func updateOutboxEntry(path string, update func(*outboxEntry) bool) (*outboxEntry, error) {
+	outboxMu.Lock()
+	defer outboxMu.Unlock()
+	e, err := readOutboxEntry(path)
+	if err != nil {
+		return nil, err
+	}
+	if !update(e) {
+		return e, nil
+	}
+	return e, writeOutboxEntry(path, e)
+}
+
+func writeOutboxEntry(path string, e *outboxEntry) error {
+	if st, err := os.Stat(path); err == nil {
+		e.Size = st.Size()
+	}
+	b, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path+".json", b, 0600)
+}
+
+func readOutboxEntry(path string) (*outboxEntry, error) {
+	b, err := os.ReadFile(path + ".json")
+	if err != nil {
+		return nil, err
+	}
+	var e outboxEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, err
+	}
+	e.File = filepath.Base(path)
+	return &e, nil
+}
+
+// recipientNodes maps age recipients to the names of known nodes.
+func recipientNodes(recipients []string) []string {
+	names := []string{}
+	nodesMu.Lock()
+	dir, err := loadNodes()
+	nodesMu.Unlock()
+	if err != nil {
+		return names
+	}
+	for _, n := range dir.Nodes {
+		if contains(recipients, n.ExchangeKey) {
+			names = append(names, n.Name)
+		}
+	}
+	return names
+}
+
+// listOutbox returns the metadata of every exported bundle, newest first.
+func listOutbox() ([]*outboxEntry, error) {
+	entries, err := os.ReadDir(outboxDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []*outboxEntry{}, nil
+		}
+		return nil, err
+	}
+	result := []*outboxEntry{}
+	for _, e := range entries {
+		if e.IsDir() || !outboxNameRx.MatchString(e.Name()) {
+			continue
+		}
+		path := filepath.Join(outboxDir, e.Name())
+		outboxMu.Lock()
+		entry, err := readOutboxEntry(path)
+		outboxMu.Unlock()
+		if err != nil {
+			// bundles exported before metadata was recorded
+			entry = &outboxEntry{File: e.Name(), Recipients: []string{}, Nodes: []string{}}
+			if info, err := e.Info(); err == nil {
+				entry.Size = info.Size()
+				entry.Created = info.ModTime().UTC().Format(time.RFC3339)
+			}
+		}
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Created > result[j].Created })
+	return result, nil
+}
+
+// downloadBundle returns length bytes of an outbox bundle starting at
+// offset, base64 encoded. The signature is included with the first chunk so
+// small bundles are fetched in a single call.
+func downloadBundle(file string, offset, length int64) (interface{}, error) {
+	path, err := outboxPath(file)
+	if err != nil {
+		return nil, err
+	}
+	if length <= 0 {
+		length = downloadChunk
+	}
+	if length > maxDownloadChunk {
+		length = maxDownloadChunk
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: no bundle %s in outbox", ErrValidation, file)
+		}
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || offset > st.Size() {
+		return nil, fmt.Errorf("%w: offset out of range", ErrValidation)
+	}
+	buf := make([]byte, length)
+	n, err := f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	result := map[string]interface{}{
+		"file":   file,
+		"size":   st.Size(),
+		"offset": offset,
+		"data":   base64.StdEncoding.EncodeToString(buf[:n]),
+		"eof":    offset+int64(n) >= st.Size(),
+	}
+	if offset == 0 {
+		sig, err := os.ReadFile(path + ".minisig")
+		if err != nil {
+			return nil, err
+		}
+		result["signature"] = string(sig)
+	}
+	return result, nil
+}
+
+// deleteOutboxBundle removes a bundle together with its signature and
+// metadata.
+func deleteOutboxBundle(file string) (interface{}, error) {
+	path, err := outboxPath(file)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: no bundle %s in outbox", ErrValidation, file)
+		}
+		return nil, err
+	}
+	for _, p := range []string{path, path + ".minisig", path + ".json"} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	params, _ := json.Marshal(map[string]string{"file": file})
+	auditLog("DeleteOutboxBundle", params, nil)
+	return map[string]string{"status": "ok"}, nil
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
-	"os/exec"
+	"strconv"
 	"strings"
+
+	"wg-bridge/internal/config"
 )
 
 type peerParams struct {
@@ -16,11 +20,21 @@ type peerParams struct {
 	Enabled             bool     `json:"enabled"`
 }
 
+func peerConfigPath(name string) (string, error) {
+	if !ifaceRx.MatchString(name) {
+		return "", fmt.Errorf("%w: invalid interface name", ErrValidation)
+	}
+	return fmt.Sprintf("/etc/wireguard/%s.conf", name), nil
+}
+
 func addPeer(name string, p peerParams) (interface{}, error) {
 	allowed, err := normalizeCIDRs(p.AllowedIPs)
 	if err != nil {
 		return nil, err
 	}
+	if err := checkRoutes(name, allowed); err != nil {
+		return nil, err
+	}
 
 	priv, pub, err := genKeyPair()
 	if err != nil {
@@ -32,34 +46,77 @@ func addPeer(name string, p peerParams) (interface{}, error) {
 			return nil, err
 		}
 	}
-	lines := []string{"[Peer]", fmt.Sprintf("PublicKey = %s", pub)}
-	if psk != "" {
-		lines = append(lines, fmt.Sprintf("PresharedKey = %s", psk))
+	err = editPeerConfig(name, func(f *config.File) error {
+		addPeerSection(f, pub, psk, allowed, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	if p.Endpoint != "" {
-		lines = append(lines, fmt.Sprintf("Endpoint = %s", strings.TrimSpace(p.Endpoint)))
+	return map[string]string{"publicKey": pub, "privateKey": priv, "presharedKey": psk}, nil
+}
+
+// addPeerSection appends a [Peer] section. Disabled peers are commented out.
+func addPeerSection(f *config.File, pub, psk string, allowed []string, p peerParams) {
+	s := f.AddSection("Peer")
+	s.Set("PublicKey", pub)
+	if psk != "" {
+		s.Set("PresharedKey", psk)
 	}
-	if len(allowed) > 0 {
-		lines = append(lines, fmt.Sprintf("AllowedIPs = %s", strings.Join(allowed, ", ")))
+	setPeerParams(s, allowed, p)
+	s.SetDisabled(!p.Enabled)
+}
+
+// setPeerParams sets or clears the settings a peerParams carries, leaving
+// the keys and any other entries and comments of s alone.
+func setPeerParams(s *config.Section, allowed []string, p peerParams) {
+	set := func(key, value string) {
+		if value == "" {
+			s.Delete(key)
+		} else {
+			s.Set(key, value)
+		}
 	}
+	set("Endpoint", strings.TrimSpace(p.Endpoint))
+	set("AllowedIPs", strings.Join(allowed, ", "))
+	keepalive := ""
 	if p.PersistentKeepalive > 0 {
-		lines = append(lines, fmt.Sprintf("PersistentKeepalive = %d", p.PersistentKeepalive))
-	}
-	block := strings.Join(lines, "\n") + "\n"
-	if !p.Enabled {
-		block = commentBlock(block)
+		keepalive = strconv.Itoa(p.PersistentKeepalive)
 	}
+	set("PersistentKeepalive", keepalive)
+}
 
-	path := fmt.Sprintf("/etc/wireguard/%s.conf", name)
-	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+// editPeerConfig applies edit to the config of name under the interface
+// lock. Lines edit does not touch, including comments, are kept as they
+// are. The result must pass checkConfig before it is written.
+func editPeerConfig(name string, edit func(f *config.File) error) error {
+	path, err := peerConfigPath(name)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer f.Close()
-	if _, err := f.WriteString("\n" + block); err != nil {
-		return nil, err
+	unlock, err := lockInterface(name)
+	if err != nil {
+		return err
 	}
-	return map[string]string{"publicKey": pub, "privateKey": priv, "presharedKey": psk}, nil
+	defer unlock()
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	f, err := config.Parse(string(data))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrValidation, err)
+	}
+	if err := edit(f); err != nil {
+		return err
+	}
+	if _, err := checkConfig(name, f.String()); err != nil {
+		return err
+	}
+	return writeAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(f.Bytes())
+		return err
+	})
 }
 
 func normalizeCIDRs(list []string) ([]string, error) {
@@ -78,110 +135,50 @@ func normalizeCIDRs(list []string) ([]string, error) {
 	return out, nil
 }
 
-func genKeyPair() (string, string, error) {
-	privBytes, err := exec.Command("wg", "genkey").Output()
-	if err != nil {
-		return "", "", err
-	}
-	priv := strings.TrimSpace(string(privBytes))
-	cmd := exec.Command("wg", "pubkey")
-	cmd.Stdin = strings.NewReader(priv)
-	pubBytes, err := cmd.Output()
-	if err != nil {
-		return "", "", err
-	}
-	return priv, strings.TrimSpace(string(pubBytes)), nil
-}
-
-func genPSK() (string, error) {
-	b, err := exec.Command("wg", "genpsk").Output()
-	if err != nil {
-		return "", err
-	}
-	return strings.TrimSpace(string(b)), nil
-}
-
-func commentBlock(block string) string {
-	lines := strings.Split(block, "\n")
-	for i, l := range lines {
-		if strings.TrimSpace(l) != "" {
-			lines[i] = "# " + l
-		}
-	}
-	return strings.Join(lines, "\n")
-}
-
 func removePeer(name, pub string) (interface{}, error) {
-	path := fmt.Sprintf("/etc/wireguard/%s.conf", name)
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-	sections := strings.Split(string(data), "\n[Peer]")
-	result := sections[0]
-	for i := 1; i < len(sections); i++ {
-		blk := sections[i]
-		if strings.Contains(blk, fmt.Sprintf("PublicKey = %s", pub)) || strings.Contains(blk, fmt.Sprintf("PublicKey=%s", pub)) {
-			continue
+	err := editPeerConfig(name, func(f *config.File) error {
+		if s := f.Peer(pub); s != nil {
+			f.RemoveSection(s)
 		}
-		result += "\n[Peer]" + blk
-	}
-	if err := os.WriteFile(path, []byte(result), 0600); err != nil {
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
 	return map[string]string{"status": "ok"}, nil
 }
 
+// updatePeer edits the settings of a peer in place, keeping its preshared
+// key and comments. An unknown peer is added.
 func updatePeer(name, pub string, p peerParams) (interface{}, error) {
-	if _, err := removePeer(name, pub); err != nil {
-		return nil, err
-	}
-	// use existing public key
-	p.Preshared = false
-	res, err := addPeerWithKey(name, pub, p)
-	if err != nil {
-		return nil, err
-	}
-	return res, nil
-}
-
-func addPeerWithKey(name, pub string, p peerParams) (interface{}, error) {
 	allowed, err := normalizeCIDRs(p.AllowedIPs)
 	if err != nil {
 		return nil, err
 	}
-	psk := ""
-	lines := []string{"[Peer]", fmt.Sprintf("PublicKey = %s", pub)}
-	if psk != "" {
-		lines = append(lines, fmt.Sprintf("PresharedKey = %s", psk))
-	}
-	if p.Endpoint != "" {
-		lines = append(lines, fmt.Sprintf("Endpoint = %s", strings.TrimSpace(p.Endpoint)))
-	}
-	if len(allowed) > 0 {
-		lines = append(lines, fmt.Sprintf("AllowedIPs = %s", strings.Join(allowed, ", ")))
-	}
-	if p.PersistentKeepalive > 0 {
-		lines = append(lines, fmt.Sprintf("PersistentKeepalive = %d", p.PersistentKeepalive))
-	}
-	block := strings.Join(lines, "\n") + "\n"
-	if !p.Enabled {
-		block = commentBlock(block)
-	}
-	path := fmt.Sprintf("/etc/wireguard/%s.conf", name)
-	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
-	if err != nil {
+	if err := checkRoutes(name, allowed); err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	if _, err := f.WriteString("\n" + block); err != nil {
+	err = editPeerConfig(name, func(f *config.File) error {
+		s := f.Peer(pub)
+		if s == nil {
+			addPeerSection(f, pub, "", allowed, p)
+			return nil
+		}
+		setPeerParams(s, allowed, p)
+		s.SetDisabled(!p.Enabled)
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
 	return map[string]string{"publicKey": pub}, nil
 }
 
 func listPeers(name string) (interface{}, error) {
-	path := fmt.Sprintf("/etc/wireguard/%s.conf", name)
+	path, err := peerConfigPath(name)
+	if err != nil {
+		return nil, err
+	}
 	data, err := os.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -189,34 +186,25 @@ func listPeers(name string) (interface{}, error) {
 		}
 		return nil, err
 	}
-	sections := strings.Split(string(data), "\n[Peer]")
+	f, err := config.Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrValidation, err)
+	}
 	peers := []map[string]interface{}{}
-	for i := 1; i < len(sections); i++ {
-		blk := sections[i]
-		enabled := true
-		if strings.HasPrefix(strings.TrimSpace(blk), "#") {
-			enabled = false
-		}
-		lines := strings.Split(blk, "\n")
-		info := map[string]interface{}{"enabled": enabled}
-		for _, l := range lines {
-			l = strings.TrimSpace(strings.TrimPrefix(l, "#"))
-			if l == "" {
-				continue
-			}
-			parts := strings.SplitN(l, "=", 2)
-			if len(parts) != 2 {
-				continue
-			}
-			key := strings.TrimSpace(parts[0])
-			val := strings.TrimSpace(parts[1])
+	for _, s := range f.Peers() {
+		info := map[string]interface{}{"enabled": !s.Disabled}
+		for key, val := range s.Map() {
 			switch key {
 			case "PublicKey":
 				info["publicKey"] = val
 			case "Endpoint":
 				info["endpoint"] = val
 			case "AllowedIPs":
-				info["allowedIPs"] = strings.Split(val, ",")
+				ips := []string{}
+				for _, ip := range strings.Split(val, ",") {
+					ips = append(ips, strings.TrimSpace(ip))
+				}
+				info["allowedIPs"] = ips
 			case "PersistentKeepalive":
 				info["persistentKeepalive"] = val
 			case "PresharedKey":
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/journal"
+
+	"wg-bridge/internal/validator"
+)
+
+const archiveDir = "/var/lib/cockpit-wg/archive"
+
+// pendingInfo describes a bundle waiting for operator approval.
+type pendingInfo struct {
+	Interface string   `json:"interface"`
+	Version   int      `json:"version"`
+	Type      string   `json:"type"`
+	Checksum  string   `json:"checksum"`
+	Sequence  uint64   `json:"sequence"`
+	Source    string   `json:"source,omitempty"`
+	Signer    string   `json:"signer,omitempty"`
+	Staged    string   `json:"staged"`
+	Meta      []string `json:"meta"`
+}
+
+// pendingRecord is written next to archived bundles and sent to the journal.
+type pendingRecord struct {
+	Action    string `json:"action"`
+	Interface string `json:"iface"`
+	Checksum  string `json:"hash"`
+	Actor     string `json:"actor"`
+	Reason    string `json:"reason,omitempty"`
+	Time      string `json:"time"`
+}
+
+// pendingPath returns the directory of the bundle staged for name with the
+// given checksum. Each interface has a queue of staged bundles, one per
+// checksum, so that deltas from several nodes wait side by side. checksum
+// may be empty when only one bundle is pending for the interface.
+func pendingPath(name, checksum string) (string, error) {
+	if !ifaceRx.MatchString(name) {
+		return "", fmt.Errorf("%w: invalid interface name", ErrValidation)
+	}
+	if checksum != "" {
+		checksum = strings.ToLower(checksum)
+		if !checksumRx.MatchString(checksum) {
+			return "", fmt.Errorf("%w: invalid checksum", ErrValidation)
+		}
+	}
+	dirs, err := pendingDirs(name)
+	if err != nil {
+		return "", err
+	}
+	var found []string
+	for _, dir := range dirs {
+		if checksum == "" || filepath.Base(dir) == checksum {
+			found = append(found, dir)
+		}
+	}
+	switch {
+	case len(found) == 0 && checksum != "":
+		return "", fmt.Errorf("no pending bundle %s for %s", checksum, name)
+	case len(found) == 0:
+		return "", fmt.Errorf("no pending bundle for %s", name)
+	case len(found) > 1:
+		return "", fmt.Errorf("%w: %d bundles pending for %s, pass a checksum", ErrValidation, len(found), name)
+	}
+	return found[0], nil
+}
+
+// pendingDirs lists the bundles staged for name, oldest first.
+func pendingDirs(name string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(pendingDir, name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	type staged struct {
+		dir string
+		mod time.Time
+	}
+	var out []staged
+	for _, e := range entries {
+		if !e.IsDir() || !checksumRx.MatchString(e.Name()) {
+			continue
+		}
+		dir := filepath.Join(pendingDir, name, e.Name())
+		if st, err := os.Stat(filepath.Join(dir, "manifest.json")); err == nil {
+			out = append(out, staged{dir, st.ModTime()})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].mod.Before(out[j].mod) })
+	dirs := make([]string, len(out))
+	for i, st := range out {
+		dirs[i] = st.dir
+	}
+	return dirs, nil
+}
+
+func readPending(name, dir string) (*pendingInfo, error) {
+	info := &pendingInfo{Interface: name, Type: validator.TypeConfig, Meta: []string{}}
+	st, err := os.Stat(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	info.Staged = st.ModTime().UTC().Format(time.RFC3339)
+	if b, err := os.ReadFile(filepath.Join(dir, "manifest.json")); err == nil {
+		var man validator.Manifest
+		if json.Unmarshal(b, &man) == nil {
+			info.Version = man.Version
+			info.Type = man.PayloadType()
+			info.Checksum = man.Checksum
+			info.Sequence = man.Sequence
+			info.Source = man.Source
+		}
+	}
+	if o := readOrigin(dir); o != nil {
+		info.Signer = o.Signer
+	}
+	metaDir := filepath.Join(dir, "meta")
+	filepath.WalkDir(metaDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if rel, err := filepath.Rel(dir, path); err == nil {
+			info.Meta = append(info.Meta, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	sort.Strings(info.Meta)
+	return info, nil
+}
+
+// listPending returns every staged bundle, by interface and oldest first.
+func listPending() ([]*pendingInfo, error) {
+	entries, err := os.ReadDir(pendingDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []*pendingInfo{}, nil
+		}
+		return nil, err
+	}
+	result := []*pendingInfo{}
+	for _, e := range entries {
+		if !e.IsDir() || !ifaceRx.MatchString(e.Name()) {
+			continue
+		}
+		dirs, err := pendingDirs(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		for _, dir := range dirs {
+			info, err := readPending(e.Name(), dir)
+			if err != nil {
+				continue
+			}
+			result = append(result, info)
+		}
+	}
+	return result, nil
+}
+
+// stagedConfig returns the configuration that applying the bundle staged in
+// dir would install. Bundles are merged into the current config, whose
+// [Interface] section they never replace, so they cannot create an
+// interface that does not exist yet.
+func stagedConfig(name, dir string, info *pendingInfo) (string, error) {
+	current, err := os.ReadFile(filepath.Join("/etc/wireguard", name+".conf"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("%w: interface %s does not exist", ErrValidation, name)
+		}
+		return "", err
+	}
+	if info.Type == validator.TypeConfig {
+		peers, err := os.ReadFile(filepath.Join(dir, "config.conf"))
+		if err != nil {
+			return "", err
+		}
+		merged, err := mergePeerList(string(current), string(peers))
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrValidation, err)
+		}
+		return merged, nil
+	}
+	p, err := stagedPayload(dir, info.Type)
+	if err != nil {
+		return "", err
+	}
+	o := readOrigin(dir)
+	if o == nil {
+		return "", fmt.Errorf("%w: peer delta without a signing node", ErrSignerNotAllowed)
+	}
+	owner, err := nodePeerKey(o.Fingerprint)
+	if err != nil {
+		return "", err
+	}
+	merged, err := mergeDelta(string(current), info.Type, p, owner)
+	if errors.Is(err, ErrBundle) {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrValidation, err)
+	}
+	return merged, nil
+}
+
+// stagedPayload decodes the payload of the peer delta staged in dir.
+func stagedPayload(dir, typ string) (*peerPayload, error) {
+	payload, err := os.ReadFile(filepath.Join(dir, "payload.json"))
+	if err != nil {
+		return nil, err
+	}
+	p, err := decodePeerPayload(typ, payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPayloadInvalid, err)
+	}
+	return p, nil
+}
+
+// getPendingDiff compares the staged configuration with the one currently
+// installed in /etc/wireguard. Key material is redacted from the output.
+func getPendingDiff(name, checksum string) (interface{}, error) {
+	dir, err := pendingPath(name, checksum)
+	if err != nil {
+		return nil, err
+	}
+	info, err := readPending(name, dir)
+	if err != nil {
+		return nil, err
+	}
+	staged, err := stagedConfig(name, dir, info)
+	if err != nil {
+		return nil, err
+	}
+	cfgPath := filepath.Join("/etc/wireguard", name+".conf")
+	current, err := os.ReadFile(cfgPath)
+	exists := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	diff, added, removed := unifiedDiff(cfgPath, filepath.Join(dir, payloadName(&validator.Manifest{Type: info.Type})), sanitizeOutput(string(current)), sanitizeOutput(staged))
+	return map[string]interface{}{
+		"interface": name,
+		"checksum":  info.Checksum,
+		"type":      info.Type,
+		"exists":    exists,
+		"diff":      diff,
+		"added":     added,
+		"removed":   removed,
+	}, nil
+}
+
+// applyPending installs the staged configuration through applyChanges and
+// archives the bundle once the new configuration is live.
+func applyPending(name, checksum string) (interface{}, error) {
+	dir, err := pendingPath(name, checksum)
+	if err != nil {
+		return nil, err
+	}
+	info, err := readPending(name, dir)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := stagedConfig(name, dir, info)
+	if err != nil {
+		auditExchange("apply", name, info.Checksum, err)
+		return nil, err
+	}
+	if _, err := applyChanges(name, cfg); err != nil {
+		auditExchange("apply", name, info.Checksum, err)
+		return nil, err
+	}
+	origin := readOrigin(dir)
+	if origin != nil && info.Type != validator.TypeConfig {
+		p, err := stagedPayload(dir, info.Type)
+		if err == nil {
+			err = recordPeerKey(origin.Fingerprint, info.Type, p)
+		}
+		if err != nil {
+			auditExchange("record-peer-key", name, info.Checksum, err)
+		}
+	}
+	archived, err := archivePending(dir, info, "applied", "")
+	if err != nil {
+		return nil, err
+	}
+	sendReceipt(origin, receiptApplied, "")
+	return map[string]string{"status": "ok", "archive": archived}, nil
+}
+
+// rejectPending discards a staged bundle. When archive is set the bundle is
+// moved to the archive directory instead of being deleted.
+func rejectPending(name, checksum, reason string, archive bool) (interface{}, error) {
+	dir, err := pendingPath(name, checksum)
+	if err != nil {
+		return nil, err
+	}
+	info, err := readPending(name, dir)
+	if err != nil {
+		return nil, err
+	}
+	origin := readOrigin(dir)
+	if archive {
+		archived, err := archivePending(dir, info, "rejected", reason)
+		if err != nil {
+			return nil, err
+		}
+		sendReceipt(origin, receiptRejected, reason)
+		return map[string]string{"status": "ok", "archive": archived}, nil
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	// drop the queue directory of the interface once it is empty
+	os.Remove(filepath.Dir(dir))
+	auditPending(newPendingRecord("rejected", info, reason))
+	sendReceipt(origin, receiptRejected, reason)
+	return map[string]string{"status": "ok"}, nil
+}
+
+func newPendingRecord(action string, info *pendingInfo, reason string) *pendingRecord {
+	return &pendingRecord{
+		Action:    action,
+		Interface: info.Interface,
+		Checksum:  info.Checksum,
+		Actor:     os.Getenv("USER"),
+		Reason:    reason,
+		Time:      time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+func archivePending(dir string, info *pendingInfo, action, reason string) (string, error) {
+	if err := os.MkdirAll(archiveDir, 0700); err != nil {
+		return "", err
+	}
+	dest := filepath.Join(archiveDir, fmt.Sprintf("%s-%s-%d", info.Interface, action, time.Now().UnixNano()))
+	if err := os.Rename(dir, dest); err != nil {
+		return "", err
+	}
+	os.Remove(filepath.Dir(dir))
+	rec := newPendingRecord(action, info, reason)
+	b, _ := json.MarshalIndent(rec, "", "  ")
+	if err := os.WriteFile(filepath.Join(dest, "record.json"), b, 0600); err != nil {
+		return "", err
+	}
+	auditPending(rec)
+	return dest, nil
+}
+
+func auditPending(rec *pendingRecord) {
+	msgBytes, _ := json.Marshal(rec)
+	journal.Send(string(msgBytes), journal.PriInfo, nil)
+}
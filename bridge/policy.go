@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/journal"
+
+	"wg-bridge/internal/config"
+	"wg-bridge/internal/validator"
+)
+
+// exchangePolicyFile enables auto-apply. Without it every bundle waits in
+// the pending directory for an operator.
+const exchangePolicyFile = "/etc/cockpit-wg/exchange-policy"
+
+// policyRule lets bundles from Signer (a keyring name or fingerprint) be
+// applied without operator approval. Empty Interfaces match any interface
+// and empty Types any type but whole configs, which must be listed.
+// MinPrefixV4/MinPrefixV6 reject AllowedIPs wider than the given prefix
+// length, e.g. 24 forbids anything wider than a /24.
+type policyRule struct {
+	Signer      string   `json:"signer"`
+	Interfaces  []string `json:"interfaces"`
+	Types       []string `json:"types"`
+	MinPrefixV4 int      `json:"minPrefixV4"`
+	MinPrefixV6 int      `json:"minPrefixV6"`
+}
+
+type exchangePolicy struct {
+	Rules []policyRule `json:"rules"`
+}
+
+// loadExchangePolicy returns nil when no policy file exists.
+func loadExchangePolicy(path string) (*exchangePolicy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return parseExchangePolicy(path, b)
+}
+
+func parseExchangePolicy(path string, b []byte) (*exchangePolicy, error) {
+	var p exchangePolicy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, r := range p.Rules {
+		if r.Signer == "" {
+			return nil, fmt.Errorf("%s: rule %d has no signer", path, i+1)
+		}
+		if r.MinPrefixV4 < 0 || r.MinPrefixV4 > 32 || r.MinPrefixV6 < 0 || r.MinPrefixV6 > 128 {
+			return nil, fmt.Errorf("%s: rule %d has an invalid prefix limit", path, i+1)
+		}
+	}
+	return &p, nil
+}
+
+// match returns the first rule allowing the bundle, or the reason none did.
+func (p *exchangePolicy) match(s *signer, iface, typ string, allowedIPs []string) (*policyRule, string) {
+	reason := "no rule for signer " + s.Name
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if r.Signer != s.Name && !strings.EqualFold(r.Signer, s.Fingerprint) {
+			continue
+		}
+		if len(r.Interfaces) > 0 && !contains(r.Interfaces, iface) {
+			reason = "interface " + iface + " not allowed"
+			continue
+		}
+		// Whole-config bundles replace the peers of the interface and are
+		// only applied by a rule listing them.
+		if len(r.Types) > 0 && !contains(r.Types, typ) || len(r.Types) == 0 && typ == validator.TypeConfig {
+			reason = "bundle type " + typ + " not allowed"
+			continue
+		}
+		if err := r.checkPrefixes(allowedIPs); err != nil {
+			reason = err.Error()
+			continue
+		}
+		return r, ""
+	}
+	return nil, reason
+}
+
+// checkPrefixes checks the prefix limits of r. A plain address counts as a
+// single-host route, as it does in the config.
+func (r *policyRule) checkPrefixes(allowedIPs []string) error {
+	for _, a := range allowedIPs {
+		nw, ok := config.ParseRoute(strings.TrimSpace(a))
+		if !ok {
+			return fmt.Errorf("invalid AllowedIPs %s", a)
+		}
+		ones, bits := nw.Mask.Size()
+		if bits == 32 && ones < r.MinPrefixV4 || bits == 128 && ones < r.MinPrefixV6 {
+			return fmt.Errorf("AllowedIPs %s wider than permitted", nw)
+		}
+	}
+	return nil
+}
+
+// bundleAllowedIPs lists the AllowedIPs a staged bundle would install: every
+// peer of a whole config, or the single peer of a delta.
+func bundleAllowedIPs(typ string, payload []byte) ([]string, error) {
+	out := []string{}
+	switch typ {
+	case validator.TypeConfig:
+		f, err := config.Parse(string(payload))
+		if err != nil {
+			return nil, err
+		}
+		for _, peer := range f.Summary().Peers {
+			for _, a := range strings.Split(peer["AllowedIPs"], ",") {
+				if a = strings.TrimSpace(a); a != "" {
+					out = append(out, a)
+				}
+			}
+		}
+	default:
+		p, err := decodePeerPayload(typ, payload)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p.AllowedIPs...)
+	}
+	return out, nil
+}
+
+// autoApply applies a freshly staged bundle when the exchange policy allows
+// it. Bundles that do not match, or fail to apply, stay pending.
+func autoApply(s *signer, res *bundleResult, payload []byte) {
+	policy, err := loadExchangePolicy(exchangePolicyFile)
+	if err != nil {
+		res.Policy = err.Error()
+		auditAutoApply(res)
+		return
+	}
+	if policy == nil {
+		return
+	}
+	defer auditAutoApply(res)
+	allowed, err := bundleAllowedIPs(res.Type, payload)
+	if err != nil {
+		res.Policy = err.Error()
+		return
+	}
+	rule, reason := policy.match(s, res.Interface, res.Type, allowed)
+	if rule == nil {
+		res.Policy = reason
+		return
+	}
+	out, err := applyPending(res.Interface, res.Checksum)
+	if err != nil {
+		res.Policy = "apply failed: " + err.Error()
+		return
+	}
+	res.AutoApplied = true
+	res.Policy = "matched rule for " + rule.Signer
+	res.Pending = ""
+	if m, ok := out.(map[string]string); ok {
+		res.Archive = m["archive"]
+	}
+}
+
+func auditAutoApply(res *bundleResult) {
+	fields := map[string]interface{}{
+		"action":  "auto-apply",
+		"iface":   res.Interface,
+		"hash":    res.Checksum,
+		"signer":  res.Signer,
+		"applied": res.AutoApplied,
+		"policy":  res.Policy,
+	}
+	msgBytes, _ := json.Marshal(fields)
+	journal.Send(string(msgBytes), journal.PriInfo, nil)
+}
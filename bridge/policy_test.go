@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"wg-bridge/internal/validator"
+)
+
+func TestLoadExchangePolicy(t *testing.T) {
+	dir := t.TempDir()
+	if p, err := loadExchangePolicy(filepath.Join(dir, "missing")); p != nil || err != nil {
+		t.Fatalf("expected no policy, got %v %v", p, err)
+	}
+	path := filepath.Join(dir, "exchange-policy")
+	os.WriteFile(path, []byte(`{"rules":[{"interfaces":["wg0"]}]}`), 0600)
+	if _, err := loadExchangePolicy(path); err == nil {
+		t.Fatal("expected rule without signer to be rejected")
+	}
+	os.WriteFile(path, []byte(`{"rules":[{"signer":"hq","minPrefixV4":33}]}`), 0600)
+	if _, err := loadExchangePolicy(path); err == nil {
+		t.Fatal("expected invalid prefix limit to be rejected")
+	}
+}
+
+func TestExchangePolicyMatch(t *testing.T) {
+	p := &exchangePolicy{Rules: []policyRule{
+		{Signer: "hq", Interfaces: []string{"wg0"}, Types: []string{validator.TypePeerAdd}, MinPrefixV4: 24, MinPrefixV6: 64},
+		{Signer: "0807060504030201", Interfaces: []string{"wg1"}},
+		{Signer: "branch", Interfaces: []string{"wg2"}, Types: []string{validator.TypeConfig}},
+	}}
+	hq := &signer{Name: "hq", Fingerprint: "AAAAAAAAAAAAAAAA"}
+	branch := &signer{Name: "branch", Fingerprint: "0807060504030201"}
+
+	cases := []struct {
+		s       *signer
+		iface   string
+		typ     string
+		allowed []string
+		ok      bool
+	}{
+		{hq, "wg0", validator.TypePeerAdd, []string{"10.0.0.0/24", "fd00::/64"}, true},
+		{hq, "wg0", validator.TypePeerAdd, []string{"10.0.0.0/16"}, false},
+		{hq, "wg0", validator.TypePeerAdd, []string{"fd00::/48"}, false},
+		{hq, "wg0", validator.TypePeerRemove, nil, false},
+		{hq, "wg1", validator.TypePeerAdd, nil, false},
+		{hq, "wg0", validator.TypePeerAdd, []string{"10.0.0.5", "fd00::5"}, true},
+		{branch, "wg1", validator.TypePeerEndpoint, []string{"0.0.0.0/0"}, true},
+		{branch, "wg1", validator.TypeConfig, []string{"10.0.0.5"}, false},
+		{branch, "wg0", validator.TypePeerAdd, nil, false},
+		{branch, "wg2", validator.TypeConfig, []string{"10.0.0.5"}, true},
+	}
+	for _, c := range cases {
+		rule, reason := p.match(c.s, c.iface, c.typ, c.allowed)
+		if (rule != nil) != c.ok {
+			t.Fatalf("%s %s %s %v: expected ok=%v, got reason %q", c.s.Name, c.iface, c.typ, c.allowed, c.ok, reason)
+		}
+	}
+}
+
+func TestBundleAllowedIPs(t *testing.T) {
+	cfg := "[Interface]\nPrivateKey = x\n\n[Peer]\nPublicKey = a\nAllowedIPs = 10.0.0.2/32, 10.1.0.0/16\n"
+	got, err := bundleAllowedIPs(validator.TypeConfig, []byte(cfg))
+	if err != nil || len(got) != 2 || got[1] != "10.1.0.0/16" {
+		t.Fatalf("unexpected AllowedIPs %v: %v", got, err)
+	}
+}
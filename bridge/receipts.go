@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/journal"
+
+	"wg-bridge/internal/validator"
+)
+
+// Receipt states, in the order a bundle normally passes through them.
+const (
+	receiptAccepted = "accepted"
+	receiptApplied  = "applied"
+	receiptRejected = "rejected"
+)
+
+var (
+	ErrReceiptInvalid   = fmt.Errorf("%w: invalid receipt", ErrBundle)
+	ErrReceiptUnmatched = fmt.Errorf("%w: receipt matches no exported bundle", ErrBundle)
+)
+
+var checksumRx = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// receiptPayload is the payload.json of a receipt bundle. Checksum and
+// Sequence identify the bundle being acknowledged.
+type receiptPayload struct {
+	Status    string `json:"status"`
+	Reason    string `json:"reason,omitempty"`
+	Interface string `json:"interface"`
+	Checksum  string `json:"checksum"`
+	Sequence  uint64 `json:"sequence"`
+	Node      string `json:"node"`
+	Time      string `json:"time"`
+}
+
+// receiptStatus is the latest receipt recorded per node in an outbox entry.
+type receiptStatus struct {
+	Status    string `json:"status"`
+	Reason    string `json:"reason,omitempty"`
+	Signer    string `json:"signer"`
+	Time      string `json:"time"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// bundleOrigin is stored as origin.json in the pending directory so that
+// receipts can still be addressed once the bundle is applied or rejected.
+type bundleOrigin struct {
+	Interface   string `json:"interface"`
+	Checksum    string `json:"checksum"`
+	Sequence    uint64 `json:"sequence"`
+	Signer      string `json:"signer"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+func decodeReceipt(data []byte) (*receiptPayload, error) {
+	var r receiptPayload
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	switch r.Status {
+	case receiptAccepted, receiptApplied, receiptRejected:
+	default:
+		return nil, fmt.Errorf("invalid receipt status %q", r.Status)
+	}
+	if !ifaceRx.MatchString(r.Interface) {
+		return nil, fmt.Errorf("invalid interface name")
+	}
+	if !checksumRx.MatchString(r.Checksum) {
+		return nil, fmt.Errorf("invalid checksum")
+	}
+	if len(r.Reason) > 256 || len(r.Node) > 255 {
+		return nil, fmt.Errorf("receipt field too long")
+	}
+	return &r, nil
+}
+
+// sendReceipt queues a receipt for the node that signed the bundle described
+// by origin. Receipts are only produced for senders in the node directory,
+// since their exchange key is needed to encrypt the receipt; failures are
+// logged and never fail the operation that triggered the receipt. The
+// receipt waits in the outbox until flushOutbox delivers it, so slow
+// transports never hold up the import or apply.
+func sendReceipt(origin *bundleOrigin, status, reason string) {
+	if origin == nil || origin.Fingerprint == "" {
+		return
+	}
+	nodesMu.Lock()
+	dir, err := loadNodes()
+	nodesMu.Unlock()
+	if err != nil {
+		return
+	}
+	var target *node
+	for _, n := range dir.Nodes {
+		if n.SigningFingerprint == origin.Fingerprint {
+			target = n
+			break
+		}
+	}
+	if target == nil {
+		return
+	}
+	if len(reason) > 256 {
+		reason = reason[:256]
+	}
+	host, _ := os.Hostname()
+	payload, _ := json.Marshal(receiptPayload{
+		Status:    status,
+		Reason:    reason,
+		Interface: origin.Interface,
+		Checksum:  origin.Checksum,
+		Sequence:  origin.Sequence,
+		Node:      host,
+		Time:      time.Now().UTC().Format(time.RFC3339),
+	})
+	_, _, err = sealBundle(origin.Interface, validator.TypeReceipt, payload, []string{target.ExchangeKey})
+	auditExchange("receipt-"+status, origin.Interface, origin.Checksum, err)
+	if err == nil {
+		select {
+		case outboxQueued <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// outboxQueued wakes pollTransports when receipts or announcements wait in
+// the outbox.
+var outboxQueued = make(chan struct{}, 1)
+
+// receiptRetention is how long a receipt stays in the outbox when it cannot
+// be delivered, so that it can still be passed on by hand. Announcements
+// are retried for as long.
+const receiptRetention = 7 * 24 * time.Hour
+
+// flushOutbox retries the receipts and key announcements that have not
+// reached every node yet. Receipts are removed once delivered or older than
+// receiptRetention; announcements stay in the outbox as a record.
+func flushOutbox() {
+	entries, err := os.ReadDir(outboxDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() || !outboxNameRx.MatchString(e.Name()) {
+			continue
+		}
+		path := filepath.Join(outboxDir, e.Name())
+		outboxMu.Lock()
+		entry, err := readOutboxEntry(path)
+		outboxMu.Unlock()
+		if err != nil || (entry.Type != validator.TypeReceipt && entry.Type != validator.TypeNodeKeyRotation) {
+			continue
+		}
+		expired := receiptExpired(entry, time.Now())
+		if !receiptDelivered(entry) && !expired {
+			if deliveries, err := retryDelivery(path); err == nil {
+				entry.Deliveries = deliveries
+			}
+		}
+		if entry.Type == validator.TypeReceipt && (receiptDelivered(entry) || expired) {
+			outboxMu.Lock()
+			for _, p := range []string{path, path + ".minisig", path + ".json"} {
+				os.Remove(p)
+			}
+			outboxMu.Unlock()
+		}
+	}
+}
+
+// receiptDelivered reports whether a receipt reached every node it was
+// sent to. Receipts for nodes without a transport have no deliveries.
+func receiptDelivered(entry *outboxEntry) bool {
+	if len(entry.Deliveries) == 0 {
+		return false
+	}
+	for _, d := range entry.Deliveries {
+		if d.Error != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func receiptExpired(entry *outboxEntry, now time.Time) bool {
+	created, err := time.Parse(time.RFC3339, entry.Created)
+	return err == nil && now.Sub(created) > receiptRetention
+}
+
+// rejectionReceipt sends a rejected receipt for a bundle that failed after
+// its signature and manifest had been verified.
+func rejectionReceipt(s *signer, m *validator.Manifest, cause error) {
+	sendReceipt(&bundleOrigin{
+		Interface:   m.Interface,
+		Checksum:    strings.ToLower(m.Checksum),
+		Sequence:    m.Sequence,
+		Signer:      s.Name,
+		Fingerprint: s.Fingerprint,
+	}, receiptRejected, bundleReason(cause))
+}
+
+func writeOrigin(dir string, o *bundleOrigin) error {
+	b, _ := json.Marshal(o)
+	return os.WriteFile(filepath.Join(dir, "origin.json"), b, 0600)
+}
+
+func readOrigin(dir string) *bundleOrigin {
+	b, err := os.ReadFile(filepath.Join(dir, "origin.json"))
+	if err != nil {
+		return nil
+	}
+	var o bundleOrigin
+	if json.Unmarshal(b, &o) != nil {
+		return nil
+	}
+	return &o
+}
+
+// applyReceipt records a receipt from node on entry. Receipts older than
+// the one already recorded are ignored so that a replayed "accepted"
+// receipt cannot hide a later "applied".
+func applyReceipt(entry *outboxEntry, node, signer string, r *receiptPayload, ts int64) bool {
+	if entry.Type == validator.TypeReceipt || entry.Interface != r.Interface || entry.Checksum != r.Checksum {
+		return false
+	}
+	if entry.Sequence != 0 && r.Sequence != 0 && entry.Sequence != r.Sequence {
+		return false
+	}
+	if entry.Receipts == nil {
+		entry.Receipts = map[string]*receiptStatus{}
+	}
+	if old, ok := entry.Receipts[node]; ok && old.Timestamp > ts {
+		return true
+	}
+	entry.Receipts[node] = &receiptStatus{
+		Status:    r.Status,
+		Reason:    r.Reason,
+		Signer:    signer,
+		Time:      r.Time,
+		Timestamp: ts,
+	}
+	return true
+}
+
+// recordReceipt matches a received receipt against the outbox and stores it
+// on every matching entry.
+func recordReceipt(s *signer, m *validator.Manifest, r *receiptPayload) error {
+	name := s.Name
+	nodesMu.Lock()
+	dir, err := loadNodes()
+	nodesMu.Unlock()
+	if err == nil {
+		for _, n := range dir.Nodes {
+			if n.SigningFingerprint == s.Fingerprint {
+				name = n.Name
+				break
+			}
+		}
+	}
+	entries, err := os.ReadDir(outboxDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	matched := false
+	for _, e := range entries {
+		if e.IsDir() || !outboxNameRx.MatchString(e.Name()) {
+			continue
+		}
+		path := filepath.Join(outboxDir, e.Name())
+		applied := false
+		_, err := updateOutboxEntry(path, func(entry *outboxEntry) bool {
+			applied = applyReceipt(entry, name, s.Name, r, m.Timestamp)
+			return applied
+		})
+		if err != nil && applied {
+			return err
+		}
+		matched = matched || applied
+	}
+	if !matched {
+		return fmt.Errorf("%w: %s %s", ErrReceiptUnmatched, r.Interface, r.Checksum)
+	}
+	journal.Send(fmt.Sprintf("{\"action\":\"receipt\",\"iface\":\"%s\",\"hash\":\"%s\",\"node\":\"%s\",\"status\":\"%s\"}", r.Interface, r.Checksum, name, r.Status), journal.PriInfo, nil)
+	return nil
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/journal"
+)
+
+// transportPoll is how often transports are asked for new bundles.
+const transportPoll = 5 * time.Minute
+
+var (
+	remotePathRx = regexp.MustCompile(`^/[A-Za-z0-9_./-]*$`)
+	hostRx       = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.-]{0,252}$`)
+	userRx       = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+)
+
+// transport moves bundles between this node and one remote node.
+type transport interface {
+	// Send delivers an outbox bundle and its signature.
+	Send(path string) error
+	// Fetch moves bundles waiting for this node into inbox and returns
+	// their names.
+	Fetch(inbox string) ([]string, error)
+}
+
+// transportConfig is the per-node transport setting stored in the node
+// directory. Type selects the driver:
+//
+//	dir  Outgoing/Incoming are local (e.g. NFS mounted) directories
+//	ssh  bundles are uploaded with sftp to Outgoing on Host and fetched
+//	     from Incoming
+//	git  Repo is a local git repository used as a mailbox; bundles for a
+//	     node live in a directory named after it
+type transportConfig struct {
+	Type     string `json:"type"`
+	Outgoing string `json:"outgoing,omitempty"`
+	Incoming string `json:"incoming,omitempty"`
+	Host     string `json:"host,omitempty"`
+	User     string `json:"user,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	Identity string `json:"identity,omitempty"`
+	Repo     string `json:"repo,omitempty"`
+	Mailbox  string `json:"mailbox,omitempty"`
+}
+
+func safePath(p string) bool {
+	return p == "" || (remotePathRx.MatchString(p) && !strings.Contains(p, ".."))
+}
+
+// validateTransport checks a transport configuration supplied over RPC.
+// Paths end up on sftp command lines and in remote shells, so only a
+// conservative character set is accepted.
+func validateTransport(c *transportConfig) error {
+	for _, p := range []string{c.Outgoing, c.Incoming, c.Identity, c.Repo} {
+		if !safePath(p) {
+			return fmt.Errorf("%w: invalid transport path %q", ErrValidation, p)
+		}
+	}
+	switch c.Type {
+	case "dir":
+		if c.Outgoing == "" && c.Incoming == "" {
+			return fmt.Errorf("%w: dir transport needs outgoing or incoming", ErrValidation)
+		}
+	case "ssh":
+		if !hostRx.MatchString(c.Host) {
+			return fmt.Errorf("%w: invalid transport host", ErrValidation)
+		}
+		if c.User != "" && !userRx.MatchString(c.User) {
+			return fmt.Errorf("%w: invalid transport user", ErrValidation)
+		}
+		if c.Port < 0 || c.Port > 65535 {
+			return fmt.Errorf("%w: invalid transport port", ErrValidation)
+		}
+		if c.Outgoing == "" && c.Incoming == "" {
+			return fmt.Errorf("%w: ssh transport needs outgoing or incoming", ErrValidation)
+		}
+	case "git":
+		if c.Repo == "" {
+			return fmt.Errorf("%w: git transport needs repo", ErrValidation)
+		}
+		if c.Mailbox != "" && !nodeNameRx.MatchString(c.Mailbox) {
+			return fmt.Errorf("%w: invalid mailbox name", ErrValidation)
+		}
+	default:
+		return fmt.Errorf("%w: unknown transport %q", ErrValidation, c.Type)
+	}
+	return nil
+}
+
+// newTransport returns the driver for n, or nil if n has no transport.
+func newTransport(n *node) transport {
+	c := n.Transport
+	if c == nil {
+		return nil
+	}
+	switch c.Type {
+	case "dir":
+		return &dirTransport{outgoing: c.Outgoing, incoming: c.Incoming}
+	case "ssh":
+		return &sshTransport{cfg: *c}
+	case "git":
+		self := c.Mailbox
+		if self == "" {
+			self, _ = os.Hostname()
+		}
+		return &gitTransport{repo: c.Repo, peer: n.Name, self: self}
+	}
+	return nil
+}
+
+// bundleFiles lists a bundle and its signature. The signature comes first
+// so that an inbox watcher always finds a complete pair once the bundle
+// appears.
+func bundleFiles(path string) []string {
+	return []string{path + ".minisig", path}
+}
+
+// copyFile copies src to dir through a temporary name, so an inbox watcher
+// on the other side never sees a partial .wgx file.
+func copyFile(src, dir string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	dest := filepath.Join(dir, filepath.Base(src))
+	tmp, err := os.CreateTemp(dir, ".incoming-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+// moveBundles moves every complete bundle in src (one with a signature) to
+// dest and returns the bundle names.
+func moveBundles(src, dest string) ([]string, error) {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var moved []string
+	for _, e := range entries {
+		if e.IsDir() || !outboxNameRx.MatchString(e.Name()) {
+			continue
+		}
+		path := filepath.Join(src, e.Name())
+		if _, err := os.Stat(path + ".minisig"); err != nil {
+			continue
+		}
+		for _, f := range bundleFiles(path) {
+			if err := copyFile(f, dest); err != nil {
+				return moved, err
+			}
+			os.Remove(f)
+		}
+		moved = append(moved, e.Name())
+	}
+	return moved, nil
+}
+
+type dirTransport struct {
+	outgoing string
+	incoming string
+}
+
+func (t *dirTransport) Send(path string) error {
+	if t.outgoing == "" {
+		return fmt.Errorf("no outgoing directory configured")
+	}
+	for _, f := range bundleFiles(path) {
+		if err := copyFile(f, t.outgoing); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *dirTransport) Fetch(inbox string) ([]string, error) {
+	if t.incoming == "" {
+		return nil, nil
+	}
+	return moveBundles(t.incoming, inbox)
+}
+
+type sshTransport struct {
+	cfg transportConfig
+}
+
+func (t *sshTransport) target() string {
+	if t.cfg.User != "" {
+		return t.cfg.User + "@" + t.cfg.Host
+	}
+	return t.cfg.Host
+}
+
+// options are passed to sftp. BatchMode makes a missing key fail
+// instead of prompting on the RPC channel.
+func (t *sshTransport) options() []string {
+	opts := []string{"-o", "BatchMode=yes"}
+	if t.cfg.Port != 0 {
+		opts = append(opts, "-P", strconv.Itoa(t.cfg.Port))
+	}
+	if t.cfg.Identity != "" {
+		opts = append(opts, "-i", t.cfg.Identity)
+	}
+	return opts
+}
+
+// partialPrefix and partialSuffix mark a file still being uploaded. Such
+// names never match a bundle, so the other side only sees a bundle once it
+// has been renamed into place.
+const (
+	partialPrefix = ".incoming-"
+	partialSuffix = ".part"
+)
+
+// Send uploads the bundle and its signature under temporary names and then
+// renames them into place, the bundle last, so that Fetch on the other side
+// never takes a bundle that is still being written.
+func (t *sshTransport) Send(path string) error {
+	if t.cfg.Outgoing == "" {
+		return fmt.Errorf("no outgoing directory configured")
+	}
+	var put, rename strings.Builder
+	for _, f := range bundleFiles(path) {
+		dest := t.cfg.Outgoing + "/" + filepath.Base(f)
+		partial := t.cfg.Outgoing + "/" + partialPrefix + filepath.Base(f) + partialSuffix
+		fmt.Fprintf(&put, "put %s %s\n", f, partial)
+		fmt.Fprintf(&rename, "rename %s %s\n", partial, dest)
+	}
+	_, err := t.sftp(put.String() + rename.String())
+	return err
+}
+
+// sftp runs batch and returns its output. The batch stops at the first
+// failing command.
+func (t *sshTransport) sftp(batch string) (string, error) {
+	// -b - reads the batch from stdin
+	cmd := exec.Command("sftp", append(t.options(), "-b", "-", t.target())...)
+	cmd.Stdin = strings.NewReader(batch)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("sftp: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// Fetch takes the bundles listed in Incoming together with their signature.
+// Each pair is fetched in a batch of its own, so a pair is only moved to
+// the inbox and removed from Incoming once both files were read in full.
+func (t *sshTransport) Fetch(inbox string) ([]string, error) {
+	if t.cfg.Incoming == "" {
+		return nil, nil
+	}
+	listing, err := t.sftp(fmt.Sprintf("ls -1 %s\n", t.cfg.Incoming))
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.MkdirTemp("", "wgx-fetch-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	var fetched []string
+	var failed error
+	for _, name := range completeBundles(listing) {
+		remote := t.cfg.Incoming + "/" + name
+		dir, err := os.MkdirTemp(tmp, "")
+		if err != nil {
+			return fetched, err
+		}
+		if _, err := t.sftp(fmt.Sprintf("get %s.minisig %s/\nget %s %s/\n", remote, dir, remote, dir)); err != nil {
+			// left in Incoming for the next poll
+			if failed == nil {
+				failed = err
+			}
+			continue
+		}
+		moved, err := moveBundles(dir, inbox)
+		fetched = append(fetched, moved...)
+		if err != nil {
+			return fetched, err
+		}
+		if _, err := t.sftp(fmt.Sprintf("rm %s\nrm %s.minisig\n", remote, remote)); err != nil && failed == nil {
+			failed = err
+		}
+	}
+	return fetched, failed
+}
+
+// completeBundles returns the bundles in an sftp listing whose signature is
+// listed as well. Files still being uploaded carry a partial name and are
+// not included.
+func completeBundles(listing string) []string {
+	files := map[string]bool{}
+	for _, line := range strings.Split(listing, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "sftp>") {
+			continue
+		}
+		files[path.Base(line)] = true
+	}
+	var names []string
+	for name := range files {
+		if outboxNameRx.MatchString(name) && files[name+".minisig"] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// gitTransport uses a local clone as a mailbox. When the clone has a remote
+// it is pulled before and pushed after every change.
+type gitTransport struct {
+	repo string
+	peer string
+	self string
+}
+
+func (t *gitTransport) git(args ...string) error {
+	cmd := exec.Command("git", append([]string{"-C", t.repo}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=cockpit-wg", "GIT_AUTHOR_EMAIL=cockpit-wg@localhost",
+		"GIT_COMMITTER_NAME=cockpit-wg", "GIT_COMMITTER_EMAIL=cockpit-wg@localhost")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (t *gitTransport) hasRemote() bool {
+	out, err := exec.Command("git", "-C", t.repo, "remote").Output()
+	return err == nil && strings.TrimSpace(string(out)) != ""
+}
+
+func (t *gitTransport) sync(message string, paths ...string) error {
+	if err := t.git(append([]string{"add", "-A", "--"}, paths...)...); err != nil {
+		return err
+	}
+	if err := t.git("commit", "-q", "-m", message, "--", "."); err != nil {
+		return err
+	}
+	if t.hasRemote() {
+		return t.git("push", "-q")
+	}
+	return nil
+}
+
+func (t *gitTransport) pull() error {
+	if t.hasRemote() {
+		return t.git("pull", "-q", "--ff-only")
+	}
+	return nil
+}
+
+func (t *gitTransport) Send(path string) error {
+	if err := t.pull(); err != nil {
+		return err
+	}
+	dir := filepath.Join(t.repo, t.peer)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for _, f := range bundleFiles(path) {
+		if err := copyFile(f, dir); err != nil {
+			return err
+		}
+	}
+	return t.sync("deliver "+filepath.Base(path)+" to "+t.peer, t.peer)
+}
+
+func (t *gitTransport) Fetch(inbox string) ([]string, error) {
+	if err := t.pull(); err != nil {
+		return nil, err
+	}
+	fetched, err := moveBundles(filepath.Join(t.repo, t.self), inbox)
+	if len(fetched) > 0 {
+		if serr := t.sync("fetch "+strings.Join(fetched, " "), t.self); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	return fetched, err
+}
+
+// deliveryStatus records the outcome of sending a bundle to one node.
+type deliveryStatus struct {
+	Transport string `json:"transport"`
+	Time      string `json:"time"`
+	Error     string `json:"error,omitempty"`
+}
+
+// deliverBundle sends an outbox bundle to every recipient node that has a
+// transport configured and records the result in the outbox entry.
+func deliverBundle(path string) (map[string]*deliveryStatus, error) {
+	return sendBundle(path, false)
+}
+
+// retryDelivery sends an outbox bundle to the recipient nodes it has not
+// reached yet.
+func retryDelivery(path string) (map[string]*deliveryStatus, error) {
+	return sendBundle(path, true)
+}
+
+// sendBundle does not hold outboxMu while transports run; their results
+// are merged into the entry as it is when they finish.
+func sendBundle(path string, retry bool) (map[string]*deliveryStatus, error) {
+	outboxMu.Lock()
+	entry, err := readOutboxEntry(path)
+	outboxMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	nodesMu.Lock()
+	dir, err := loadNodes()
+	nodesMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	sent := map[string]*deliveryStatus{}
+	for _, n := range dir.Nodes {
+		t := newTransport(n)
+		if t == nil || !contains(entry.Recipients, n.ExchangeKey) {
+			continue
+		}
+		if d := entry.Deliveries[n.Name]; retry && d != nil && d.Error == "" {
+			continue
+		}
+		st := &deliveryStatus{Transport: n.Transport.Type, Time: time.Now().UTC().Format(time.RFC3339)}
+		if err := t.Send(path); err != nil {
+			st.Error = err.Error()
+		}
+		sent[n.Name] = st
+		auditExchange("deliver", entry.Interface, entry.Checksum, errorOrNil(st.Error))
+	}
+	entry, err = updateOutboxEntry(path, func(e *outboxEntry) bool {
+		if e.Deliveries == nil {
+			e.Deliveries = map[string]*deliveryStatus{}
+		}
+		for name, st := range sent {
+			e.Deliveries[name] = st
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry.Deliveries, nil
+}
+
+func errorOrNil(msg string) error {
+	if msg == "" {
+		return nil
+	}
+	return errors.New(msg)
+}
+
+// fetchBundles pulls waiting bundles from every node with a transport into
+// the inbox, where the inbox watcher picks them up.
+func fetchBundles() (map[string]interface{}, error) {
+	nodesMu.Lock()
+	dir, err := loadNodes()
+	nodesMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(inboxDir, 0700); err != nil {
+		return nil, err
+	}
+	result := map[string]interface{}{}
+	for _, n := range dir.Nodes {
+		t := newTransport(n)
+		if t == nil {
+			continue
+		}
+		fetched, err := t.Fetch(inboxDir)
+		status := map[string]interface{}{"transport": n.Transport.Type, "fetched": len(fetched)}
+		if err != nil {
+			status["error"] = err.Error()
+			msg, _ := json.Marshal(map[string]string{"action": "fetch", "node": n.Name, "error": err.Error()})
+			journal.Send(string(msg), journal.PriErr, nil)
+		}
+		result[n.Name] = status
+	}
+	return result, nil
+}
+
+// pollTransports fetches bundles periodically while the bridge runs and
+// delivers queued receipts and announcements, right away when one is
+// queued.
+func pollTransports() {
+	poll := time.NewTicker(transportPoll)
+	defer poll.Stop()
+	fetchBundles()
+	for {
+		flushOutbox()
+		select {
+		case <-poll.C:
+			fetchBundles()
+		case <-outboxQueued:
+		}
+	}
+}
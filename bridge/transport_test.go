@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestBundle(t *testing.T, dir, name string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("bundle"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+".minisig", []byte("sig"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDirTransport(t *testing.T) {
+	out, shared, inbox := t.TempDir(), t.TempDir(), t.TempDir()
+	path := writeTestBundle(t, out, "wg0-1.wgx")
+
+	sender := &dirTransport{outgoing: shared}
+	if err := sender.Send(path); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	// a bundle without signature is left alone
+	os.WriteFile(filepath.Join(shared, "wg0-2.wgx"), []byte("partial"), 0600)
+
+	receiver := &dirTransport{incoming: shared}
+	fetched, err := receiver.Fetch(inbox)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if len(fetched) != 1 || fetched[0] != "wg0-1.wgx" {
+		t.Fatalf("unexpected fetch result %v", fetched)
+	}
+	for _, f := range []string{"wg0-1.wgx", "wg0-1.wgx.minisig"} {
+		if _, err := os.Stat(filepath.Join(inbox, f)); err != nil {
+			t.Fatalf("expected %s in inbox: %v", f, err)
+		}
+		if _, err := os.Stat(filepath.Join(shared, f)); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected %s removed from shared dir", f)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(shared, "wg0-2.wgx")); err != nil {
+		t.Fatalf("expected unsigned bundle to stay: %v", err)
+	}
+}
+
+func TestGitTransport(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	repo, out, inbox := t.TempDir(), t.TempDir(), t.TempDir()
+	if err := exec.Command("git", "init", "-q", repo).Run(); err != nil {
+		t.Fatalf("git init: %v", err)
+	}
+	path := writeTestBundle(t, out, "wg0-1.wgx")
+
+	if err := (&gitTransport{repo: repo, peer: "branch1", self: "hq"}).Send(path); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	fetched, err := (&gitTransport{repo: repo, peer: "hq", self: "branch1"}).Fetch(inbox)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if len(fetched) != 1 {
+		t.Fatalf("unexpected fetch result %v", fetched)
+	}
+	if _, err := os.Stat(filepath.Join(inbox, "wg0-1.wgx.minisig")); err != nil {
+		t.Fatalf("expected signature in inbox: %v", err)
+	}
+	status, err := exec.Command("git", "-C", repo, "status", "--porcelain").Output()
+	if err != nil || len(status) != 0 {
+		t.Fatalf("expected clean mailbox, got %q: %v", status, err)
+	}
+}
+
+func TestCompleteBundles(t *testing.T) {
+	listing := `sftp> ls -1 /srv/incoming
+/srv/incoming/.incoming-wg0-3.wgx.part
+/srv/incoming/wg0-1.wgx
+/srv/incoming/wg0-1.wgx.minisig
+/srv/incoming/wg0-2.wgx.minisig
+/srv/incoming/wg0-3.wgx.minisig
+/srv/incoming/wg0-4.wgx
+`
+	names := completeBundles(listing)
+	if len(names) != 1 || names[0] != "wg0-1.wgx" {
+		t.Fatalf("expected only the renamed pair, got %v", names)
+	}
+}
+
+func TestValidateTransport(t *testing.T) {
+	good := []transportConfig{
+		{Type: "dir", Outgoing: "/mnt/exchange/out"},
+		{Type: "ssh", Host: "vpn.example.com", User: "wgx", Port: 2222, Outgoing: "/var/lib/cockpit-wg/inbox"},
+		{Type: "git", Repo: "/srv/mailbox"},
+	}
+	for _, c := range good {
+		if err := validateTransport(&c); err != nil {
+			t.Fatalf("expected %+v to be valid, got %v", c, err)
+		}
+	}
+	bad := []transportConfig{
+		{Type: "ftp", Outgoing: "/x"},
+		{Type: "dir"},
+		{Type: "dir", Outgoing: "relative/path"},
+		{Type: "dir", Outgoing: "/a/../etc"},
+		{Type: "ssh", Host: "-oProxyCommand=x", Outgoing: "/x"},
+		{Type: "ssh", Host: "host", Outgoing: "/x; rm -rf /"},
+		{Type: "git"},
+	}
+	for _, c := range bad {
+		if err := validateTransport(&c); !errors.Is(err, ErrValidation) {
+			t.Fatalf("expected %+v to be rejected, got %v", c, err)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"wg-bridge/internal/config"
+	"wg-bridge/internal/validator"
+)
+
+// validationPolicyFile selects strict or lenient validation per interface.
+const validationPolicyFile = "/etc/cockpit-wg/validation-policy"
+
+// lintConfigFile enables, disables and tunes the lint rules.
+const lintConfigFile = "/etc/cockpit-wg/lint.yaml"
+
+const (
+	validationStrict  = "strict"
+	validationLenient = "lenient"
+)
+
+// validationPolicy decides how configs are validated. Strict, the default,
+// requires at least one peer and rejects catch-all AllowedIPs such as
+// 0.0.0.0/0. Lenient accepts both, as a client routing all of its traffic
+// through the tunnel needs. Interfaces overrides Default per interface.
+type validationPolicy struct {
+	Default    string            `json:"default"`
+	Interfaces map[string]string `json:"interfaces"`
+
+	// routes limits the AllowedIPs of each interface
+	routes *allowedIPsPolicy
+	// lint sets up the lint rules run after validation
+	lint *validator.LintConfig
+	// publicKey returns the public key peers have on file for an
+	// interface, or "" if none is known. The PrivateKey of its config must
+	// belong to that key.
+	publicKey func(name string) string
+}
+
+// loadValidationPolicy returns the defaults when no policy file exists.
+func loadValidationPolicy(path string) (*validationPolicy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &validationPolicy{Default: validationStrict}, nil
+		}
+		return nil, err
+	}
+	return parseValidationPolicy(path, b)
+}
+
+func parseValidationPolicy(path string, b []byte) (*validationPolicy, error) {
+	p := &validationPolicy{Default: validationStrict}
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if !validMode(p.Default) {
+		return nil, fmt.Errorf("%s: invalid default mode %q", path, p.Default)
+	}
+	for name, mode := range p.Interfaces {
+		if !ifaceRx.MatchString(name) {
+			return nil, fmt.Errorf("%s: invalid interface name %q", path, name)
+		}
+		if !validMode(mode) {
+			return nil, fmt.Errorf("%s: invalid mode %q for %s", path, mode, name)
+		}
+	}
+	return p, nil
+}
+
+// loadLintConfig returns nil, running every rule with its defaults, when
+// no lint file exists.
+func loadLintConfig(path string) (*validator.LintConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	c, err := validator.ParseLintConfig(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// loadValidation loads the installed validation policy, AllowedIPs policy
+// and lint rules. The key of a running interface is the one its peers have
+// on file, as for CheckKeyPair.
+func loadValidation() (*validationPolicy, error) {
+	policy, err := loadValidationPolicy(validationPolicyFile)
+	if err != nil {
+		return nil, err
+	}
+	policy.publicKey = runningPublicKey
+	if policy.routes, err = loadAllowedIPsPolicy(allowedIPsPolicyFile); err != nil {
+		return nil, err
+	}
+	if policy.lint, err = loadLintConfig(lintConfigFile); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func validMode(mode string) bool {
+	return mode == validationStrict || mode == validationLenient
+}
+
+// mode returns the validation mode of the interface name. An empty name,
+// used for text not tied to an interface, gets the default.
+func (p *validationPolicy) mode(name string) string {
+	if mode, ok := p.Interfaces[name]; ok {
+		return mode
+	}
+	return p.Default
+}
+
+// validator returns a validator set up for the config of name.
+func (p *validationPolicy) validator(name string) *validator.ConfigValidator {
+	mode := p.mode(name)
+	v := validator.NewValidator(mode == validationStrict)
+	if p.routes != nil {
+		v.SetRouteLimits(p.routes.limits(name, mode == validationLenient))
+	}
+	if p.publicKey != nil && name != "" {
+		if pub := p.publicKey(name); pub != "" {
+			v.ExpectPublicKey(pub)
+		}
+	}
+	return v
+}
+
+// check parses and validates text as the config of name. Every config the
+// bridge writes or imports goes through here, so that a config is valid in
+// the UI exactly when it would be accepted for installation.
+func (p *validationPolicy) check(name, text string) (*configSummary, error) {
+	summary, diags := p.diagnose(name, text)
+	if config.HasErrors(diags) {
+		return nil, &diagnosticsError{Diagnostics: diags}
+	}
+	return summary, nil
+}
+
+// diagnose reports every problem of text as the config of name, followed
+// by the findings of the lint rules. A lint rule set to severity error
+// makes the config invalid like any other error.
+func (p *validationPolicy) diagnose(name, text string) (*configSummary, []config.Diagnostic) {
+	f, diags := p.validator(name).Diagnose(text)
+	diags = append(diags, validator.NewLinter(p.lint).Lint(name, f)...)
+	config.SortDiagnostics(diags)
+	return f.Summary(), diags
+}
+
+// diagnosticsError is a validation error carrying all diagnostics of a
+// config. wrapError passes them to the UI as the data of the RPC error.
+type diagnosticsError struct {
+	Diagnostics []config.Diagnostic
+}
+
+func (e *diagnosticsError) Error() string {
+	var first config.Diagnostic
+	n := 0
+	for _, d := range e.Diagnostics {
+		if d.Severity == config.SeverityError {
+			if n == 0 {
+				first = d
+			}
+			n++
+		}
+	}
+	msg := fmt.Sprintf("%v: %s", ErrValidation, first)
+	if n > 1 {
+		msg += fmt.Sprintf(" (and %d more)", n-1)
+	}
+	return msg
+}
+
+func (e *diagnosticsError) Unwrap() error {
+	return ErrValidation
+}
+
+// checkConfig validates text as the config of name under the installed
+// validation policy and lint rules.
+func checkConfig(name, text string) (*configSummary, error) {
+	policy, err := loadValidation()
+	if err != nil {
+		return nil, err
+	}
+	return policy.check(name, text)
+}
+
+// diagnoseConfig reports every problem of text as the config of name under
+// the installed validation policy and lint rules. Unlike checkConfig it
+// does not fail when there are errors.
+func diagnoseConfig(name, text string) (*configSummary, []config.Diagnostic, error) {
+	policy, err := loadValidation()
+	if err != nil {
+		return nil, nil, err
+	}
+	summary, diags := policy.diagnose(name, text)
+	return summary, diags, nil
+}
+
+// checkRoutes checks AllowedIPs about to be given to a peer of name
+// against the installed AllowedIPs policy, so that a request or bundle
+// breaking it is turned down before anything is generated or staged.
+func checkRoutes(name string, routes []string) error {
+	policy, err := loadValidation()
+	if err != nil {
+		return err
+	}
+	if err := policy.validator(name).CheckRoutes(routes); err != nil {
+		return fmt.Errorf("%w: %v", ErrValidation, err)
+	}
+	return nil
+}
+
+// validateConfig implements the ValidateConfig RPC. name is optional and
+// selects the interface whose policy applies. Warnings come with the
+// result; errors fail the call and carry every diagnostic.
+func validateConfig(name, text string) (interface{}, error) {
+	if name != "" && !ifaceRx.MatchString(name) {
+		return nil, fmt.Errorf("%w: invalid interface name", ErrValidation)
+	}
+	policy, err := loadValidation()
+	if err != nil {
+		return nil, err
+	}
+	summary, diags := policy.diagnose(name, text)
+	if config.HasErrors(diags) {
+		return nil, &diagnosticsError{Diagnostics: diags}
+	}
+	return map[string]interface{}{"summary": summary, "mode": policy.mode(name), "diagnostics": diags}, nil
+}
+
+// lintInterfaces diagnoses the config of every interface for the self-test.
+func lintInterfaces() (map[string][]config.Diagnostic, error) {
+	policy, err := loadValidation()
+	if err != nil {
+		return nil, err
+	}
+	res, err := listInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	out := map[string][]config.Diagnostic{}
+	for _, name := range res.(map[string]interface{})["interfaces"].([]string) {
+		data, err := os.ReadFile(filepath.Join("/etc/wireguard", name+".conf"))
+		if err != nil {
+			return nil, err
+		}
+		_, out[name] = policy.diagnose(name, string(data))
+	}
+	return out, nil
+}
+
+// countSeverities summarizes diagnostics as "1 error, 2 warnings, 0 info".
+func countSeverities(diags []config.Diagnostic) string {
+	n := map[config.Severity]int{}
+	for _, d := range diags {
+		n[d.Severity]++
+	}
+	plural := func(count int, word string) string {
+		if count == 1 {
+			return fmt.Sprintf("%d %s", count, word)
+		}
+		return fmt.Sprintf("%d %ss", count, word)
+	}
+	return fmt.Sprintf("%s, %s, %d info", plural(n[config.SeverityError], "error"), plural(n[config.SeverityWarning], "warning"), n[config.SeverityInfo])
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"wg-bridge/internal/config"
+)
+
+func TestParseValidationPolicy(t *testing.T) {
+	p, err := parseValidationPolicy("p", []byte(`{"interfaces":{"wg1":"lenient"}}`))
+	if err != nil {
+		t.Fatalf("parseValidationPolicy: %v", err)
+	}
+	if p.mode("wg0") != validationStrict || p.mode("") != validationStrict || p.mode("wg1") != validationLenient {
+		t.Fatalf("unexpected modes %+v", p)
+	}
+	for _, b := range []string{
+		`{"default":"relaxed"}`,
+		`{"interfaces":{"wg0":"off"}}`,
+		`{"interfaces":{"../wg0":"strict"}}`,
+		`not json`,
+	} {
+		if _, err := parseValidationPolicy("p", []byte(b)); err == nil {
+			t.Errorf("%s: expected policy to be rejected", b)
+		}
+	}
+}
+
+func TestValidationPolicyModes(t *testing.T) {
+	priv, _, _ := genKeyPair()
+	_, peer, _ := genKeyPair()
+	iface := "[Interface]\nPrivateKey = " + priv + "\n"
+	withPeer := func(allowed string) string {
+		return iface + "\n[Peer]\nPublicKey = " + peer + "\nAllowedIPs = " + allowed + "\n"
+	}
+	p := &validationPolicy{Default: validationStrict, Interfaces: map[string]string{"wg1": validationLenient}}
+
+	cases := []struct {
+		name, text      string
+		strict, lenient bool
+	}{
+		{"peer", withPeer("10.0.0.2/32"), true, true},
+		{"no peers", iface, false, true},
+		{"catch-all", withPeer("0.0.0.0/0, ::/0"), false, true},
+		{"invalid AllowedIPs", withPeer("10.0.0.300/32"), false, false},
+		{"placeholder key", "[Interface]\nPrivateKey = x\n", false, false},
+		{"no interface", "[Peer]\nPublicKey = " + peer + "\n", false, false},
+	}
+	for _, tc := range cases {
+		for iface, want := range map[string]bool{"wg0": tc.strict, "wg1": tc.lenient} {
+			_, err := p.check(iface, tc.text)
+			if want && err != nil {
+				t.Errorf("%s on %s: unexpected error %v", tc.name, iface, err)
+			}
+			if !want && !errors.Is(err, ErrValidation) {
+				t.Errorf("%s on %s: expected ErrValidation, got %v", tc.name, iface, err)
+			}
+		}
+	}
+}
+
+func TestValidationPolicyPublicKey(t *testing.T) {
+	priv, pub, _ := genKeyPair()
+	_, other, _ := genKeyPair()
+	_, peer, _ := genKeyPair()
+	text := "[Interface]\nPrivateKey = " + priv + "\n\n[Peer]\nPublicKey = " + peer + "\nAllowedIPs = 10.0.0.2/32\n"
+	running := map[string]string{"wg0": pub, "wg1": other}
+	p := &validationPolicy{Default: validationStrict, publicKey: func(name string) string { return running[name] }}
+
+	for _, name := range []string{"", "wg0", "wg2"} {
+		if _, err := p.check(name, text); err != nil {
+			t.Errorf("%q: unexpected error %v", name, err)
+		}
+	}
+	_, err := p.check("wg1", text)
+	var de *diagnosticsError
+	if !errors.As(err, &de) || de.Diagnostics[0].Rule != "key-mismatch" {
+		t.Fatalf("expected key-mismatch, got %v", err)
+	}
+}
+
+func TestValidateConfigDiagnostics(t *testing.T) {
+	priv, _, _ := genKeyPair()
+	_, peer, _ := genKeyPair()
+	text := "[Interface]\nPrivateKey = " + priv + "\nListenPort = 0\nMTU = 10\n\n[Peer]\nPublicKey = " + peer + "\nAllowedIPs = 10.0.0.2/32\n"
+	_, err := validateConfig("", text)
+	var de *diagnosticsError
+	if !errors.As(err, &de) || countSeverities(de.Diagnostics) != "2 errors, 0 warnings, 1 info" {
+		t.Fatalf("expected both problems to be reported, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "line 3: invalid ListenPort") || !strings.Contains(err.Error(), "and 1 more") {
+		t.Errorf("unexpected message %q", err)
+	}
+	re := wrapError(err)
+	if re.Code != CodeValidationFailed || re.Data.(map[string]interface{})["diagnostics"] == nil {
+		t.Errorf("diagnostics missing from the RPC error: %+v", re)
+	}
+
+	text = strings.Replace(text, "ListenPort = 0\nMTU = 10\n", "Frobnicate = 1\n", 1)
+	res, err := validateConfig("", text)
+	if err != nil {
+		t.Fatalf("warnings must not fail validation: %v", err)
+	}
+	diags := res.(map[string]interface{})["diagnostics"].([]config.Diagnostic)
+	if len(diags) != 2 || diags[0].Rule != "unknown-key" || diags[0].Severity != config.SeverityWarning ||
+		diags[1].Rule != "missing-preshared-key" {
+		t.Errorf("diagnostics = %+v", diags)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"wg-bridge/internal/config"
+	"wg-bridge/internal/validator"
+)
+
+// WireGuard keys are generated in-process with curve25519 and are the same
+// as those of wg genkey, wg pubkey and wg genpsk.
+
+func genKeyPair() (string, string, error) {
+	priv, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return "", "", err
+	}
+	return priv.String(), priv.PublicKey().String(), nil
+}
+
+func genPSK() (string, error) {
+	k, err := wgtypes.GenerateKey()
+	if err != nil {
+		return "", err
+	}
+	return k.String(), nil
+}
+
+// checkKeyPair reports whether the PrivateKey in the config of name belongs
+// to pub, the public key peers have on file. Without pub, the key of the
+// running interface is used.
+func checkKeyPair(name, pub string) (interface{}, error) {
+	if !ifaceRx.MatchString(name) {
+		return nil, fmt.Errorf("%w: invalid interface name", ErrValidation)
+	}
+	data, err := os.ReadFile(filepath.Join("/etc/wireguard", name+".conf"))
+	if err != nil {
+		return nil, err
+	}
+	summary, err := config.NewParser(false).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrValidation, err)
+	}
+	priv := summary.Interface["PrivateKey"]
+	derived, err := validator.DerivePublicKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("%w: PrivateKey: %v", ErrValidation, err)
+	}
+	result := map[string]interface{}{"publicKey": derived}
+	source := "request"
+	if pub == "" {
+		if pub = runningPublicKey(name); pub == "" {
+			return result, nil
+		}
+		source = "interface"
+	}
+	err = validator.CheckKeyPair(priv, pub)
+	if err != nil && !errors.Is(err, validator.ErrKeyMismatch) {
+		return nil, fmt.Errorf("%w: %v", ErrValidation, err)
+	}
+	result["expected"] = pub
+	result["source"] = source
+	result["match"] = err == nil
+	return result, nil
+}
+
+// runningPublicKey returns the public key of the interface if it is up.
+func runningPublicKey(name string) string {
+	client, err := wgctrl.New()
+	if err != nil {
+		return ""
+	}
+	defer client.Close()
+	dev, err := client.Device(name)
+	if err != nil {
+		return ""
+	}
+	return dev.PublicKey.String()
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"wg-bridge/internal/validator"
+)
+
+func TestGenKeyPair(t *testing.T) {
+	priv, pub, err := genKeyPair()
+	if err != nil {
+		t.Fatalf("genKeyPair: %v", err)
+	}
+	if err := validator.CheckKeyPair(priv, pub); err != nil {
+		t.Fatalf("generated pair does not match: %v", err)
+	}
+	psk, err := genPSK()
+	if err != nil || len(psk) != 44 || psk == priv {
+		t.Fatalf("genPSK = %q, %v", psk, err)
+	}
+}
+
+func TestCheckConfigRejectsWeakKeys(t *testing.T) {
+	priv, pub, _ := genKeyPair()
+	_, peer, _ := genKeyPair()
+	dummy := "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+	cfg := func(priv, peer string) string {
+		return "[Interface]\nPrivateKey = " + priv + "\n\n[Peer]\nPublicKey = " + peer + "\nAllowedIPs = 10.0.0.2/32\n"
+	}
+	if _, err := checkConfig("wg0", cfg(priv, peer)); err != nil {
+		t.Fatalf("expected generated keys to pass: %v", err)
+	}
+	for name, text := range map[string]string{
+		"dummy private key": cfg(dummy, peer),
+		"dummy peer key":    cfg(priv, dummy),
+		"own key as peer":   cfg(priv, pub),
+	} {
+		if _, err := checkConfig("wg0", text); err == nil {
+			t.Errorf("%s: expected config to be rejected", name)
+		}
+	}
+	if _, err := checkConfig("wg0", cfg(priv, peer)+"PresharedKey = "+dummy+"\n"); err == nil || !strings.Contains(err.Error(), "PresharedKey") {
+		t.Errorf("expected dummy PresharedKey to be rejected, got %v", err)
+	}
+}
@@ -14,10 +14,18 @@ Cockpit plugin for managing WireGuard.
 %attr(0755,root,root) /usr/share/cockpit/cockpit-wg/wg-bridge
 /usr/share/cockpit/cockpit-wg/*
 /usr/share/polkit-1/actions/org.cockpit-project.cockpit-wg.policy
+/usr/lib/systemd/system/cockpit-wg-key-rotation.service
+/usr/lib/systemd/system/cockpit-wg-key-rotation.timer
 
 %post
 /usr/bin/pkcheck --version >/dev/null 2>&1 || true
 /usr/bin/systemctl daemon-reload >/dev/null 2>&1 || true
+/usr/bin/systemctl enable --now cockpit-wg-key-rotation.timer >/dev/null 2>&1 || true
+
+%preun
+if [ $1 -eq 0 ]; then
+  /usr/bin/systemctl disable --now cockpit-wg-key-rotation.timer >/dev/null 2>&1 || true
+fi
 
 %postun
 rm -rf /usr/share/cockpit/cockpit-wg
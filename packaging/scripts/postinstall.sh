@@ -7,5 +7,6 @@ if command -v pkcheck >/dev/null 2>&1; then
 fi
 if command -v systemctl >/dev/null 2>&1; then
   systemctl daemon-reload >/dev/null 2>&1 || true
+  systemctl enable --now cockpit-wg-key-rotation.timer >/dev/null 2>&1 || true
 fi
 exit 0
@@ -0,0 +1,6 @@
+#!/bin/sh
+set -e
+if command -v systemctl >/dev/null 2>&1; then
+  systemctl disable --now cockpit-wg-key-rotation.timer >/dev/null 2>&1 || true
+fi
+exit 0
@@ -10,6 +10,15 @@ import { useTranslation } from "react-i18next";
 import backend from "./backend";
 import QRCode from "qrcode";
 
+const toBase64 = async (file: File): Promise<string> => {
+  const bytes = new Uint8Array(await file.arrayBuffer());
+  let binary = "";
+  bytes.forEach((b) => {
+    binary += String.fromCharCode(b);
+  });
+  return btoa(binary);
+};
+
 const Exchange: React.FC = () => {
   const { t } = useTranslation();
   const [key, setKey] = useState("");
@@ -35,10 +44,12 @@ const Exchange: React.FC = () => {
   };
 
   const handleImport = async (e: React.ChangeEvent<HTMLInputElement>) => {
-    const file = e.target.files?.[0];
-    if (!file) return;
-    const content = await file.text();
-    await backend.importBundle(content);
+    const files = Array.from(e.target.files ?? []);
+    const bundle = files.find((f) => f.name.endsWith(".wgx"));
+    if (!bundle) return;
+    const sig = files.find((f) => f.name.endsWith(".minisig"));
+    const signature = sig ? await sig.text() : "";
+    await backend.importBundle(await toBase64(bundle), signature);
     setImported(true);
   };
 
@@ -60,7 +71,8 @@ const Exchange: React.FC = () => {
       {qr && <img src={qr} alt={t("exchange.pubKeyLabel")} />}
       <input
         type="file"
-        accept=".wgx"
+        accept=".wgx,.minisig"
+        multiple
         onChange={handleImport}
         aria-label={t('exchange.importBundle')}
         data-testid="bundle-input"
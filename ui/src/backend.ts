@@ -84,6 +84,10 @@ class Backend {
     return this.call("ListInterfaces");
   }
 
+  validateConfig(text: string, name = ""): Promise<any> {
+    return this.call("ValidateConfig", { name, text });
+  }
+
   getInterfaceStatus(name: string): Promise<any> {
     return this.call("GetInterfaceStatus", { name });
   }
@@ -120,8 +124,56 @@ class Backend {
     return this.call("UpdatePeer", { name, publicKey, peer });
   }
 
-  importBundle(bundle: string): Promise<any> {
-    return this.call("ImportBundle", { bundle });
+  importBundle(bundle: string, signature: string): Promise<any> {
+    return this.call("ImportBundle", { bundle, signature });
+  }
+
+  listOutbox(): Promise<any> {
+    return this.call("ListOutbox");
+  }
+
+  downloadBundle(file: string, offset = 0, length = 0): Promise<any> {
+    return this.call("DownloadBundle", { file, offset, length });
+  }
+
+  deleteOutboxBundle(file: string): Promise<any> {
+    return this.call("DeleteOutboxBundle", { file });
+  }
+
+  deliverBundle(file: string): Promise<any> {
+    return this.call("DeliverBundle", { file });
+  }
+
+  fetchBundles(): Promise<any> {
+    return this.call("FetchBundles");
+  }
+
+  listNodes(): Promise<any> {
+    return this.call("ListNodes");
+  }
+
+  addNode(node: any): Promise<any> {
+    return this.call("AddNode", node);
+  }
+
+  removeNode(name: string): Promise<any> {
+    return this.call("RemoveNode", { name });
+  }
+
+  listSigners(): Promise<any> {
+    return this.call("ListSigners");
+  }
+
+  addSigner(signer: any): Promise<any> {
+    return this.call("AddSigner", signer);
+  }
+
+  revokeSigner(name: string, reason: string): Promise<any> {
+    return this.call("RevokeSigner", { name, reason });
+  }
+
+  removeSigner(name: string): Promise<any> {
+    return this.call("RemoveSigner", { name });
   }
 
   getExchangeKey(): Promise<any> {
@@ -131,6 +183,34 @@ class Backend {
   rotateKeys(): Promise<any> {
     return this.call("RotateKeys");
   }
+
+  getKeyStatus(): Promise<any> {
+    return this.call("GetKeyStatus");
+  }
+
+  checkKeyPair(name: string, publicKey = ""): Promise<any> {
+    return this.call("CheckKeyPair", { name, publicKey });
+  }
+
+  repairKeys(): Promise<any> {
+    return this.call("RepairKeys");
+  }
+
+  listKeyArchive(): Promise<any> {
+    return this.call("ListKeyArchive");
+  }
+
+  getKeyRotation(): Promise<any> {
+    return this.call("GetKeyRotation");
+  }
+
+  createBackup(passphrase: string): Promise<any> {
+    return this.call("CreateBackup", { passphrase });
+  }
+
+  restoreBackup(file: string, passphrase: string, dryRun = false): Promise<any> {
+    return this.call("RestoreBackup", { file, passphrase, dryRun });
+  }
 }
 
 export default new Backend();
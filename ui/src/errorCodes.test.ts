@@ -5,6 +5,7 @@ import {
   CodeValidationFailed,
   CodePermissionDenied,
   CodeMetricsUnavailable,
+  CodeBundleRejected,
 } from './errorCodes';
 import './i18n';
 
@@ -16,5 +17,6 @@ describe('errorCodes mapping', () => {
     expect(i18n.t(errorMessages[CodeValidationFailed])).toBe('Configuration validation failed');
     expect(i18n.t(errorMessages[CodePermissionDenied])).toBe('Permission denied');
     expect(i18n.t(errorMessages[CodeMetricsUnavailable])).toBe('Metrics provider unavailable');
+    expect(i18n.t(errorMessages[CodeBundleRejected])).toBe('Bundle rejected');
   });
 });
@@ -2,11 +2,26 @@ export const CodePackageManagerFailure = 1001;
 export const CodeValidationFailed = 1002;
 export const CodePermissionDenied = 1003;
 export const CodeMetricsUnavailable = 1004;
+export const CodeBundleRejected = 1005;
+
+export interface Diagnostic {
+  line: number;
+  col: number;
+  endLine: number;
+  endCol: number;
+  section?: string;
+  key?: string;
+  severity: 'error' | 'warning' | 'info';
+  rule: string;
+  message: string;
+  fix?: string;
+}
 
 export interface BackendError {
   code: number;
   message: string;
   details?: string;
+  data?: { diagnostics?: Diagnostic[] };
   timestamp?: number;
   trace?: string;
 }
@@ -16,4 +31,5 @@ export const errorMessages: Record<number, string> = {
   [CodeValidationFailed]: 'errors.validationFailed',
   [CodePermissionDenied]: 'errors.permissionDenied',
   [CodeMetricsUnavailable]: 'errors.metricsUnavailable',
+  [CodeBundleRejected]: 'errors.bundleRejected',
 };